@@ -1,15 +1,19 @@
 package main
 
 import (
+	"bytes"
 	"context"
 	"errors"
 	"fmt"
+	"math/rand/v2"
 	"os"
 	"os/exec"
+	"path"
 	"path/filepath"
 	"runtime"
 	"strings"
 	"sync"
+	"sync/atomic"
 	"time"
 )
 
@@ -20,8 +24,16 @@ const (
 	StatusSuccess BackupStatus = "success"
 	StatusFailed  BackupStatus = "failed"
 	StatusSkipped BackupStatus = "skipped"
+	StatusPartial BackupStatus = "partial" // recorded for days still being written, never counts as done
+	StatusPruned  BackupStatus = "pruned"  // artifacts deleted by the retention policy
+	StatusCorrupt BackupStatus = "corrupt" // artifacts failed verification
+	// StatusInterrupted is recorded for dumps cut short by a shutdown; the day is retried on the next run
+	StatusInterrupted BackupStatus = "interrupted"
 )
 
+// ErrInterrupted is the cancellation cause of dumps stopped by SIGINT/SIGTERM
+var ErrInterrupted = errors.New("interrupted by shutdown")
+
 // BackupResult stores the result of a backup
 type BackupResult struct {
 	Database   string
@@ -29,237 +41,901 @@ type BackupResult struct {
 	BsonFile   string
 	MetaFile   string
 	FileSize   int64
+	RawSize    int64 // raw bytes dumped
+	StoredSize int64 // bytes written to storage, all artifacts
 	Status     BackupStatus
 	Error      error
 }
 
-// BackupDatabase performs one backup attempt for a single DB & collection/date
-func BackupDatabase(dbName string, date time.Time) BackupResult {
+// Dump modes selected by DUMP_MODE
+const (
+	DumpModeFiles   = "files"   // mongodump --out, raw .bson staged on disk then compressed
+	DumpModeArchive = "archive" // mongodump --archive streamed to storage in one pass
+)
+
+// dumpOutput is what one dump stored for a collection
+type dumpOutput struct {
+	Format    string // "bson" or "archive"
+	Files     []ArtifactInfo
+	Documents int64
+	// cleanup removes staged raw files once the backup is recorded
+	cleanup func()
+}
+
+// combineResults folds the collection results of one database and date into a single result:
+// interrupted or failed if any collection was, skipped if all were, success otherwise. Sizes are summed.
+func combineResults(dbName string, results []BackupResult) BackupResult {
+	if len(results) == 1 {
+		return results[0]
+	}
+	combined := BackupResult{Database: dbName, Status: StatusSkipped}
+	var names []string
+	var errs []error
+	skippedMissing := false
+	for _, res := range results {
+		names = append(names, res.Collection)
+		combined.FileSize += res.FileSize
+		combined.RawSize += res.RawSize
+		combined.StoredSize += res.StoredSize
+		switch res.Status {
+		case StatusInterrupted:
+			combined.Status = StatusInterrupted
+		case StatusFailed:
+			if combined.Status != StatusInterrupted {
+				combined.Status = StatusFailed
+			}
+			errs = append(errs, fmt.Errorf("%s: %w", res.Collection, res.Error))
+		case StatusSuccess:
+			if combined.Status == StatusSkipped {
+				combined.Status = StatusSuccess
+			}
+		case StatusSkipped:
+			skippedMissing = skippedMissing || res.Error != nil
+		}
+	}
+	combined.Collection = strings.Join(names, ",")
+	switch combined.Status {
+	case StatusInterrupted:
+		combined.Error = ErrInterrupted
+	case StatusFailed:
+		combined.Error = errors.Join(errs...)
+	case StatusSkipped:
+		if skippedMissing {
+			combined.Error = ErrSkipped
+		}
+	}
+	return combined
+}
+
+// BackupCollection performs one backup attempt of the collection rendered from t for the job's date.
+// Cancelling ctx with ErrInterrupted kills mongodump and records the backup as interrupted.
+func BackupCollection(ctx context.Context, job BackupJob, t CollectionTemplate) BackupResult {
+	dbName := job.Database
 	result := BackupResult{
 		Database:   dbName,
-		Collection: fmt.Sprintf("GPS_%s", FormatDate(date)),
+		Collection: t.Name(job.Date),
 		Status:     StatusFailed,
 	}
 
-	dir, err := BackupDir(dbName, date)
-	if err != nil {
-		Error.Printf("Backup failed: DB=%s Collection=%s Error=%v", dbName, result.Collection, err)
-		result.Error = err
-		return result
-	}
-
 	Info.Printf("Start backup: DB=%s Collection=%s", dbName, result.Collection)
 
-	// Check if already backed up
-	done, err := IsBackupDone(dbName, result.Collection)
+	// Every backup gets its own data key, wrapped by the active master key
+	var dk *DataKey
+	if BackupKeys != nil {
+		var err error
+		if dk, err = BackupKeys.NewDataKey(); err != nil {
+			Error.Printf("Backup failed: DB=%s Collection=%s Error=encryption error %v", dbName, result.Collection, err)
+			result.Error = err
+			SaveBackupStatus(ctx, dbName, result.Collection, string(StatusFailed), "encryption error", result.Error)
+			return result
+		}
+	}
+
+	// Pick the replica set member to dump from
+	target, err := SelectDumpTarget(ctx)
 	if err != nil {
 		Error.Printf("Backup failed: DB=%s Collection=%s Error=%v", dbName, result.Collection, err)
-		result.Error = err
+		result.Error = withClass(classifyError(err), err)
+		SaveBackupStatus(ctx, dbName, result.Collection, string(StatusFailed), "no eligible member", result.Error)
 		return result
 	}
-	if done {
-		Info.Printf("Backup skipped: DB=%s Collection=%s Reason=already exists", dbName, result.Collection)
-		result.Status = StatusSkipped
-		return result
+	if target.Source != "" {
+		Info.Printf("Dump source: DB=%s Collection=%s Source=%s", dbName, result.Collection, target.Source)
 	}
 
-	// Run mongodump with timeout
-	ctx, cancel := context.WithTimeout(context.Background(), AppConfig.BackupTimeout)
-	defer cancel()
-
-	cmd := exec.CommandContext(ctx, AppConfig.MongodumpPath,
-		"--uri", AppConfig.MongoURI,
-		"--db", dbName,
-		"--collection", result.Collection,
-		"--out", dir,
-	)
-	output, err := cmd.CombinedOutput()
-
-	if ctx.Err() == context.DeadlineExceeded {
-		Error.Printf("Backup failed: DB=%s Collection=%s Error=timeout", dbName, result.Collection)
-		SaveBackupStatus(dbName, result.Collection, string(StatusFailed), "timeout")
-		result.Error = ctx.Err()
-		return result
-	}
-
-	if err != nil {
-		outStr := string(output)
-		if strings.Contains(outStr, "ns not found") || strings.Contains(outStr, fmt.Sprintf("collection '%s' does not exist", result.Collection)) {
-			Info.Printf("Backup skipped: DB=%s Collection=%s Reason=collection not found", dbName, result.Collection)
-			result.Status = StatusSkipped
-			SaveBackupStatus(dbName, result.Collection, string(StatusSkipped), "collection not found")
-			result.Error = errors.New("skipped")
+	// Record where the oplog stands, so a restore can replay what was written during the dump
+	var oplog *OplogInfo
+	if AppConfig.OplogMode != OplogOff {
+		if oplog, err = startOplogWindow(ctx, target); err != nil {
+			Error.Printf("Backup failed: DB=%s Collection=%s Error=oplog error %v", dbName, result.Collection, err)
+			result.Error = withClass(classifyError(err), err)
+			SaveBackupStatus(ctx, dbName, result.Collection, string(StatusFailed), "oplog error", result.Error)
 			return result
 		}
-		Error.Printf("Backup failed: DB=%s Collection=%s Error=%v Output=%s", dbName, result.Collection, err, outStr)
-		SaveBackupStatus(dbName, result.Collection, string(StatusFailed), outStr)
-		result.Error = fmt.Errorf("%v (output: %s)", err, outStr)
-		return result
 	}
 
-	// Correct mongodump path: nested dbName folder
-	bsonFile := filepath.Join(dir, dbName, result.Collection+".bson")
-	metaFile := filepath.Join(dir, dbName, result.Collection+".metadata.json")
-	s2BsonFile := bsonFile + ".s2"
-	s2MetaFile := metaFile + ".s2"
-
-	// Check BSON integrity
-	if err := CheckBsonIntegrity(bsonFile); err != nil {
-		Error.Printf("Backup failed: DB=%s Collection=%s Error=BSON integrity check failed %v", dbName, result.Collection, err)
-		SaveBackupStatus(dbName, result.Collection, string(StatusFailed), "BSON integrity failed")
-		result.Error = err
+	var out dumpOutput
+	var ok bool
+	if AppConfig.DumpMode == DumpModeArchive {
+		out, ok = dumpArchive(ctx, job, &result, dk, t.All(), target)
+	} else {
+		out, ok = dumpFiles(ctx, job, &result, dk, t.All(), target)
+	}
+	if !ok {
 		return result
 	}
-
-	// Check metadata.json validity
-	if err := CheckMetadataIntegrity(metaFile); err != nil {
-		Error.Printf("Backup failed: DB=%s Collection=%s Error=metadata integrity check failed %v", dbName, result.Collection, err)
-		SaveBackupStatus(dbName, result.Collection, string(StatusFailed), "metadata integrity failed")
-		result.Error = err
+	if oplog != nil && !finishOplog(ctx, job, &result, dk, t.All(), oplog, &out) {
 		return result
 	}
 
-	// Compress files
-	filesToCompress := map[string]string{
-		bsonFile: s2BsonFile,
-		metaFile: s2MetaFile,
+	savedStatus := StatusSuccess
+	if job.Partial {
+		savedStatus = StatusPartial
 	}
-	if err := CompressFilesS2(filesToCompress); err != nil {
-		Error.Printf("Backup failed: DB=%s Collection=%s Error=compress error %v", dbName, result.Collection, err)
-		result.Error = err
-		SaveBackupStatus(dbName, result.Collection, string(StatusFailed), "compress error")
+
+	// Write manifest next to the artifacts
+	manifest := Manifest{
+		Database:         dbName,
+		Collection:       result.Collection,
+		Status:           string(savedStatus),
+		Format:           out.Format,
+		Compression:      SettingsFor(dbName).Codec.Name(),
+		DocumentCount:    out.Documents,
+		MongodumpVersion: MongodumpVersion(),
+		CreatedAt:        time.Now(),
+		Files:            out.Files,
+		Source:           target.Source,
+		Oplog:            oplog,
+	}
+	if dk != nil {
+		manifest.Encryption = &dk.Info
+	}
+	for _, f := range out.Files {
+		manifest.RawSize += f.RawSize
+		manifest.CompressedSize += f.CompressedSize
+	}
+	manifestKey := ManifestKey(out.Files[0].Key)
+	if err := WriteManifest(ctx, manifestKey, manifest); err != nil {
+		Error.Printf("Backup failed: DB=%s Collection=%s Error=manifest error %v", dbName, result.Collection, err)
+		result.Error = withClass(classifyError(err), err)
+		SaveBackupStatus(ctx, dbName, result.Collection, string(StatusFailed), "manifest error", result.Error)
 		return result
 	}
 
-	if info, err := os.Stat(s2BsonFile); err == nil {
-		result.FileSize = info.Size()
+	result.FileSize = out.Files[0].CompressedSize
+	result.RawSize = manifest.RawSize
+	result.StoredSize = manifest.CompressedSize
+	result.BsonFile = out.Files[0].Key
+	if len(out.Files) > 1 {
+		result.MetaFile = out.Files[1].Key
 	}
-	result.BsonFile = s2BsonFile
-	result.MetaFile = s2MetaFile
 	result.Status = StatusSuccess
 	result.Error = nil
 
 	// Save metadata
-	if metaErr := SaveBackupHistory(dbName, result.Collection, s2BsonFile, s2MetaFile, result.FileSize, string(StatusSuccess), "s2", "OK"); metaErr != nil {
+	history := BackupHistory{
+		Database:         dbName,
+		Collection:       result.Collection,
+		BsonFile:         result.BsonFile,
+		MetaFile:         result.MetaFile,
+		ManifestFile:     manifestKey,
+		BsonURL:          out.Files[0].URL,
+		FileSize:         result.FileSize,
+		RawSize:          manifest.RawSize,
+		CompressedSize:   manifest.CompressedSize,
+		DocumentCount:    manifest.DocumentCount,
+		MongodumpVersion: manifest.MongodumpVersion,
+		Files:            manifest.Files,
+		Status:           string(savedStatus),
+		Format:           manifest.Format,
+		Compression:      manifest.Compression,
+		Encryption:       manifest.Encryption,
+		Oplog:            oplog,
+		Message:          "OK",
+	}
+	if len(out.Files) > 1 {
+		history.MetaURL = out.Files[1].URL
+	}
+	if metaErr := SaveBackupHistory(ctx, history); metaErr != nil {
 		Error.Printf("Failed to save backup metadata: %v", metaErr)
 	}
 
-	SaveBackupStatus(dbName, result.Collection, string(StatusSuccess), "OK")
-	Info.Printf("Backup success: DB=%s Collection=%s File=%s Size=%d", dbName, result.Collection, s2BsonFile, result.FileSize)
+	SaveBackupStatus(ctx, dbName, result.Collection, string(savedStatus), "OK", nil)
+	recordBackupMetrics(dbName, savedStatus, manifest.RawSize, manifest.CompressedSize)
+	Info.Printf("Backup success: DB=%s Collection=%s File=%s Size=%d Docs=%d", dbName, result.Collection, history.BsonURL, result.FileSize, manifest.DocumentCount)
 
 	// Cleanup raw files
-	if !AppConfig.KeepRawFiles {
-		os.Remove(bsonFile)
-		os.Remove(metaFile)
+	if out.cleanup != nil && !AppConfig.KeepRawFiles {
+		out.cleanup()
 	}
 
 	return result
 }
 
-// Retry wrapper with intelligent logic
-func BackupWithRetry(dbName string, date time.Time) (int, error) {
-	var lastErr error
-	var attempt int
-	for i := 0; i < AppConfig.MaxRetries; i++ {
-		attempt = i + 1
-		res := BackupDatabase(dbName, date)
-		if res.Error == nil || res.Error.Error() == "skipped" {
-			return attempt, nil
+// dumpFiles runs mongodump --out into BACKUP_PATH, validates the raw files and
+// compresses (and encrypts, with dk) them into the storage backend. With all set the
+// whole database is dumped and every collection becomes a pair of artifacts.
+func dumpFiles(parent context.Context, job BackupJob, result *BackupResult, dk *DataKey, all bool, target DumpTarget) (dumpOutput, bool) {
+	dbName := job.Database
+	dir, err := BackupDir(dbName, result.Collection)
+	if err != nil {
+		Error.Printf("Backup failed: DB=%s Collection=%s Error=%v", dbName, result.Collection, err)
+		result.Error = withClass(classifyError(err), err)
+		return dumpOutput{}, false
+	}
+
+	// Correct mongodump path: nested dbName folder
+	dumpDir := filepath.Join(dir, dbName)
+	names := []string{result.Collection}
+	removeRaw := func() {
+		for _, name := range names {
+			os.Remove(filepath.Join(dumpDir, name+".bson"))
+			os.Remove(filepath.Join(dumpDir, name+".metadata.json"))
 		}
-		if !isRecoverableError(res.Error) {
-			Error.Printf("Backup non-recoverable: DB=%s Collection=%s Error=%v", dbName, res.Collection, res.Error)
-			return attempt, res.Error
+	}
+
+	// Run mongodump with timeout
+	settings := SettingsFor(dbName)
+	ctx, cancel := context.WithTimeout(parent, settings.Timeout)
+	defer cancel()
+
+	args := append(mongodumpArgs(target, dbName, result.Collection, all), "--out", dir)
+	cmd := exec.CommandContext(ctx, AppConfig.MongodumpPath, args...)
+	output, err := cmd.CombinedOutput()
+	if all {
+		names = dumpedCollections(dumpDir)
+	}
+	if ctx.Err() == context.DeadlineExceeded || err != nil {
+		failDump(ctx, result, err, string(output))
+		if result.Status == StatusInterrupted {
+			removeRaw()
 		}
-		lastErr = res.Error
-		time.Sleep(AppConfig.RetryInterval)
+		return dumpOutput{}, false
 	}
-	Error.Printf("Backup failed after max retries: DB=%s Collection=%s Error=%v", dbName, FormatDate(date), lastErr)
-	return attempt, lastErr
+	if len(names) == 0 {
+		Info.Printf("Backup skipped: DB=%s Collection=%s Reason=database has no collections", dbName, result.Collection)
+		result.Status = StatusSkipped
+		result.Error = ErrSkipped
+		SaveBackupStatus(parent, dbName, result.Collection, string(StatusSkipped), "database has no collections", result.Error)
+		return dumpOutput{}, false
+	}
+
+	out := dumpOutput{Format: "bson"}
+	var keys, rawFiles []string
+	for _, name := range names {
+		bsonFile := filepath.Join(dumpDir, name+".bson")
+		metaFile := filepath.Join(dumpDir, name+".metadata.json")
+		bsonKey := ArtifactKey(bsonFile, settings.Codec)
+		metaKey := ArtifactKey(metaFile, settings.Codec)
+		if dk != nil {
+			bsonKey += EncryptedExt
+			metaKey += EncryptedExt
+		}
+
+		// Check BSON integrity
+		bsonStats, err := CheckBsonIntegrity(bsonFile)
+		if err != nil {
+			Error.Printf("Backup failed: DB=%s Collection=%s Error=BSON integrity check failed %v", dbName, name, err)
+			result.Error = withClass(ErrIntegrity, err)
+			SaveBackupStatus(parent, dbName, result.Collection, string(StatusFailed), "BSON integrity failed", result.Error)
+			return dumpOutput{}, false
+		}
+
+		// Check metadata.json validity
+		if err := CheckMetadataIntegrity(metaFile); err != nil {
+			Error.Printf("Backup failed: DB=%s Collection=%s Error=metadata integrity check failed %v", dbName, name, err)
+			result.Error = withClass(ErrIntegrity, err)
+			SaveBackupStatus(parent, dbName, result.Collection, string(StatusFailed), "metadata integrity failed", result.Error)
+			return dumpOutput{}, false
+		}
+
+		Info.Printf("BSON integrity OK: DB=%s Collection=%s Docs=%d Bytes=%d", dbName, name, bsonStats.Documents, bsonStats.Bytes)
+
+		// Compress files into the storage backend, hashing on the way
+		keys = append(keys, bsonKey, metaKey)
+		rawFiles = append(rawFiles, bsonFile, metaFile)
+		bsonInfo, err := CompressFile(ctx, settings.Codec, dk, bsonFile, bsonKey)
+		var metaInfo ArtifactInfo
+		if err == nil {
+			metaInfo, err = CompressFile(ctx, settings.Codec, dk, metaFile, metaKey)
+		}
+		if err != nil {
+			if isInterrupted(ctx) {
+				markInterrupted(parent, result, "compress")
+				for _, key := range keys {
+					BackupStorage.Delete(context.Background(), key)
+				}
+				removeRaw()
+				return dumpOutput{}, false
+			}
+			Error.Printf("Backup failed: DB=%s Collection=%s Error=compress error %v", dbName, name, err)
+			result.Error = withClass(classifyError(err), err)
+			SaveBackupStatus(parent, dbName, result.Collection, string(StatusFailed), "compress error", result.Error)
+			return dumpOutput{}, false
+		}
+		out.Files = append(out.Files, bsonInfo, metaInfo)
+		out.Documents += bsonStats.Documents
+	}
+
+	out.cleanup = func() {
+		for i, key := range keys {
+			if file := rawFiles[i]; !isStoredArtifact(file, key) {
+				os.Remove(file)
+			}
+		}
+	}
+	return out, true
 }
 
-func isRecoverableError(err error) bool {
-	if err == context.DeadlineExceeded {
+// finishOplog closes the oplog window of a dump and, with OPLOG_MODE=capture, stores the
+// entries written during the dump as an artifact of the backup
+func finishOplog(ctx context.Context, job BackupJob, result *BackupResult, dk *DataKey, all bool, oplog *OplogInfo, out *dumpOutput) bool {
+	dbName := job.Database
+	fail := func(err error) bool {
+		Error.Printf("Backup failed: DB=%s Collection=%s Error=oplog error %v", dbName, result.Collection, err)
+		result.Error = withClass(classifyError(err), err)
+		SaveBackupStatus(ctx, dbName, result.Collection, string(StatusFailed), "oplog error", result.Error)
+		return false
+	}
+	if err := finishOplogWindow(ctx, oplog); err != nil {
+		return fail(err)
+	}
+	if AppConfig.OplogMode != OplogCapture {
 		return true
 	}
-	if err != nil && err.Error() == "skipped" {
+
+	dir, err := BackupDir(dbName, result.Collection)
+	if err != nil {
+		return fail(err)
+	}
+	file := filepath.Join(dir, OplogName)
+	codec := SettingsFor(dbName).Codec
+	key := ArtifactKey(file, codec)
+	if dk != nil {
+		key += EncryptedExt
+	}
+	if oplog.Entries, err = CaptureOplog(ctx, oplog, dbName, result.Collection, all, file); err != nil {
+		return fail(err)
+	}
+	info, err := CompressFile(ctx, codec, dk, file, key)
+	if err != nil {
+		return fail(err)
+	}
+	if !isStoredArtifact(file, key) {
+		os.Remove(file)
+	}
+	oplog.Key = key
+	out.Files = append(out.Files, info)
+	Info.Printf("Oplog captured: DB=%s Collection=%s Entries=%d Window=%s..%s", dbName, result.Collection, oplog.Entries, oplog.Start, oplog.End)
+	return true
+}
+
+// mongodumpArgs returns the connection and selection arguments of one mongodump run
+func mongodumpArgs(target DumpTarget, dbName, collection string, all bool) []string {
+	args := []string{"--uri", target.URI, "--db", dbName}
+	if target.ReadPreference != "" {
+		args = append(args, "--readPreference", target.ReadPreference)
+	}
+	if !all {
+		args = append(args, "--collection", collection)
+	}
+	if AppConfig.DumpParallelism > 0 {
+		args = append(args, fmt.Sprintf("--numParallelCollections=%d", AppConfig.DumpParallelism))
+	}
+	return args
+}
+
+// dumpedCollections returns the collections mongodump wrote to dumpDir
+func dumpedCollections(dumpDir string) []string {
+	entries, err := os.ReadDir(dumpDir)
+	if err != nil {
+		return nil
+	}
+	var names []string
+	for _, e := range entries {
+		if name, ok := strings.CutSuffix(e.Name(), ".bson"); ok && !e.IsDir() {
+			names = append(names, name)
+		}
+	}
+	return names
+}
+
+// dumpArchive pipes mongodump --archive through validation, hashing, compression and
+// encryption (with dk) straight into the storage backend; nothing but the artifact is written.
+// With all set the archive holds every collection of the database.
+func dumpArchive(parent context.Context, job BackupJob, result *BackupResult, dk *DataKey, all bool, target DumpTarget) (dumpOutput, bool) {
+	dbName := job.Database
+	settings := SettingsFor(dbName)
+	key := path.Join(dbName, result.Collection, dbName, result.Collection+".archive"+settings.Codec.Ext())
+	if dk != nil {
+		key += EncryptedExt
+	}
+
+	ctx, cancel := context.WithTimeout(parent, settings.Timeout)
+	defer cancel()
+
+	args := append(mongodumpArgs(target, dbName, result.Collection, all), "--archive")
+	cmd := exec.CommandContext(ctx, AppConfig.MongodumpPath, args...)
+	var stderr bytes.Buffer
+	cmd.Stderr = &stderr
+
+	info, stats, err := StreamArchive(ctx, settings.Codec, dk, cmd, key)
+	if ctx.Err() == context.DeadlineExceeded || err != nil {
+		var dumpErr *exec.ExitError
+		var corruptErr *BsonCorruptionError
+		switch {
+		case isInterrupted(ctx):
+			markInterrupted(parent, result, "mongodump")
+		case errors.As(err, &corruptErr):
+			Error.Printf("Backup failed: DB=%s Collection=%s Error=archive integrity check failed %v", dbName, result.Collection, err)
+			result.Error = withClass(ErrIntegrity, err)
+			SaveBackupStatus(parent, dbName, result.Collection, string(StatusFailed), "archive integrity failed", result.Error)
+		case errors.As(err, &dumpErr) || ctx.Err() != nil || classifyDumpError(ctx, err, "") == ErrToolMissing:
+			failDump(ctx, result, err, stderr.String())
+		default:
+			Error.Printf("Backup failed: DB=%s Collection=%s Error=stream error %v", dbName, result.Collection, err)
+			result.Error = withClass(classifyError(err), err)
+			SaveBackupStatus(parent, dbName, result.Collection, string(StatusFailed), "stream error", result.Error)
+		}
+		return dumpOutput{}, false
+	}
+
+	Info.Printf("Archive integrity OK: DB=%s Collection=%s Docs=%d Bytes=%d", dbName, result.Collection, stats.Documents, stats.Bytes)
+	return dumpOutput{Format: "archive", Files: []ArtifactInfo{info}, Documents: stats.Documents}, true
+}
+
+// failDump records a failed mongodump run on result with its error class; collections
+// that do not exist are skipped
+func failDump(ctx context.Context, result *BackupResult, err error, outStr string) {
+	dbName := result.Database
+	if isInterrupted(ctx) {
+		markInterrupted(ctx, result, "mongodump")
+		return
+	}
+	// ctx may have expired with the dump; the status write gets its own MONGO_OP_TIMEOUT
+	statusCtx := context.WithoutCancel(ctx)
+	class := classifyDumpError(ctx, err, outStr)
+	switch class {
+	case ErrTimeout:
+		Error.Printf("Backup failed: DB=%s Collection=%s Error=timeout", dbName, result.Collection)
+		result.Error = withClass(ErrTimeout, ctx.Err())
+		SaveBackupStatus(statusCtx, dbName, result.Collection, string(StatusFailed), "timeout", result.Error)
+	case ErrSkipped:
+		Info.Printf("Backup skipped: DB=%s Collection=%s Reason=collection not found", dbName, result.Collection)
+		result.Status = StatusSkipped
+		result.Error = ErrSkipped
+		SaveBackupStatus(statusCtx, dbName, result.Collection, string(StatusSkipped), "collection not found", result.Error)
+	default:
+		result.Error = withClass(class, fmt.Errorf("%v (output: %s)", err, outStr))
+		Error.Printf("Backup failed: DB=%s Collection=%s Class=%s Error=%v Output=%s", dbName, result.Collection, ErrorClass(result.Error), err, outStr)
+		msg := outStr
+		if msg == "" {
+			msg = err.Error()
+		}
+		SaveBackupStatus(statusCtx, dbName, result.Collection, string(StatusFailed), msg, result.Error)
+	}
+}
+
+// isInterrupted reports whether ctx was cancelled by a shutdown
+func isInterrupted(ctx context.Context) bool {
+	return errors.Is(context.Cause(ctx), ErrInterrupted)
+}
+
+// markInterrupted records a backup stopped by a shutdown at stage; the status write
+// outlives the cancelled ctx
+func markInterrupted(ctx context.Context, result *BackupResult, stage string) {
+	Warn.Printf("Backup interrupted: DB=%s Collection=%s Stage=%s", result.Database, result.Collection, stage)
+	SaveBackupStatus(context.WithoutCancel(ctx), result.Database, result.Collection, string(StatusInterrupted), "interrupted during "+stage, ErrInterrupted)
+	result.Status = StatusInterrupted
+	result.Error = ErrInterrupted
+}
+
+// graceContext returns a context that is cancelled with ErrInterrupted grace after parent is done,
+// so in-flight dumps can finish after a shutdown signal but not hold it up forever
+func graceContext(parent context.Context, grace time.Duration) (context.Context, context.CancelFunc) {
+	ctx, cancel := context.WithCancelCause(context.WithoutCancel(parent))
+	go func() {
+		select {
+		case <-parent.Done():
+		case <-ctx.Done():
+			return
+		}
+		timer := time.NewTimer(grace)
+		defer timer.Stop()
+		select {
+		case <-timer.C:
+			cancel(ErrInterrupted)
+		case <-ctx.Done():
+		}
+	}()
+	return ctx, func() { cancel(context.Canceled) }
+}
+
+// backupAttempt runs one attempt of the collection of job rendered from t. Once ctx is done
+// the running dump gets SHUTDOWN_GRACE to finish.
+func backupAttempt(ctx context.Context, job BackupJob, t CollectionTemplate) BackupResult {
+	dumpCtx, cancel := graceContext(ctx, AppConfig.ShutdownGrace)
+	defer cancel()
+	return BackupCollection(dumpCtx, job, t)
+}
+
+// throttledAttempt records an attempt of q that never started because the load throttle
+// kept dumps paused for longer than BACKUP_TIMEOUT
+func throttledAttempt(ctx context.Context, q *queuedJob, err error) BackupResult {
+	result := BackupResult{
+		Database:   q.job.Database,
+		Collection: q.template.Name(q.job.Date),
+		Status:     StatusFailed,
+		Error:      err,
+	}
+	Error.Printf("Backup failed: DB=%s Collection=%s Error=%v", result.Database, result.Collection, err)
+	SaveBackupStatus(ctx, result.Database, result.Collection, string(StatusFailed), "load throttle", err)
+	return result
+}
+
+// retryDelay returns the wait before retry n (1 for the first retry): RETRY_INTERVAL doubled
+// per retry and capped at RETRY_MAX_DELAY, with jitter so failed jobs do not retry in lockstep
+func retryDelay(n int) time.Duration {
+	d, max := AppConfig.RetryInterval, AppConfig.RetryMaxDelay
+	for i := 1; i < n && d < max; i++ {
+		d *= 2
+	}
+	if d > max {
+		d = max
+	}
+	if d <= 0 {
+		return 0
+	}
+	// equal jitter: between half and the full delay
+	return d/2 + time.Duration(rand.Int64N(int64(d/2)+1))
+}
+
+// retryBudget is the number of retries left to all jobs of one run (RETRY_BUDGET),
+// so a cluster-wide outage does not multiply the run time by MAX_RETRIES
+type retryBudget struct {
+	left atomic.Int64
+}
+
+func newRetryBudget(n int) *retryBudget {
+	b := &retryBudget{}
+	b.left.Store(int64(n))
+	return b
+}
+
+// take uses one retry, reporting false once the budget is spent
+func (b *retryBudget) take() bool {
+	return b.left.Add(-1) >= 0
+}
+
+// queuedJob is one collection of a BackupJob in the run queue, with its attempts so far
+type queuedJob struct {
+	job      BackupJob
+	template CollectionTemplate
+	attempts int
+	last     BackupResult
+}
+
+// stop records q as interrupted if it never ran; otherwise its last failure is final
+func (q *queuedJob) stop() {
+	if q.attempts == 0 {
+		q.last = BackupResult{
+			Database:   q.job.Database,
+			Collection: q.template.Name(q.job.Date),
+			Status:     StatusInterrupted,
+			Error:      ErrInterrupted,
+		}
+	}
+}
+
+// retry reports whether the failed last attempt of q is retried, logging why not
+func (q *queuedJob) retry(ctx context.Context, budget *retryBudget) bool {
+	res, job := q.last, q.job
+	if res.Error == nil || errors.Is(res.Error, ErrSkipped) || res.Status == StatusInterrupted {
+		return false
+	}
+	if !isRecoverableError(res.Error) {
+		Error.Printf("Backup non-recoverable: DB=%s Collection=%s Class=%s Error=%v", job.Database, res.Collection, ErrorClass(res.Error), res.Error)
+		return false
+	}
+	if q.attempts >= SettingsFor(job.Database).MaxRetries {
+		Error.Printf("Backup failed after max retries: DB=%s Collection=%s Error=%v", job.Database, res.Collection, res.Error)
+		return false
+	}
+	if ctx.Err() != nil {
+		Warn.Printf("Backup retries stopped by shutdown: DB=%s Collection=%s Error=%v", job.Database, res.Collection, res.Error)
+		return false
+	}
+	if !budget.take() {
+		Error.Printf("Backup retry budget exhausted: DB=%s Collection=%s Budget=%d Error=%v", job.Database, res.Collection, AppConfig.RetryBudget, res.Error)
 		return false
 	}
 	return true
 }
 
-func RunFullBackup(backupDate time.Time) {
-	dbs, err := ListProviderDatabases()
+// jobResult folds the final state of the collections of job into its JobResult;
+// Attempts is the highest attempt count of any collection
+func jobResult(job BackupJob, units []*queuedJob) JobResult {
+	var results []BackupResult
+	attempts := 0
+	for _, q := range units {
+		results = append(results, q.last)
+		attempts = max(attempts, q.attempts)
+	}
+	res := combineResults(job.Database, results)
+	jr := JobResult{
+		Job:      job,
+		Status:   res.Status,
+		Error:    res.Error,
+		Attempts: attempts,
+	}
+	if res.Status == StatusSuccess {
+		jr.RawSize = res.RawSize
+		jr.CompressedSize = res.StoredSize
+	}
+	if jr.Status == StatusSkipped {
+		jr.Error = nil
+		jr.SkipReason = "already backed up"
+		if errors.Is(res.Error, ErrSkipped) {
+			jr.SkipReason = "collection not found or empty"
+		}
+	}
+	if jr.Status == StatusInterrupted && attempts == 0 {
+		jr.SkipReason = "not started"
+	}
+	return jr
+}
+
+// dbLimiter caps the collections of one database dumped at the same time (DB_CONCURRENCY).
+// A job over the cap is parked until a dump of its database ends, so it does not hold a worker.
+type dbLimiter struct {
+	mu      sync.Mutex
+	limit   int
+	running map[string]int
+	parked  map[string][]*queuedJob
+}
+
+func newDBLimiter(limit int) *dbLimiter {
+	return &dbLimiter{limit: max(limit, 1), running: map[string]int{}, parked: map[string][]*queuedJob{}}
+}
+
+// acquire takes a slot of the database of q, or parks q and reports false
+func (l *dbLimiter) acquire(q *queuedJob) bool {
+	l.mu.Lock()
+	defer l.mu.Unlock()
+	dbName := q.job.Database
+	if l.running[dbName] >= l.limit {
+		l.parked[dbName] = append(l.parked[dbName], q)
+		return false
+	}
+	l.running[dbName]++
+	return true
+}
+
+// release frees a slot of dbName and returns the job parked first on it, if any
+func (l *dbLimiter) release(dbName string) *queuedJob {
+	l.mu.Lock()
+	defer l.mu.Unlock()
+	l.running[dbName]--
+	parked := l.parked[dbName]
+	if len(parked) == 0 {
+		return nil
+	}
+	l.parked[dbName] = parked[1:]
+	return parked[0]
+}
+
+// BackupJob identifies one database/date pair queued for backup
+type BackupJob struct {
+	Database string
+	Date     time.Time
+	Force    bool // re-take the backup even if it is recorded as done
+	Partial  bool // the day is not over yet, record the backup as partial
+
+	// Done holds the collections found backed up (see DoneBackups) when the job was queued;
+	// unless Force is set they are reported as skipped without another dump
+	Done map[string]bool
+}
+
+// JobResult is the final outcome of a BackupJob after retries
+type JobResult struct {
+	Job        BackupJob
+	Status     BackupStatus
+	Error      error
+	Attempts   int
+	SkipReason string
+	// Sizes of the stored backup, zero unless it succeeded
+	RawSize        int64
+	CompressedSize int64
+}
+
+// PendingBackupJobs walks back up to MaxRetryDays days from backupDate and returns
+// every database/date pair with a COLLECTIONS collection not yet backed up, oldest day first
+func PendingBackupJobs(ctx context.Context, dbs []string, backupDate time.Time) []BackupJob {
+	days := AppConfig.MaxRetryDays
+	if days <= 0 {
+		days = 1
+	}
+	var dates []time.Time
+	for offset := days - 1; offset >= 0; offset-- {
+		dates = append(dates, backupDate.AddDate(0, 0, -offset))
+	}
+
+	done, err := DoneBackups(ctx, dbs, dates)
+	if err != nil {
+		Warn.Printf("Backfill check failed, queueing every day: Error=%v", err)
+	}
+	var jobs []BackupJob
+	for _, date := range dates {
+		for _, dbName := range dbs {
+			for _, collection := range CollectionNames(date) {
+				if !done[dbName][collection] {
+					jobs = append(jobs, BackupJob{Database: dbName, Date: date, Done: done[dbName]})
+					break
+				}
+			}
+		}
+	}
+	return jobs
+}
+
+// RunFullBackup backs up the provider databases matching dbPatterns (all if empty)
+// for backupDate and the missed days before it. Every call is recorded as a run,
+// including runs with nothing to do.
+func RunFullBackup(ctx context.Context, backupDate time.Time, dbPatterns []string) *BackupRun {
+	dbs, err := ExpandDatabasePatterns(ctx, dbPatterns)
 	if err != nil {
 		Error.Printf("Failed to list databases: %v", err)
-		return
+		run := NewBackupRun(backupDate)
+		run.Finish(nil, err)
+		return run
 	}
 	if len(dbs) == 0 {
 		Info.Println("No databases found for backup.")
-		return
 	}
 
-	Info.Printf("Starting backup for %d databases", len(dbs))
+	pending := PendingBackupJobs(ctx, dbs, backupDate)
+	if len(dbs) > 0 && len(pending) == 0 {
+		Info.Printf("All %d databases are backed up for the last %d days", len(dbs), AppConfig.MaxRetryDays)
+	} else if len(pending) > 0 {
+		Info.Printf("Starting backup for %d databases (%d pending jobs)", len(dbs), len(pending))
+	}
+	return RunBackupJobs(ctx, backupDate, pending)
+}
+
+// RunBackupJobs runs jobs in order on the worker pool, one collection per worker, at most
+// DB_CONCURRENCY collections of a database at once and no more than the load throttle allows.
+// It logs one line per job and records the run summary for targetDate. Failed attempts are
+// re-queued with backoff within the run's retry budget. After ctx is done workers stop taking
+// jobs; jobs never started are reported as interrupted.
+func RunBackupJobs(ctx context.Context, targetDate time.Time, pending []BackupJob) *BackupRun {
+	run := NewBackupRun(targetDate)
+	Info.Printf("Run started: RunID=%s TargetDate=%s Jobs=%d", run.RunID, run.TargetDate, len(pending))
+
 	workerCount := AppConfig.WorkerCount
 	if workerCount <= 0 {
 		workerCount = 2 * runtime.NumCPU()
 	}
 
-	type backupResult struct {
-		DBName     string
-		Status     string
-		Error      error
-		Retries    int
-		SkipReason string
+	// one unit per job and COLLECTIONS template; pending is ordered oldest day first,
+	// so workers pick up the oldest days first
+	units := make([][]*queuedJob, len(pending))
+	var queue []*queuedJob
+	for i, job := range pending {
+		for _, t := range CollectionTemplates {
+			q := &queuedJob{job: job, template: t}
+			units[i] = append(units[i], q)
+			if name := t.Name(job.Date); job.Done[name] && !job.Force {
+				Info.Printf("Backup skipped: DB=%s Collection=%s Reason=already exists", job.Database, name)
+				q.last = BackupResult{Database: job.Database, Collection: name, Status: StatusSkipped}
+				continue
+			}
+			queue = append(queue, q)
+		}
 	}
 
-	jobs := make(chan string, len(dbs))
-	results := make(chan backupResult, len(dbs))
-	var wg sync.WaitGroup
+	// every unit is in jobs at most once, so sending never blocks
+	jobs := make(chan *queuedJob, len(queue))
+	var wg, remaining sync.WaitGroup
+	budget := newRetryBudget(AppConfig.RetryBudget)
+	limiter := newDBLimiter(AppConfig.DBConcurrency)
+	throttleCtx, stopThrottle := context.WithCancel(ctx)
+	defer stopThrottle()
+	throttle := StartThrottle(throttleCtx, workerCount)
+
+	start := time.Now()
+	metricWorkers.Set(float64(workerCount))
+	defer func() {
+		metricWorkers.Set(0)
+		metricRunDuration.Observe(time.Since(start).Seconds())
+	}()
+
+	// requeue puts q back at the end of the queue after its backoff delay, so the worker
+	// is free for other jobs meanwhile; on shutdown the last failure is final
+	requeue := func(q *queuedJob) {
+		delay := retryDelay(q.attempts)
+		Warn.Printf("Backup retry scheduled: DB=%s Collection=%s Attempt=%d Delay=%s Error=%v",
+			q.job.Database, q.last.Collection, q.attempts+1, delay.Round(time.Second), q.last.Error)
+		timer := time.NewTimer(delay)
+		defer timer.Stop()
+		select {
+		case <-timer.C:
+			jobs <- q
+		case <-ctx.Done():
+			Warn.Printf("Backup retries stopped by shutdown: DB=%s Collection=%s Error=%v", q.job.Database, q.last.Collection, q.last.Error)
+			remaining.Done()
+		}
+	}
 
 	for w := 0; w < workerCount; w++ {
 		wg.Add(1)
 		go func() {
 			defer wg.Done()
-			for dbName := range jobs {
-				attempts, err := BackupWithRetry(dbName, backupDate)
-				status := "success"
-				skipReason := ""
-				if err != nil {
-					if err.Error() == "skipped" {
-						status = "skipped"
-						skipReason = "collection not found or empty"
-					} else {
-						status = "failed"
+			for q := range jobs {
+				if ctx.Err() != nil {
+					q.stop()
+					remaining.Done()
+					continue
+				}
+				if !limiter.acquire(q) {
+					continue
+				}
+				if err := throttle.acquire(ctx, SettingsFor(q.job.Database).Timeout); err != nil {
+					if next := limiter.release(q.job.Database); next != nil {
+						jobs <- next
+					}
+					if ctx.Err() != nil {
+						q.stop()
+						remaining.Done()
+						continue
+					}
+					q.last = throttledAttempt(ctx, q, err)
+				} else {
+					metricWorkersBusy.Inc()
+					q.last = backupAttempt(ctx, q.job, q.template)
+					metricWorkersBusy.Dec()
+					throttle.release()
+					if next := limiter.release(q.job.Database); next != nil {
+						jobs <- next
 					}
 				}
-				results <- backupResult{
-					DBName:     dbName,
-					Status:     status,
-					Error:      err,
-					Retries:    attempts,
-					SkipReason: skipReason,
+				q.attempts++
+				if q.retry(ctx, budget) {
+					go requeue(q)
+					continue
 				}
+				remaining.Done()
 			}
 		}()
 	}
 
-	for _, db := range dbs {
-		jobs <- db
+	// retries go to the end of the queue
+	remaining.Add(len(queue))
+	for _, q := range queue {
+		jobs <- q
 	}
+	remaining.Wait()
 	close(jobs)
 	wg.Wait()
-	close(results)
 
-	for res := range results {
+	var all []JobResult
+	for i, job := range pending {
+		res := jobResult(job, units[i])
+		date := FormatDate(res.Job.Date)
 		switch res.Status {
-		case "success":
-			Info.Printf("[SUCCESS] DB=%s (retries=%d)", res.DBName, res.Retries)
-		case "skipped":
-			Warn.Printf("[SKIPPED] DB=%s (%s)", res.DBName, res.SkipReason)
-		case "failed":
-			Error.Printf("[FAILED] DB=%s (retries=%d, error=%v)", res.DBName, res.Retries, res.Error)
+		case StatusSuccess:
+			Info.Printf("[SUCCESS] DB=%s Date=%s (retries=%d)", res.Job.Database, date, res.Attempts)
+		case StatusSkipped:
+			Warn.Printf("[SKIPPED] DB=%s Date=%s (%s)", res.Job.Database, date, res.SkipReason)
+		case StatusInterrupted:
+			Warn.Printf("[INTERRUPTED] DB=%s Date=%s (retries=%d)", res.Job.Database, date, res.Attempts)
+		case StatusFailed:
+			Error.Printf("[FAILED] DB=%s Date=%s (retries=%d, error=%v)", res.Job.Database, date, res.Attempts, res.Error)
 		default:
-			Warn.Printf("[UNKNOWN STATUS] DB=%s: %s", res.DBName, res.Status)
+			Warn.Printf("[UNKNOWN STATUS] DB=%s Date=%s: %s", res.Job.Database, date, res.Status)
 		}
+		recordJobMetrics(res)
+		all = append(all, res)
 	}
+	run.Finish(all, nil)
+	return run
 }
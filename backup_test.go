@@ -0,0 +1,100 @@
+package main
+
+import (
+	"context"
+	"path/filepath"
+	"testing"
+	"time"
+)
+
+func TestRetryDelay(t *testing.T) {
+	defer func(cfg Config) { AppConfig = cfg }(AppConfig)
+
+	tests := []struct {
+		interval, max time.Duration
+		retry         int
+		want          time.Duration // computed delay, jittered down to half of it
+	}{
+		{5 * time.Minute, 30 * time.Minute, 1, 5 * time.Minute},
+		{5 * time.Minute, 30 * time.Minute, 2, 10 * time.Minute},
+		{5 * time.Minute, 30 * time.Minute, 3, 20 * time.Minute},
+		{5 * time.Minute, 30 * time.Minute, 4, 30 * time.Minute},
+		{5 * time.Minute, 30 * time.Minute, 60, 30 * time.Minute},
+		{time.Hour, time.Hour, 3, time.Hour},
+		{0, 30 * time.Minute, 2, 0},
+	}
+	for _, tt := range tests {
+		AppConfig.RetryInterval, AppConfig.RetryMaxDelay = tt.interval, tt.max
+		for i := 0; i < 200; i++ {
+			if got := retryDelay(tt.retry); got < tt.want/2 || got > tt.want {
+				t.Fatalf("RETRY_INTERVAL=%s RETRY_MAX_DELAY=%s: retryDelay(%d) = %s, want between %s and %s",
+					tt.interval, tt.max, tt.retry, got, tt.want/2, tt.want)
+			}
+		}
+	}
+}
+
+func TestRetryMaxDelayDefault(t *testing.T) {
+	defer func(cfg Config) { AppConfig = cfg }(AppConfig)
+	t.Setenv("MONGO_URI", "mongodb://localhost:27017")
+	t.Setenv("BACKUP_PATH", t.TempDir())
+
+	for _, tt := range []struct {
+		interval, maxDelay string
+		want               time.Duration
+	}{
+		{"", "", 30 * time.Minute},
+		{"1h", "", time.Hour},
+		{"1h", "10m", 10 * time.Minute},
+	} {
+		t.Setenv("RETRY_INTERVAL", tt.interval)
+		t.Setenv("RETRY_MAX_DELAY", tt.maxDelay)
+		if _, err := LoadConfig(); err != nil {
+			t.Fatalf("RETRY_INTERVAL=%q RETRY_MAX_DELAY=%q: %v", tt.interval, tt.maxDelay, err)
+		}
+		if AppConfig.RetryMaxDelay != tt.want {
+			t.Errorf("RETRY_INTERVAL=%q RETRY_MAX_DELAY=%q: max delay %s, want %s",
+				tt.interval, tt.maxDelay, AppConfig.RetryMaxDelay, tt.want)
+		}
+	}
+}
+
+func TestRetryBudget(t *testing.T) {
+	b := newRetryBudget(2)
+	for i, want := range []bool{true, true, false, false} {
+		if got := b.take(); got != want {
+			t.Errorf("take %d = %v, want %v", i+1, got, want)
+		}
+	}
+	if newRetryBudget(0).take() {
+		t.Error("RETRY_BUDGET=0: take = true, want retries disabled")
+	}
+}
+
+func TestRunBackupJobsSkipsDoneCollections(t *testing.T) {
+	defer func(cfg Config, s Storage) { AppConfig, BackupStorage = cfg, s }(AppConfig, BackupStorage)
+	AppConfig.BackupPath = t.TempDir()
+	AppConfig.MongodumpPath = filepath.Join(t.TempDir(), "missing-mongodump")
+	AppConfig.WorkerCount = 2
+	BackupStorage = &LocalStorage{Root: AppConfig.BackupPath}
+
+	date := time.Date(2025, 1, 31, 0, 0, 0, 0, time.Local)
+	done := map[string]bool{}
+	for _, name := range CollectionNames(date) {
+		done[name] = true
+	}
+	jobs := []BackupJob{
+		{Database: "2024_provider1", Date: date, Done: done},
+		{Database: "2024_provider2", Date: date, Done: done},
+	}
+	// mongodump does not exist: any dump attempt would fail the job
+	run := RunBackupJobs(context.Background(), date, jobs)
+	if run.Skipped != len(jobs) || run.Failed != 0 {
+		t.Fatalf("run = %d skipped, %d failed, want %d skipped", run.Skipped, run.Failed, len(jobs))
+	}
+	for _, r := range run.Results {
+		if r.Attempts != 0 || r.SkipReason != "already backed up" {
+			t.Errorf("job %s: %d attempts, skip reason %q", r.Database, r.Attempts, r.SkipReason)
+		}
+	}
+}
@@ -0,0 +1,163 @@
+package main
+
+import (
+	"bufio"
+	"encoding/binary"
+	"fmt"
+	"io"
+
+	"go.mongodb.org/mongo-driver/bson"
+)
+
+// maxBsonDocumentSize is the largest document accepted in a dump: the 16MiB server limit
+// plus the 16KiB of headroom mongodump allows for internal documents
+const maxBsonDocumentSize = 16*1024*1024 + 16*1024
+
+// archiveMagic is the magic number at the start of every mongodump --archive stream
+const archiveMagic = 0x8199e26d
+
+// archiveTerminator ends the prelude and every namespace block of an archive
+const archiveTerminator = 0xFFFFFFFF
+
+// BsonStats summarises a validated stream of BSON documents
+type BsonStats struct {
+	Documents int64
+	Bytes     int64
+}
+
+// BsonCorruptionError reports the first corrupt document of a BSON stream
+type BsonCorruptionError struct {
+	Offset   int64 // byte offset of the document's length prefix
+	Document int64 // 1-based index of the document
+	Err      error
+}
+
+func (e *BsonCorruptionError) Error() string {
+	return fmt.Sprintf("corrupt BSON document %d at offset %d: %v", e.Document, e.Offset, e.Err)
+}
+
+func (e *BsonCorruptionError) Unwrap() error { return e.Err }
+
+// bsonReader reads length-prefixed BSON documents, and archive terminators, from a stream
+type bsonReader struct {
+	r      *bufio.Reader
+	buf    []byte
+	offset int64 // bytes consumed so far
+	docs   int64 // documents read so far
+}
+
+func newBsonReader(r io.Reader) *bsonReader {
+	return &bsonReader{r: bufio.NewReaderSize(r, 1<<20), buf: make([]byte, 0, 64*1024)}
+}
+
+// next returns the next validated document, or terminator=true when allowTerminator is set
+// and an archive terminator is read. It returns io.EOF at a clean end of stream.
+// The returned document is only valid until the next call.
+func (b *bsonReader) next(allowTerminator bool) (doc bson.Raw, terminator bool, err error) {
+	var header [4]byte
+	if _, err := io.ReadFull(b.r, header[:]); err != nil {
+		if err == io.EOF {
+			return nil, false, io.EOF
+		}
+		return nil, false, b.corrupt(fmt.Errorf("truncated length prefix: %w", err))
+	}
+	length := binary.LittleEndian.Uint32(header[:])
+	if allowTerminator && length == archiveTerminator {
+		b.offset += int64(len(header))
+		return nil, true, nil
+	}
+	size := int(length)
+	if size < 5 || size > maxBsonDocumentSize {
+		return nil, false, b.corrupt(fmt.Errorf("invalid length %d", length))
+	}
+
+	if cap(b.buf) < size {
+		b.buf = make([]byte, size)
+	}
+	b.buf = b.buf[:size]
+	copy(b.buf, header[:])
+	if _, err := io.ReadFull(b.r, b.buf[len(header):]); err != nil {
+		return nil, false, b.corrupt(fmt.Errorf("truncated body, expected %d bytes: %w", size, err))
+	}
+	if err := bson.Raw(b.buf).Validate(); err != nil {
+		return nil, false, b.corrupt(err)
+	}
+
+	b.docs++
+	b.offset += int64(size)
+	return bson.Raw(b.buf), false, nil
+}
+
+// corrupt wraps err with the position of the next document in the stream
+func (b *bsonReader) corrupt(err error) error {
+	return &BsonCorruptionError{Offset: b.offset, Document: b.docs + 1, Err: err}
+}
+
+// ValidateBsonStream reads concatenated BSON documents from r, checks every length prefix
+// and validates each document with bson.Raw. Failures are returned as *BsonCorruptionError.
+func ValidateBsonStream(r io.Reader) (BsonStats, error) {
+	br := newBsonReader(r)
+	for {
+		if _, _, err := br.next(false); err != nil {
+			stats := BsonStats{Documents: br.docs, Bytes: br.offset}
+			if err == io.EOF {
+				return stats, nil
+			}
+			return stats, err
+		}
+	}
+}
+
+// ValidateArchiveStream validates a mongodump --archive stream: the magic number, the prelude
+// and every namespace header and document. Documents counts collection documents only.
+func ValidateArchiveStream(r io.Reader) (BsonStats, error) {
+	br := newBsonReader(r)
+	var stats BsonStats
+
+	var magic [4]byte
+	if _, err := io.ReadFull(br.r, magic[:]); err != nil {
+		return stats, br.corrupt(fmt.Errorf("missing archive magic number: %w", err))
+	}
+	if binary.LittleEndian.Uint32(magic[:]) != archiveMagic {
+		return stats, br.corrupt(fmt.Errorf("invalid archive magic number %x", magic))
+	}
+	br.offset = int64(len(magic))
+
+	// Prelude: archive header and collection metadata, closed by a terminator
+	for {
+		_, terminator, err := br.next(true)
+		if err == io.EOF {
+			return stats, br.corrupt(fmt.Errorf("truncated archive prelude"))
+		}
+		if err != nil {
+			return stats, err
+		}
+		if terminator {
+			break
+		}
+	}
+
+	// Body: blocks of namespace header, documents, terminator
+	expectHeader := true
+	for {
+		_, terminator, err := br.next(true)
+		stats.Bytes = br.offset
+		if err == io.EOF {
+			if !expectHeader {
+				return stats, br.corrupt(fmt.Errorf("truncated archive block"))
+			}
+			return stats, nil
+		}
+		if err != nil {
+			return stats, err
+		}
+		switch {
+		case terminator:
+			expectHeader = true
+		case expectHeader:
+			expectHeader = false
+		default:
+			stats.Documents++
+		}
+	}
+}
@@ -0,0 +1,125 @@
+package main
+
+import (
+	"bytes"
+	"encoding/binary"
+	"errors"
+	"testing"
+
+	"go.mongodb.org/mongo-driver/bson"
+)
+
+func mustMarshal(t *testing.T, docs ...interface{}) [][]byte {
+	t.Helper()
+	var out [][]byte
+	for _, d := range docs {
+		data, err := bson.Marshal(d)
+		if err != nil {
+			t.Fatal(err)
+		}
+		out = append(out, data)
+	}
+	return out
+}
+
+func TestValidateBsonStream(t *testing.T) {
+	docs := mustMarshal(t, bson.M{"_id": 1, "a": "x"}, bson.M{"_id": 2, "b": bson.A{1, 2}}, bson.M{"_id": 3})
+	valid := bytes.Join(docs, nil)
+	second := int64(len(docs[0]))
+	third := second + int64(len(docs[1]))
+
+	badType := append([]byte(nil), docs[1]...)
+	badType[4] = 0x7e // element type of the first field
+
+	badLength := make([]byte, 4)
+	binary.LittleEndian.PutUint32(badLength, 3)
+
+	tests := []struct {
+		name     string
+		stream   []byte
+		docs     int64
+		offset   int64 // offset of the corrupt document, -1 for a valid stream
+		document int64
+	}{
+		{"valid", valid, 3, -1, 0},
+		{"empty", nil, 0, -1, 0},
+		{"truncated length prefix", append(append([]byte(nil), valid...), 0x10, 0x00), 3, int64(len(valid)), 4},
+		{"truncated body", valid[:third+2+4], 2, third, 3},
+		{"invalid length", bytes.Join([][]byte{docs[0], badLength, docs[2]}, nil), 1, second, 2},
+		{"invalid element", bytes.Join([][]byte{docs[0], badType, docs[2]}, nil), 1, second, 2},
+	}
+	for _, tt := range tests {
+		t.Run(tt.name, func(t *testing.T) {
+			stats, err := ValidateBsonStream(bytes.NewReader(tt.stream))
+			if stats.Documents != tt.docs {
+				t.Errorf("Documents = %d, want %d", stats.Documents, tt.docs)
+			}
+			if tt.offset < 0 {
+				if err != nil {
+					t.Fatalf("unexpected error: %v", err)
+				}
+				if stats.Bytes != int64(len(tt.stream)) {
+					t.Errorf("Bytes = %d, want %d", stats.Bytes, len(tt.stream))
+				}
+				return
+			}
+			var corrupt *BsonCorruptionError
+			if !errors.As(err, &corrupt) {
+				t.Fatalf("got %v, want a *BsonCorruptionError", err)
+			}
+			if corrupt.Offset != tt.offset || corrupt.Document != tt.document {
+				t.Errorf("corruption at document %d offset %d, want document %d offset %d",
+					corrupt.Document, corrupt.Offset, tt.document, tt.offset)
+			}
+		})
+	}
+}
+
+// archiveStream builds a mongodump --archive stream with one namespace block per docs entry
+func archiveStream(t *testing.T, blocks ...[][]byte) []byte {
+	t.Helper()
+	var buf bytes.Buffer
+	word := func(v uint32) {
+		var b [4]byte
+		binary.LittleEndian.PutUint32(b[:], v)
+		buf.Write(b[:])
+	}
+	word(archiveMagic)
+	for _, d := range mustMarshal(t, bson.M{"formatVersion": "0.1"}, bson.M{"db": "d", "collection": "c"}) {
+		buf.Write(d)
+	}
+	word(archiveTerminator)
+	for _, docs := range blocks {
+		buf.Write(mustMarshal(t, bson.M{"db": "d", "collection": "c"})[0])
+		for _, d := range docs {
+			buf.Write(d)
+		}
+		word(archiveTerminator)
+	}
+	return buf.Bytes()
+}
+
+func TestValidateArchiveStream(t *testing.T) {
+	docs := mustMarshal(t, bson.M{"_id": 1}, bson.M{"_id": 2}, bson.M{"_id": 3})
+	valid := archiveStream(t, docs[:2], docs[2:])
+
+	stats, err := ValidateArchiveStream(bytes.NewReader(valid))
+	if err != nil {
+		t.Fatal(err)
+	}
+	if stats.Documents != 3 || stats.Bytes != int64(len(valid)) {
+		t.Errorf("stats = %+v, want 3 documents and %d bytes", stats, len(valid))
+	}
+
+	var corrupt *BsonCorruptionError
+	if _, err := ValidateArchiveStream(bytes.NewReader(valid[:len(valid)-4])); !errors.As(err, &corrupt) {
+		t.Errorf("archive without its last terminator: got %v, want a *BsonCorruptionError", err)
+	}
+	badMagic := append([]byte{0, 0, 0, 0}, valid[4:]...)
+	if _, err := ValidateArchiveStream(bytes.NewReader(badMagic)); !errors.As(err, &corrupt) || corrupt.Offset != 0 {
+		t.Errorf("invalid magic number: got %v, want a *BsonCorruptionError at offset 0", err)
+	}
+	if _, err := ValidateArchiveStream(bytes.NewReader(valid[:20])); !errors.As(err, &corrupt) {
+		t.Errorf("truncated prelude: got %v, want a *BsonCorruptionError", err)
+	}
+}
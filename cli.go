@@ -0,0 +1,116 @@
+package main
+
+import (
+	"context"
+	"flag"
+	"fmt"
+	"strings"
+	"time"
+)
+
+// stringList is a repeatable string flag
+type stringList []string
+
+func (l *stringList) String() string { return strings.Join(*l, ",") }
+
+func (l *stringList) Set(v string) error {
+	*l = append(*l, v)
+	return nil
+}
+
+// runBackupCommand implements the one-shot "backup" subcommand and returns the process exit code
+func runBackupCommand(ctx context.Context, args []string) int {
+	fs := flag.NewFlagSet("backup", flag.ContinueOnError)
+	var dbPatterns stringList
+	fs.Var(&dbPatterns, "db", "database name or glob, repeatable (default: all provider databases)")
+	date := fs.String("date", "", "backup date (YYYY-MM-DD or YYYY_MM_DD)")
+	from := fs.String("from", "", "first backup date of a range")
+	to := fs.String("to", "", "last backup date of a range")
+	force := fs.Bool("force", false, "re-take backups that are already recorded as done")
+	if err := fs.Parse(args); err != nil {
+		return 2
+	}
+
+	dates, err := ParseDateArgs(*date, *from, *to)
+	if err != nil {
+		Error.Printf("backup: %v", err)
+		return 2
+	}
+
+	if err := ConnectMongo(ctx, AppConfig.MongoURI); err != nil {
+		Error.Printf("Failed to connect MongoDB: %v", err)
+		return 1
+	}
+	defer DisconnectMongo()
+
+	dbs, err := ExpandDatabasePatterns(ctx, dbPatterns)
+	if err != nil {
+		Error.Printf("backup: %v", err)
+		return 1
+	}
+	if len(dbs) == 0 {
+		Warn.Println("backup: no databases matched")
+		return 1
+	}
+
+	var done map[string]map[string]bool
+	if !*force {
+		if done, err = DoneBackups(ctx, dbs, dates); err != nil {
+			Error.Printf("backup: %v", err)
+			return 1
+		}
+	}
+	var jobs []BackupJob
+	for _, d := range dates {
+		for _, dbName := range dbs {
+			jobs = append(jobs, BackupJob{Database: dbName, Date: d, Force: *force, Done: done[dbName]})
+		}
+	}
+
+	Info.Printf("One-shot backup: %d databases x %d days (force=%v)", len(dbs), len(dates), *force)
+	run := RunBackupJobs(ctx, dates[len(dates)-1], jobs)
+	Info.Printf("Backup finished: RunID=%s success=%d skipped=%d failed=%d interrupted=%d",
+		run.RunID, run.Success, run.Skipped, run.Failed, run.Interrupted)
+
+	if run.Failed > 0 || run.Interrupted > 0 {
+		return 1
+	}
+	return 0
+}
+
+// ParseDateArgs turns --date or --from/--to flag values into a list of days
+func ParseDateArgs(date, from, to string) ([]time.Time, error) {
+	if date != "" {
+		if from != "" || to != "" {
+			return nil, fmt.Errorf("--date cannot be combined with --from/--to")
+		}
+		d, err := ParseDate(date)
+		if err != nil {
+			return nil, err
+		}
+		return []time.Time{d}, nil
+	}
+	if from == "" {
+		return nil, fmt.Errorf("either --date or --from is required")
+	}
+
+	start, err := ParseDate(from)
+	if err != nil {
+		return nil, err
+	}
+	end := start
+	if to != "" {
+		if end, err = ParseDate(to); err != nil {
+			return nil, err
+		}
+	}
+	if end.Before(start) {
+		return nil, fmt.Errorf("--to (%s) is before --from (%s)", to, from)
+	}
+
+	var dates []time.Time
+	for d := start; !d.After(end); d = d.AddDate(0, 0, 1) {
+		dates = append(dates, d)
+	}
+	return dates, nil
+}
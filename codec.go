@@ -0,0 +1,160 @@
+package main
+
+import (
+	"fmt"
+	"io"
+	"strconv"
+	"strings"
+
+	"github.com/klauspost/compress/gzip"
+	"github.com/klauspost/compress/s2"
+	"github.com/klauspost/compress/zstd"
+)
+
+// Codec compresses and decompresses backup artifacts
+type Codec interface {
+	// Name is recorded in the manifest and backupHistory, e.g. "zstd"
+	Name() string
+	// Ext is the artifact key suffix, e.g. ".zst"; "" for uncompressed artifacts
+	Ext() string
+	NewWriter(w io.Writer) (io.WriteCloser, error)
+	NewReader(r io.Reader) (io.ReadCloser, error)
+}
+
+// BackupCodec is the codec used for new backups, from COMPRESSION
+var BackupCodec Codec = s2Codec{}
+
+// codecs lists every known codec by name; levels only matter when compressing
+var codecs = map[string]Codec{
+	"s2":   s2Codec{},
+	"zstd": zstdCodec{level: 3},
+	"gzip": gzipCodec{level: gzip.DefaultCompression},
+	"none": noneCodec{},
+}
+
+// ParseCodec parses COMPRESSION values such as "s2", "zstd", "zstd:19", "gzip:6" or "none"
+func ParseCodec(spec string) (Codec, error) {
+	name, levelStr, hasLevel := strings.Cut(strings.ToLower(strings.TrimSpace(spec)), ":")
+	if name == "" {
+		name = "s2"
+	}
+	codec, ok := codecs[name]
+	if !ok {
+		return nil, fmt.Errorf("unknown compression %q (expected s2, zstd, gzip or none)", spec)
+	}
+	if !hasLevel {
+		return codec, nil
+	}
+
+	level, err := strconv.Atoi(levelStr)
+	if err != nil {
+		return nil, fmt.Errorf("invalid compression level in %q", spec)
+	}
+	switch name {
+	case "zstd":
+		if level < 1 || level > 22 {
+			return nil, fmt.Errorf("zstd level %d out of range 1-22", level)
+		}
+		return zstdCodec{level: level}, nil
+	case "gzip":
+		if level < gzip.HuffmanOnly || level > gzip.BestCompression {
+			return nil, fmt.Errorf("gzip level %d out of range %d-%d", level, gzip.HuffmanOnly, gzip.BestCompression)
+		}
+		return gzipCodec{level: level}, nil
+	default:
+		return nil, fmt.Errorf("compression %q does not take a level", name)
+	}
+}
+
+// CodecByName returns the codec recorded as name in a manifest or backupHistory
+func CodecByName(name string) (Codec, bool) {
+	c, ok := codecs[name]
+	return c, ok
+}
+
+// SplitArtifactKey splits an artifact key into the key without its codec and encryption
+// extensions and the codec matching the extension; keys without a known extension are uncompressed
+func SplitArtifactKey(key string) (string, Codec) {
+	key = strings.TrimSuffix(key, EncryptedExt)
+	for _, c := range codecs {
+		if c.Ext() != "" && strings.HasSuffix(key, c.Ext()) {
+			return strings.TrimSuffix(key, c.Ext()), c
+		}
+	}
+	return key, noneCodec{}
+}
+
+// CodecFor returns the recorded codec if known, otherwise the codec of the key's extension
+func CodecFor(key, recorded string) Codec {
+	if c, ok := CodecByName(recorded); ok {
+		return c
+	}
+	_, c := SplitArtifactKey(key)
+	return c
+}
+
+type s2Codec struct{}
+
+func (s2Codec) Name() string { return "s2" }
+func (s2Codec) Ext() string  { return ".s2" }
+
+func (s2Codec) NewWriter(w io.Writer) (io.WriteCloser, error) {
+	return s2.NewWriter(w), nil
+}
+
+func (s2Codec) NewReader(r io.Reader) (io.ReadCloser, error) {
+	return io.NopCloser(s2.NewReader(r)), nil
+}
+
+type zstdCodec struct {
+	level int
+}
+
+func (zstdCodec) Name() string { return "zstd" }
+func (zstdCodec) Ext() string  { return ".zst" }
+
+func (c zstdCodec) NewWriter(w io.Writer) (io.WriteCloser, error) {
+	return zstd.NewWriter(w, zstd.WithEncoderLevel(zstd.EncoderLevelFromZstd(c.level)))
+}
+
+func (zstdCodec) NewReader(r io.Reader) (io.ReadCloser, error) {
+	d, err := zstd.NewReader(r)
+	if err != nil {
+		return nil, err
+	}
+	return d.IOReadCloser(), nil
+}
+
+type gzipCodec struct {
+	level int
+}
+
+func (gzipCodec) Name() string { return "gzip" }
+func (gzipCodec) Ext() string  { return ".gz" }
+
+func (c gzipCodec) NewWriter(w io.Writer) (io.WriteCloser, error) {
+	return gzip.NewWriterLevel(w, c.level)
+}
+
+func (gzipCodec) NewReader(r io.Reader) (io.ReadCloser, error) {
+	return gzip.NewReader(r)
+}
+
+type noneCodec struct{}
+
+func (noneCodec) Name() string { return "none" }
+func (noneCodec) Ext() string  { return "" }
+
+func (noneCodec) NewWriter(w io.Writer) (io.WriteCloser, error) {
+	return nopWriteCloser{w}, nil
+}
+
+func (noneCodec) NewReader(r io.Reader) (io.ReadCloser, error) {
+	return io.NopCloser(r), nil
+}
+
+type nopWriteCloser struct {
+	io.Writer
+}
+
+func (nopWriteCloser) Close() error { return nil }
@@ -1,18 +1,28 @@
 package main
 
 import (
+	"errors"
+	"fmt"
+	"net"
 	"os"
+	"path"
+	"path/filepath"
 	"runtime"
+	"sort"
 	"strconv"
+	"strings"
 	"time"
 
+	"github.com/BurntSushi/toml"
 	"github.com/joho/godotenv"
+	"gopkg.in/yaml.v3"
 )
 
 type Config struct {
 	MongoURI      string
 	BackupPath    string
 	MongodumpPath string
+	DumpMode      string // DUMP_MODE: files (default) or archive
 	Compression   string
 	RetryInterval time.Duration
 	MaxRetries    int
@@ -23,79 +33,535 @@ type Config struct {
 	LogFile       string
 	ScheduleHour  int
 	ScheduleMin   int
+	Schedules     string // SCHEDULES: "cron|dbPattern|dateOffset" entries separated by ';'
+	ScheduleTZ    string
+	// STORAGE_BACKEND: local (BACKUP_PATH, default) or s3
+	StorageBackend string
+	S3             S3Config
+	// RETENTION_DAILY/WEEKLY/MONTHLY, RETENTION_RULES: "pattern=daily:weekly:monthly;..."
+	Retention       RetentionPolicy
+	RetentionRules  string
+	RetentionDryRun bool
+	// ENCRYPTION_KEY_FILE / ENCRYPTION_KEY: master keys; ENCRYPTION_KEY_ID selects the active one
+	EncryptionKeyFile string
+	EncryptionKey     string
+	EncryptionKeyID   string
+	MetricsAddr       string // METRICS_ADDR, e.g. ":9108"; empty disables the metrics listener
+	Notify            NotifyConfig
+	ShutdownGrace     time.Duration // SHUTDOWN_GRACE: time in-flight dumps get to finish after SIGINT/SIGTERM
+	// MONGO_OP_TIMEOUT bounds single status/history reads and writes, MONGO_QUERY_TIMEOUT listings and scans
+	MongoOpTimeout    time.Duration
+	MongoQueryTimeout time.Duration
+	// DB_INCLUDE / DB_EXCLUDE: comma separated database globs; COLLECTIONS: "template|dateOffset" entries separated by ';'
+	DBInclude   string
+	DBExclude   string
+	Collections string
+	// Databases holds the per-database overrides of the config file, first match wins
+	Databases []DatabaseOverride
+	// RETRY_INTERVAL is the first retry delay, doubled per retry up to RETRY_MAX_DELAY;
+	// RETRY_BUDGET caps the retries of all jobs of one run
+	RetryMaxDelay time.Duration
+	RetryBudget   int
+	// DB_CONCURRENCY caps the collections of one database dumped at once; NUM_PARALLEL_COLLECTIONS
+	// is passed to mongodump --numParallelCollections (0: mongodump default)
+	DBConcurrency   int
+	DumpParallelism int
+	Throttle        ThrottleConfig
+	DumpRead        DumpReadConfig
+	OplogMode       string // OPLOG_MODE: off (default), record or capture
+}
+
+// DatabaseOverride changes settings for the databases matching Pattern; zero values keep the global setting
+type DatabaseOverride struct {
+	Pattern     string
+	Timeout     time.Duration
+	MaxRetries  int
+	Compression string
+	Retention   *RetentionPolicy
+	Destination *DestinationConfig
+}
+
+// DestinationConfig is the storage backend of an override. S3 settings left empty are
+// taken from the global S3 configuration.
+type DestinationConfig struct {
+	Backend string // local or s3
+	Path    string // local root
+	Bucket  string
+	Prefix  string
 }
 
 var AppConfig Config
 
-func LoadConfig() {
+// listSeparators joins config file lists into the env var syntax of the key
+var listSeparators = map[string]string{
+	"SCHEDULES":       ";",
+	"COLLECTIONS":     ";",
+	"RETENTION_RULES": ";",
+}
+
+// LoadConfig builds AppConfig from the defaults, the CONFIG_FILE (YAML or TOML) and the
+// environment, which wins over the file. Every invalid value is reported in the returned
+// error, not only the first; warnings are returned for logging once the logger is up.
+func LoadConfig() ([]string, error) {
+	var warnings []string
 	if err := godotenv.Load(); err != nil {
-		Warn.Println("Can't load .env, using environment variables")
+		warnings = append(warnings, "Can't load .env, using environment variables")
 	}
 
-	retryInterval := 5 * time.Minute
-	if v := os.Getenv("RETRY_INTERVAL"); v != "" {
-		if d, err := time.ParseDuration(v); err == nil {
-			retryInterval = d
+	src := &configSource{used: map[string]bool{}}
+	if name := os.Getenv("CONFIG_FILE"); name != "" {
+		if err := src.loadFile(name); err != nil {
+			return warnings, err
 		}
 	}
 
-	backupTimeout := 10 * time.Minute
-	if v := os.Getenv("BACKUP_TIMEOUT"); v != "" {
-		if d, err := time.ParseDuration(v); err == nil {
-			backupTimeout = d
+	// RETRY_MAX_DELAY defaults to at least RETRY_INTERVAL, so a long first delay is kept
+	retryInterval := src.duration("RETRY_INTERVAL", 5*time.Minute, 0)
+	c := Config{
+		MongoURI:          src.str("MONGO_URI"),
+		BackupPath:        src.str("BACKUP_PATH"),
+		MongodumpPath:     src.str("MONGODUMP_PATH"),
+		DumpMode:          src.oneOf("DUMP_MODE", DumpModeFiles, DumpModeFiles, DumpModeArchive),
+		Compression:       src.str("COMPRESSION"),
+		RetryInterval:     retryInterval,
+		MaxRetries:        src.integer("MAX_RETRIES", 5, 1, 100),
+		MaxRetryDays:      src.integer("MAX_RETRY_DAYS", 7, 1, 366),
+		BackupTimeout:     src.duration("BACKUP_TIMEOUT", 10*time.Minute, time.Second),
+		KeepRawFiles:      src.boolean("KEEP_RAW_FILES", false),
+		WorkerCount:       src.integer("WORKER_COUNT", runtime.NumCPU(), 1, 1024),
+		LogFile:           src.str("LOG_FILE"),
+		ScheduleHour:      src.integer("SCHEDULE_HOUR", 2, 0, 23),
+		ScheduleMin:       src.integer("SCHEDULE_MINUTE", 0, 0, 59),
+		Schedules:         src.str("SCHEDULES"),
+		ScheduleTZ:        src.str("SCHEDULE_TZ"),
+		StorageBackend:    src.oneOf("STORAGE_BACKEND", "local", "local", "s3"),
+		RetentionRules:    src.str("RETENTION_RULES"),
+		RetentionDryRun:   src.boolean("RETENTION_DRY_RUN", false),
+		EncryptionKeyFile: src.str("ENCRYPTION_KEY_FILE"),
+		EncryptionKey:     src.str("ENCRYPTION_KEY"),
+		EncryptionKeyID:   src.str("ENCRYPTION_KEY_ID"),
+		MetricsAddr:       src.str("METRICS_ADDR"),
+		ShutdownGrace:     src.duration("SHUTDOWN_GRACE", 2*time.Minute, 0),
+		MongoOpTimeout:    src.duration("MONGO_OP_TIMEOUT", 5*time.Second, time.Millisecond),
+		MongoQueryTimeout: src.duration("MONGO_QUERY_TIMEOUT", 30*time.Second, time.Millisecond),
+		DBInclude:         src.str("DB_INCLUDE"),
+		DBExclude:         src.str("DB_EXCLUDE"),
+		Collections:       src.str("COLLECTIONS"),
+		RetryMaxDelay:     src.duration("RETRY_MAX_DELAY", max(30*time.Minute, retryInterval), 0),
+		RetryBudget:       src.integer("RETRY_BUDGET", 20, 0, 100000),
+		DBConcurrency:     src.integer("DB_CONCURRENCY", 2, 1, 1024),
+		DumpParallelism:   src.integer("NUM_PARALLEL_COLLECTIONS", 0, 0, 1024),
+		S3: S3Config{
+			Endpoint:  src.str("S3_ENDPOINT"),
+			Bucket:    src.str("S3_BUCKET"),
+			Prefix:    src.str("S3_PREFIX"),
+			AccessKey: src.str("S3_ACCESS_KEY"),
+			SecretKey: src.str("S3_SECRET_KEY"),
+			Region:    src.str("S3_REGION"),
+			UseSSL:    src.boolean("S3_USE_SSL", true),
+			PartSize:  uint64(src.integer("S3_PART_SIZE_MB", 64, 5, 5120)) << 20,
+		},
+		Retention: RetentionPolicy{
+			Daily:   src.integer("RETENTION_DAILY", 0, 0, 100000),
+			Weekly:  src.integer("RETENTION_WEEKLY", 0, 0, 100000),
+			Monthly: src.integer("RETENTION_MONTHLY", 0, 0, 100000),
+		},
+		Notify: NotifyConfig{
+			Mode:       src.oneOf("NOTIFY_MODE", NotifyOnFailure, NotifyOnFailure, NotifyAlways, NotifyOff),
+			WebhookURL: src.str("NOTIFY_WEBHOOK_URL"),
+			SlackURL:   src.str("NOTIFY_SLACK_URL"),
+			RateLimit:  src.duration("NOTIFY_RATE_LIMIT", 6*time.Hour, 0),
+			SMTP: SMTPConfig{
+				Host:     src.str("SMTP_HOST"),
+				Port:     src.integer("SMTP_PORT", 587, 1, 65535),
+				Username: src.str("SMTP_USERNAME"),
+				Password: src.str("SMTP_PASSWORD"),
+				From:     src.str("SMTP_FROM"),
+				To:       src.list("SMTP_TO"),
+			},
+		},
+		Throttle: ThrottleConfig{
+			Interval:       src.duration("THROTTLE_INTERVAL", 30*time.Second, 0),
+			MaxReplLag:     src.duration("THROTTLE_MAX_REPL_LAG", time.Minute, 0),
+			MaxQueuedReads: src.integer("THROTTLE_MAX_QUEUED_READS", 100, 0, 1000000),
+			MaxConnections: src.integer("THROTTLE_MAX_CONNECTIONS", 0, 0, 1000000),
+		},
+		DumpRead: DumpReadConfig{
+			Preference: src.oneOf("DUMP_READ_PREFERENCE", "", readPreferenceModes...),
+			Tags:       src.str("DUMP_READ_TAGS"),
+			Member:     src.str("DUMP_MEMBER"),
+			MaxLag:     src.duration("DUMP_MAX_LAG", time.Minute, 0),
+			Fallback:   src.oneOf("DUMP_READ_FALLBACK", "none", "none", "primary"),
+		},
+		OplogMode: src.oneOf("OPLOG_MODE", OplogOff, OplogOff, OplogRecord, OplogCapture),
+		Databases: src.databases,
+	}
+	if c.MongodumpPath == "" {
+		c.MongodumpPath = "mongodump"
+	}
+	AppConfig = c
+
+	src.validate(&c)
+	return warnings, src.err()
+}
+
+// validate checks the values that are only meaningful together or have their own syntax
+func (s *configSource) validate(c *Config) {
+	if c.MongoURI == "" {
+		s.errs = append(s.errs, errors.New("MONGO_URI is required"))
+	}
+	if c.BackupPath == "" {
+		s.errs = append(s.errs, errors.New("BACKUP_PATH is required"))
+	}
+	if c.StorageBackend == "s3" && c.S3.Bucket == "" {
+		s.errs = append(s.errs, errors.New("S3_BUCKET is required with STORAGE_BACKEND=s3"))
+	}
+	if _, err := ParseCodec(c.Compression); err != nil {
+		s.errorf("COMPRESSION", "%v", err)
+	}
+	if c.Schedules != "" {
+		if _, err := ParseSchedules(c.Schedules); err != nil {
+			s.errorf("SCHEDULES", "%v", err)
+		}
+	}
+	if c.ScheduleTZ != "" {
+		if _, err := time.LoadLocation(c.ScheduleTZ); err != nil {
+			s.errorf("SCHEDULE_TZ", "%v", err)
+		}
+	}
+	if _, err := ParseRetentionRules(c.RetentionRules); err != nil {
+		s.errorf("RETENTION_RULES", "%v", err)
+	}
+	if _, err := ParseDatabaseFilter(c.DBInclude, c.DBExclude); err != nil {
+		s.errs = append(s.errs, err)
+	}
+	if _, err := ParseCollectionTemplates(c.Collections); err != nil {
+		s.errorf("COLLECTIONS", "%v", err)
+	}
+	if c.MetricsAddr != "" {
+		if _, _, err := net.SplitHostPort(c.MetricsAddr); err != nil {
+			s.errorf("METRICS_ADDR", "%v", err)
 		}
 	}
+	if err := validateDumpRead(c.DumpRead); err != nil {
+		s.errs = append(s.errs, err)
+	}
+	if c.EncryptionKeyFile != "" && c.EncryptionKey != "" {
+		s.errs = append(s.errs, errors.New("ENCRYPTION_KEY_FILE and ENCRYPTION_KEY cannot both be set"))
+	}
+	for _, key := range s.unusedFileKeys() {
+		s.errs = append(s.errs, fmt.Errorf("%s: unknown key %q", s.fileName, key))
+	}
+}
 
-	keepRawFiles := false
-	if v := os.Getenv("KEEP_RAW_FILES"); v == "1" || v == "true" || v == "TRUE" {
-		keepRawFiles = true
+// configSource looks values up in the environment first, then in the config file, and
+// collects every invalid value instead of stopping at the first
+type configSource struct {
+	fileName  string
+	file      map[string]string // flattened file keys in env var form, e.g. S3_BUCKET
+	fileKeys  map[string]string // env var form -> key as written in the file
+	used      map[string]bool
+	databases []DatabaseOverride
+	errs      []error
+}
+
+// loadFile reads a YAML (.yaml, .yml) or TOML (.toml) config file. Nested sections are
+// flattened into env var names: s3: {bucket: x} is S3_BUCKET.
+func (s *configSource) loadFile(name string) error {
+	data, err := os.ReadFile(name)
+	if err != nil {
+		return fmt.Errorf("CONFIG_FILE: %w", err)
+	}
+	raw := map[string]interface{}{}
+	switch strings.ToLower(filepath.Ext(name)) {
+	case ".yaml", ".yml":
+		err = yaml.Unmarshal(data, &raw)
+	case ".toml":
+		_, err = toml.Decode(string(data), &raw)
+	default:
+		return fmt.Errorf("CONFIG_FILE %s: unknown format (expected .yaml, .yml or .toml)", name)
+	}
+	if err != nil {
+		return fmt.Errorf("CONFIG_FILE %s: %w", name, err)
 	}
 
-	workerCount := runtime.NumCPU()
-	if v := os.Getenv("WORKER_COUNT"); v != "" {
-		if val, err := strconv.Atoi(v); err == nil && val > 0 {
-			workerCount = val
+	s.fileName = name
+	s.file = map[string]string{}
+	s.fileKeys = map[string]string{}
+	if dbs, ok := raw["databases"]; ok {
+		delete(raw, "databases")
+		s.databases = s.parseDatabases(dbs)
+	}
+	s.flatten("", "", raw)
+	return nil
+}
+
+func (s *configSource) flatten(prefix, filePrefix string, m map[string]interface{}) {
+	for k, v := range m {
+		key := strings.ToUpper(prefix + k)
+		fileKey := filePrefix + k
+		switch v := v.(type) {
+		case map[string]interface{}:
+			s.flatten(key+"_", fileKey+".", v)
+			continue
+		case []interface{}:
+			sep, ok := listSeparators[key]
+			if !ok {
+				sep = ","
+			}
+			items := make([]string, len(v))
+			for i, item := range v {
+				items[i] = fmt.Sprint(item)
+			}
+			s.file[key] = strings.Join(items, sep)
+		case nil:
+			s.file[key] = ""
+		default:
+			s.file[key] = fmt.Sprint(v)
 		}
+		s.fileKeys[key] = fileKey
+	}
+}
+
+func (s *configSource) lookup(key string) (string, bool) {
+	s.used[key] = true
+	if v, ok := os.LookupEnv(key); ok {
+		return v, true
+	}
+	v, ok := s.file[key]
+	return v, ok
+}
+
+// origin names where the value of key came from, for error messages
+func (s *configSource) origin(key string) string {
+	if _, ok := os.LookupEnv(key); ok {
+		return key
+	}
+	if fileKey, ok := s.fileKeys[key]; ok {
+		return fmt.Sprintf("%s (%s in %s)", key, fileKey, s.fileName)
 	}
+	return key
+}
 
-	hour := 2
-	minute := 0
-	if v := os.Getenv("SCHEDULE_HOUR"); v != "" {
-		if val, err := strconv.Atoi(v); err == nil {
-			hour = val
+func (s *configSource) errorf(key, format string, args ...interface{}) {
+	s.errs = append(s.errs, fmt.Errorf("%s: %s", s.origin(key), fmt.Sprintf(format, args...)))
+}
+
+func (s *configSource) str(key string) string {
+	v, _ := s.lookup(key)
+	return strings.TrimSpace(v)
+}
+
+func (s *configSource) list(key string) []string {
+	var items []string
+	for _, item := range strings.Split(s.str(key), ",") {
+		if item = strings.TrimSpace(item); item != "" {
+			items = append(items, item)
 		}
 	}
-	if v := os.Getenv("SCHEDULE_MINUTE"); v != "" {
-		if val, err := strconv.Atoi(v); err == nil {
-			minute = val
+	return items
+}
+
+func (s *configSource) oneOf(key, def string, allowed ...string) string {
+	v := s.str(key)
+	if v == "" {
+		return def
+	}
+	for _, a := range allowed {
+		if v == a {
+			return v
 		}
 	}
+	s.errorf(key, "invalid value %q (expected %s)", v, strings.Join(allowed, ", "))
+	return def
+}
 
-	AppConfig = Config{
-		MongoURI:      os.Getenv("MONGO_URI"),
-		BackupPath:    os.Getenv("BACKUP_PATH"),
-		MongodumpPath: os.Getenv("MONGODUMP_PATH"),
-		Compression:   os.Getenv("COMPRESSION"),
-		RetryInterval: retryInterval,
-		MaxRetries:    atoiDefault(os.Getenv("MAX_RETRIES"), 5),
-		MaxRetryDays:  atoiDefault(os.Getenv("MAX_RETRY_DAYS"), 7),
-		BackupTimeout: backupTimeout,
-		KeepRawFiles:  keepRawFiles,
-		WorkerCount:   workerCount,
-		LogFile:       os.Getenv("LOG_FILE"),
-		ScheduleHour:  hour,
-		ScheduleMin:   minute,
+func (s *configSource) duration(key string, def, min time.Duration) time.Duration {
+	v := s.str(key)
+	if v == "" {
+		return def
+	}
+	d, err := time.ParseDuration(v)
+	if err != nil {
+		s.errorf(key, "invalid duration %q", v)
+		return def
 	}
+	if d < min {
+		s.errorf(key, "%s is below the minimum of %s", d, min)
+		return def
+	}
+	return d
+}
 
-	if AppConfig.MongoURI == "" || AppConfig.BackupPath == "" {
-		Error.Println("MONGO_URI and BACKUP_PATH are required")
-		os.Exit(1)
+func (s *configSource) integer(key string, def, min, max int) int {
+	v := s.str(key)
+	if v == "" {
+		return def
 	}
+	n, err := strconv.Atoi(v)
+	if err != nil {
+		s.errorf(key, "invalid number %q", v)
+		return def
+	}
+	if n < min || n > max {
+		s.errorf(key, "%d out of range %d-%d", n, min, max)
+		return def
+	}
+	return n
 }
 
-func atoiDefault(s string, def int) int {
-	if v, err := strconv.Atoi(s); err == nil {
-		return v
+func (s *configSource) boolean(key string, def bool) bool {
+	v := s.str(key)
+	if v == "" {
+		return def
 	}
-	return def
+	b, err := strconv.ParseBool(v)
+	if err != nil {
+		s.errorf(key, "invalid boolean %q", v)
+		return def
+	}
+	return b
+}
+
+// unusedFileKeys returns the file keys no setting reads, usually typos
+func (s *configSource) unusedFileKeys() []string {
+	var keys []string
+	for key := range s.file {
+		if !s.used[key] {
+			keys = append(keys, s.fileKeys[key])
+		}
+	}
+	sort.Strings(keys)
+	return keys
+}
+
+func sortedKeys(m map[string]interface{}) []string {
+	keys := make([]string, 0, len(m))
+	for k := range m {
+		keys = append(keys, k)
+	}
+	sort.Strings(keys)
+	return keys
+}
+
+func (s *configSource) err() error {
+	return errors.Join(s.errs...)
+}
+
+// parseDatabases parses the "databases" list of per-database overrides:
+//
+//	databases:
+//	  - pattern: 2024_bigprovider
+//	    timeout: 1h
+//	    retries: 8
+//	    compression: zstd:19
+//	    retention: 7:4:6
+//	    destination: {backend: s3, bucket: big-backups, prefix: mongo}
+func (s *configSource) parseDatabases(v interface{}) []DatabaseOverride {
+	var entries []map[string]interface{}
+	switch v := v.(type) {
+	case []map[string]interface{}: // TOML [[databases]]
+		entries = v
+	case []interface{}:
+		for i, e := range v {
+			m, ok := e.(map[string]interface{})
+			if !ok {
+				s.errs = append(s.errs, fmt.Errorf("%s: databases[%d]: expected a table", s.fileName, i))
+				continue
+			}
+			entries = append(entries, m)
+		}
+	default:
+		s.errs = append(s.errs, fmt.Errorf("%s: databases: expected a list", s.fileName))
+		return nil
+	}
+
+	var overrides []DatabaseOverride
+	for i, m := range entries {
+		fail := func(format string, args ...interface{}) {
+			s.errs = append(s.errs, fmt.Errorf("%s: databases[%d]: %s", s.fileName, i, fmt.Sprintf(format, args...)))
+		}
+		o := DatabaseOverride{}
+		for _, k := range sortedKeys(m) {
+			val := m[k]
+			str := strings.TrimSpace(fmt.Sprint(val))
+			switch k {
+			case "pattern":
+				o.Pattern = str
+			case "timeout":
+				d, err := time.ParseDuration(str)
+				if err != nil || d < time.Second {
+					fail("invalid timeout %q", str)
+				}
+				o.Timeout = d
+			case "retries":
+				n, err := strconv.Atoi(str)
+				if err != nil || n < 1 || n > 100 {
+					fail("invalid retries %q (expected 1-100)", str)
+				}
+				o.MaxRetries = n
+			case "compression":
+				if _, err := ParseCodec(str); err != nil {
+					fail("%v", err)
+				}
+				o.Compression = str
+			case "retention":
+				p, err := ParseRetentionPolicy(str)
+				if err != nil {
+					fail("retention: %v", err)
+				}
+				o.Retention = &p
+			case "destination":
+				o.Destination = s.parseDestination(val, fail)
+			default:
+				fail("unknown key %q", k)
+			}
+		}
+		if o.Pattern == "" {
+			fail("pattern is required")
+		} else if _, err := path.Match(o.Pattern, ""); err != nil {
+			fail("invalid pattern %q: %v", o.Pattern, err)
+		}
+		overrides = append(overrides, o)
+	}
+	return overrides
+}
+
+func (s *configSource) parseDestination(v interface{}, fail func(string, ...interface{})) *DestinationConfig {
+	m, ok := v.(map[string]interface{})
+	if !ok {
+		fail("destination: expected a table")
+		return nil
+	}
+	d := &DestinationConfig{}
+	for _, k := range sortedKeys(m) {
+		val := m[k]
+		str := strings.TrimSpace(fmt.Sprint(val))
+		switch k {
+		case "backend":
+			d.Backend = str
+		case "path":
+			d.Path = str
+		case "bucket":
+			d.Bucket = str
+		case "prefix":
+			d.Prefix = str
+		default:
+			fail("destination: unknown key %q", k)
+		}
+	}
+	switch d.Backend {
+	case "", "local":
+		d.Backend = "local"
+		if d.Path == "" {
+			fail("destination: path is required for the local backend")
+		}
+	case "s3":
+		if d.Bucket == "" && d.Prefix == "" {
+			fail("destination: bucket or prefix is required for the s3 backend")
+		}
+	default:
+		fail("destination: unknown backend %q (expected local or s3)", d.Backend)
+	}
+	return d
 }
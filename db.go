@@ -2,8 +2,10 @@ package main
 
 import (
 	"context"
+	"errors"
 	"fmt"
-	"regexp"
+	"path"
+	"strings"
 	"time"
 
 	"go.mongodb.org/mongo-driver/bson"
@@ -14,8 +16,8 @@ import (
 var mongoClient *mongo.Client
 
 // ConnectMongo initializes a new MongoDB client with timeout
-func ConnectMongo(uri string) error {
-	ctx, cancel := context.WithTimeout(context.Background(), 10*time.Second)
+func ConnectMongo(parent context.Context, uri string) error {
+	ctx, cancel := context.WithTimeout(parent, 10*time.Second)
 	defer cancel()
 
 	client, err := mongo.Connect(ctx, options.Client().ApplyURI(uri))
@@ -30,7 +32,7 @@ func ConnectMongo(uri string) error {
 	mongoClient = client
 	Info.Println("MongoDB connected successfully")
 
-	if err := EnsureIndexes(); err != nil {
+	if err := EnsureIndexes(ctx); err != nil {
 		Error.Printf("Failed to ensure indexes: %v", err)
 	}
 
@@ -58,12 +60,12 @@ func GetMongoClient() *mongo.Client {
 }
 
 // EnsureIndexes creates indexes for backup collections
-func EnsureIndexes() error {
+func EnsureIndexes(ctx context.Context) error {
 	if mongoClient == nil {
 		return fmt.Errorf("mongoClient is nil")
 	}
 	coll := mongoClient.Database("admin").Collection("backupStatus")
-	_, err := coll.Indexes().CreateOne(context.Background(), mongo.IndexModel{
+	_, err := coll.Indexes().CreateOne(ctx, mongo.IndexModel{
 		Keys: bson.D{
 			{Key: "database", Value: 1},
 			{Key: "date", Value: 1},
@@ -76,22 +78,27 @@ func EnsureIndexes() error {
 	return err
 }
 
-// SaveBackupStatus inserts backup status document
-func SaveBackupStatus(dbName, date, status, msg string) error {
+// SaveBackupStatus inserts backup status document; the class of cause (see ErrorClass)
+// is stored as errorClass
+func SaveBackupStatus(parent context.Context, dbName, date, status, msg string, cause error) error {
 	if mongoClient == nil {
 		return fmt.Errorf("mongoClient is nil")
 	}
-	ctx, cancel := context.WithTimeout(context.Background(), 5*time.Second)
+	ctx, cancel := context.WithTimeout(parent, AppConfig.MongoOpTimeout)
 	defer cancel()
 
-	coll := mongoClient.Database("admin").Collection("backupStatus")
-	_, err := coll.InsertOne(ctx, bson.M{
+	doc := bson.M{
 		"database":  dbName,
 		"date":      date,
 		"status":    status,
 		"message":   msg,
 		"timestamp": time.Now(),
-	})
+	}
+	if cause != nil {
+		doc["errorClass"] = ErrorClass(cause)
+	}
+	coll := mongoClient.Database("admin").Collection("backupStatus")
+	_, err := coll.InsertOne(ctx, doc)
 	if err != nil {
 		Error.Printf("Failed to save backup status for %s (%s): %v", dbName, date, err)
 	} else {
@@ -100,32 +107,138 @@ func SaveBackupStatus(dbName, date, status, msg string) error {
 	return err
 }
 
-// IsBackupDone checks if backup for db+date succeeded
-func IsBackupDone(dbName, date string) (bool, error) {
+// DoneBackups returns, by database, the COLLECTIONS collections of dates that are backed up:
+// they succeeded, or were skipped (collection not found) after the end of their day, when
+// no more data can arrive. It reads backupStatus once for every database and date.
+func DoneBackups(parent context.Context, dbs []string, dates []time.Time) (map[string]map[string]bool, error) {
 	if mongoClient == nil {
-		return false, fmt.Errorf("mongoClient is nil")
+		return nil, fmt.Errorf("mongoClient is nil")
 	}
-	ctx, cancel := context.WithTimeout(context.Background(), 5*time.Second)
+	ctx, cancel := context.WithTimeout(parent, AppConfig.MongoQueryTimeout)
 	defer cancel()
 
+	dayEnds := map[string]time.Time{}
+	var names []string
+	for _, date := range dates {
+		for _, name := range CollectionNames(date) {
+			dayEnds[name] = DayEnd(date)
+			names = append(names, name)
+		}
+	}
+
 	coll := mongoClient.Database("admin").Collection("backupStatus")
-	count, err := coll.CountDocuments(ctx, bson.M{
+	cursor, err := coll.Find(ctx, bson.M{
+		"database": bson.M{"$in": dbs},
+		"date":     bson.M{"$in": names},
+		"status":   bson.M{"$in": bson.A{string(StatusSuccess), string(StatusSkipped)}},
+	}, options.Find().SetProjection(bson.M{"database": 1, "date": 1, "status": 1, "timestamp": 1}))
+	if err != nil {
+		return nil, fmt.Errorf("failed to query backup status: %w", err)
+	}
+	defer cursor.Close(ctx)
+
+	done := map[string]map[string]bool{}
+	for cursor.Next(ctx) {
+		var doc struct {
+			Database  string    `bson:"database"`
+			Date      string    `bson:"date"`
+			Status    string    `bson:"status"`
+			Timestamp time.Time `bson:"timestamp"`
+		}
+		if err := cursor.Decode(&doc); err != nil {
+			return nil, fmt.Errorf("failed to decode backup status: %w", err)
+		}
+		if doc.Status == string(StatusSkipped) && doc.Timestamp.Before(dayEnds[doc.Date]) {
+			continue
+		}
+		if done[doc.Database] == nil {
+			done[doc.Database] = map[string]bool{}
+		}
+		done[doc.Database][doc.Date] = true
+	}
+	if err := cursor.Err(); err != nil {
+		return nil, fmt.Errorf("failed to read backup status: %w", err)
+	}
+	return done, nil
+}
+
+// SaveBackupRun inserts the summary of one backup run
+func SaveBackupRun(parent context.Context, run *BackupRun) error {
+	if mongoClient == nil {
+		return fmt.Errorf("mongoClient is nil")
+	}
+	ctx, cancel := context.WithTimeout(parent, AppConfig.MongoOpTimeout)
+	defer cancel()
+
+	coll := mongoClient.Database("admin").Collection("backupRuns")
+	_, err := coll.InsertOne(ctx, run)
+	return err
+}
+
+// SuccessfulBackups returns the set of collections of dbName with a successful backup in backupHistory
+func SuccessfulBackups(parent context.Context, dbName string) (map[string]bool, error) {
+	if mongoClient == nil {
+		return nil, fmt.Errorf("mongoClient is nil")
+	}
+	ctx, cancel := context.WithTimeout(parent, AppConfig.MongoOpTimeout)
+	defer cancel()
+
+	coll := mongoClient.Database("admin").Collection("backupHistory")
+	values, err := coll.Distinct(ctx, "collection", bson.M{
 		"database": dbName,
-		"date":     date,
 		"status":   "success",
 	})
 	if err != nil {
-		Error.Printf("Failed to check backup done for %s (%s): %v", dbName, date, err)
+		return nil, fmt.Errorf("failed to query backup history for %s: %w", dbName, err)
+	}
+
+	done := map[string]bool{}
+	for _, v := range values {
+		if name, ok := v.(string); ok {
+			done[name] = true
+		}
+	}
+	return done, nil
+}
+
+// LastSuccessTimes returns the time of the latest successful backup of every database in backupHistory
+func LastSuccessTimes(parent context.Context) (map[string]time.Time, error) {
+	if mongoClient == nil {
+		return nil, fmt.Errorf("mongoClient is nil")
+	}
+	ctx, cancel := context.WithTimeout(parent, AppConfig.MongoQueryTimeout)
+	defer cancel()
+
+	coll := mongoClient.Database("admin").Collection("backupHistory")
+	cursor, err := coll.Aggregate(ctx, mongo.Pipeline{
+		{{Key: "$match", Value: bson.M{"status": "success"}}},
+		{{Key: "$group", Value: bson.M{"_id": "$database", "last": bson.M{"$max": "$timestamp"}}}},
+	})
+	if err != nil {
+		return nil, fmt.Errorf("failed to query backup history: %w", err)
+	}
+	var rows []struct {
+		Database string    `bson:"_id"`
+		Last     time.Time `bson:"last"`
+	}
+	if err := cursor.All(ctx, &rows); err != nil {
+		return nil, fmt.Errorf("failed to read backup history: %w", err)
 	}
-	return count > 0, err
+
+	times := make(map[string]time.Time, len(rows))
+	for _, r := range rows {
+		times[r.Database] = r.Last
+	}
+	return times, nil
 }
 
-// ListProviderDatabases returns databases matching YYYY_providerId
-func ListProviderDatabases() ([]string, error) {
+// ListProviderDatabases returns the databases selected by DB_INCLUDE/DB_EXCLUDE
+// (YYYY_providerId by default)
+func ListProviderDatabases(parent context.Context) ([]string, error) {
 	if mongoClient == nil {
 		return nil, fmt.Errorf("mongoClient is nil")
 	}
-	ctx, cancel := context.WithTimeout(context.Background(), 30*time.Second)
+	ctx, cancel := context.WithTimeout(parent, AppConfig.MongoQueryTimeout)
 	defer cancel()
 
 	dbs, err := mongoClient.ListDatabaseNames(ctx, bson.M{})
@@ -134,9 +247,8 @@ func ListProviderDatabases() ([]string, error) {
 	}
 
 	var filtered []string
-	providerDbPattern := regexp.MustCompile(`^\d{4}_.+`)
 	for _, db := range dbs {
-		if providerDbPattern.MatchString(db) {
+		if BackupDatabases.Match(db) {
 			filtered = append(filtered, db)
 		}
 	}
@@ -144,3 +256,198 @@ func ListProviderDatabases() ([]string, error) {
 	Info.Printf("Found %d provider databases for backup", len(filtered))
 	return filtered, nil
 }
+
+// ExpandDatabasePatterns resolves database names and globs against the provider databases
+// selected by DB_INCLUDE/DB_EXCLUDE; no patterns means every provider database. A plain name
+// that is not one of them is an error, so a typo cannot produce empty backups.
+func ExpandDatabasePatterns(ctx context.Context, patterns []string) ([]string, error) {
+	for _, p := range patterns {
+		if _, err := path.Match(p, ""); err != nil {
+			return nil, fmt.Errorf("invalid database pattern %q: %w", p, err)
+		}
+	}
+	available, err := ListProviderDatabases(ctx)
+	if err != nil {
+		return nil, err
+	}
+	return expandDatabases(patterns, available)
+}
+
+// expandDatabases returns the databases of available matching patterns, in pattern order
+func expandDatabases(patterns, available []string) ([]string, error) {
+	if len(patterns) == 0 {
+		return available, nil
+	}
+	known := map[string]bool{}
+	for _, dbName := range available {
+		known[dbName] = true
+	}
+
+	seen := map[string]bool{}
+	var result, unknown []string
+	add := func(name string) {
+		if !seen[name] {
+			seen[name] = true
+			result = append(result, name)
+		}
+	}
+	for _, p := range patterns {
+		if !strings.ContainsAny(p, "*?[") {
+			if !known[p] {
+				unknown = append(unknown, p)
+				continue
+			}
+			add(p)
+			continue
+		}
+		for _, dbName := range available {
+			if ok, _ := path.Match(p, dbName); ok {
+				add(dbName)
+			}
+		}
+	}
+	if len(unknown) > 0 {
+		return nil, fmt.Errorf("unknown databases %s: not found or not selected by DB_INCLUDE/DB_EXCLUDE", strings.Join(unknown, ", "))
+	}
+	return result, nil
+}
+
+// ReplSetMember is one member of the replSetGetStatus output
+type ReplSetMember struct {
+	Name       string    `bson:"name"`
+	StateStr   string    `bson:"stateStr"`
+	OptimeDate time.Time `bson:"optimeDate"`
+}
+
+// ReplSetMembers returns the members of the replica set, nil when the server is not part of one
+func ReplSetMembers(ctx context.Context) ([]ReplSetMember, error) {
+	var rs struct {
+		Members []ReplSetMember `bson:"members"`
+	}
+	err := mongoClient.Database("admin").RunCommand(ctx, bson.D{{Key: "replSetGetStatus", Value: 1}}).Decode(&rs)
+	var cmdErr mongo.CommandError
+	if errors.As(err, &cmdErr) && (cmdErr.Code == 76 || cmdErr.Code == 59) { // NoReplicationEnabled, CommandNotFound (mongos)
+		return nil, nil
+	}
+	if err != nil {
+		return nil, fmt.Errorf("replSetGetStatus: %w", err)
+	}
+	return rs.Members, nil
+}
+
+// ReplSetConfigMember is one member of the replSetGetConfig output
+type ReplSetConfigMember struct {
+	Host   string            `bson:"host"`
+	Hidden bool              `bson:"hidden"`
+	Tags   map[string]string `bson:"tags"`
+
+	// secondaryDelaySecs since MongoDB 5.0, slaveDelay before
+	SecondaryDelaySecs int64 `bson:"secondaryDelaySecs"`
+	SlaveDelay         int64 `bson:"slaveDelay"`
+}
+
+// Delay returns how far the member is configured to stay behind the primary
+func (m ReplSetConfigMember) Delay() time.Duration {
+	return time.Duration(max(m.SecondaryDelaySecs, m.SlaveDelay)) * time.Second
+}
+
+// ReplSetConfigMembers returns the configured members of the replica set by host
+func ReplSetConfigMembers(ctx context.Context) (map[string]ReplSetConfigMember, error) {
+	var rs struct {
+		Config struct {
+			Members []ReplSetConfigMember `bson:"members"`
+		} `bson:"config"`
+	}
+	if err := mongoClient.Database("admin").RunCommand(ctx, bson.D{{Key: "replSetGetConfig", Value: 1}}).Decode(&rs); err != nil {
+		return nil, fmt.Errorf("replSetGetConfig: %w", err)
+	}
+	members := map[string]ReplSetConfigMember{}
+	for _, m := range rs.Config.Members {
+		members[m.Host] = m
+	}
+	return members, nil
+}
+
+// ReplicationLag returns how far each secondary is behind the primary, or behind the
+// most recent member while there is no primary
+func ReplicationLag(members []ReplSetMember) map[string]time.Duration {
+	var newest time.Time
+	for _, m := range members {
+		if m.StateStr == "PRIMARY" {
+			newest = m.OptimeDate
+			break
+		}
+		if m.OptimeDate.After(newest) {
+			newest = m.OptimeDate
+		}
+	}
+	lags := map[string]time.Duration{}
+	for _, m := range members {
+		if m.StateStr == "SECONDARY" {
+			lags[m.Name] = max(newest.Sub(m.OptimeDate), 0)
+		}
+	}
+	return lags
+}
+
+// ClusterLoad is one sample of the source cluster's load, taken by the throttle
+type ClusterLoad struct {
+	ReplLag     time.Duration // highest lag of a visible, non-delayed secondary, 0 without a replica set
+	QueuedReads int64         // globalLock.currentQueue.readers
+	Connections int64         // connections.current
+}
+
+func (l ClusterLoad) String() string {
+	return fmt.Sprintf("ReplLag=%s QueuedReads=%d Connections=%d", l.ReplLag, l.QueuedReads, l.Connections)
+}
+
+// SampleClusterLoad reads serverStatus and replSetGetStatus of the server mongoClient
+// sends commands to (the primary of a replica set)
+func SampleClusterLoad(parent context.Context) (ClusterLoad, error) {
+	var load ClusterLoad
+	if mongoClient == nil {
+		return load, fmt.Errorf("mongoClient is nil")
+	}
+	ctx, cancel := context.WithTimeout(parent, AppConfig.MongoOpTimeout)
+	defer cancel()
+
+	var status struct {
+		GlobalLock struct {
+			CurrentQueue struct {
+				Readers int64 `bson:"readers"`
+			} `bson:"currentQueue"`
+		} `bson:"globalLock"`
+		Connections struct {
+			Current int64 `bson:"current"`
+		} `bson:"connections"`
+	}
+	if err := mongoClient.Database("admin").RunCommand(ctx, bson.D{{Key: "serverStatus", Value: 1}}).Decode(&status); err != nil {
+		return load, fmt.Errorf("serverStatus: %w", err)
+	}
+	load.QueuedReads = status.GlobalLock.CurrentQueue.Readers
+	load.Connections = status.Connections.Current
+
+	members, err := ReplSetMembers(ctx)
+	if err != nil || members == nil {
+		return load, err
+	}
+	configs, err := ReplSetConfigMembers(ctx)
+	if err != nil {
+		return load, err
+	}
+	load.ReplLag = maxReplicationLag(members, configs)
+	return load, nil
+}
+
+// maxReplicationLag returns the highest lag of the secondaries. Hidden and delayed members
+// are left out: they serve no reads and a delayed one never catches up by design.
+func maxReplicationLag(members []ReplSetMember, configs map[string]ReplSetConfigMember) time.Duration {
+	var lag time.Duration
+	for name, l := range ReplicationLag(members) {
+		if c := configs[name]; c.Hidden || c.Delay() > 0 {
+			continue
+		}
+		lag = max(lag, l)
+	}
+	return lag
+}
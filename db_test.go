@@ -0,0 +1,38 @@
+package main
+
+import (
+	"strings"
+	"testing"
+)
+
+func TestExpandDatabases(t *testing.T) {
+	// ListProviderDatabases already applied DB_INCLUDE/DB_EXCLUDE
+	available := []string{"2024_provider1", "2024_provider2", "2025_provider1"}
+	tests := []struct {
+		patterns []string
+		want     []string
+		unknown  string
+	}{
+		{nil, available, ""},
+		{[]string{"2025_*", "2024_provider1", "2024_*"}, []string{"2025_provider1", "2024_provider1", "2024_provider2"}, ""},
+		{[]string{"2023_*"}, nil, ""},
+		{[]string{"2024_provider1", "2024_provdier2"}, nil, "2024_provdier2"},
+		// excluded or not matching DB_INCLUDE
+		{[]string{"2024_internal", "admin"}, nil, "2024_internal, admin"},
+	}
+	for _, tt := range tests {
+		got, err := expandDatabases(tt.patterns, available)
+		if tt.unknown != "" {
+			if err == nil || !strings.Contains(err.Error(), tt.unknown) {
+				t.Errorf("expandDatabases(%q): got %v, want an error naming %s", tt.patterns, err, tt.unknown)
+			}
+			continue
+		}
+		if err != nil {
+			t.Fatalf("expandDatabases(%q): %v", tt.patterns, err)
+		}
+		if strings.Join(got, " ") != strings.Join(tt.want, " ") {
+			t.Errorf("expandDatabases(%q) = %v, want %v", tt.patterns, got, tt.want)
+		}
+	}
+}
@@ -0,0 +1,516 @@
+package main
+
+import (
+	"bufio"
+	"context"
+	"crypto/aes"
+	"crypto/cipher"
+	"crypto/rand"
+	"crypto/sha256"
+	"encoding/base64"
+	"encoding/binary"
+	"encoding/hex"
+	"errors"
+	"flag"
+	"fmt"
+	"io"
+	"os"
+	"path"
+	"strings"
+)
+
+// EncryptedExt is appended to the key of encrypted artifacts, e.g. GPS_<date>.bson.zst.enc
+const EncryptedExt = ".enc"
+
+// EncryptionAlgorithm is the only supported artifact encryption
+const EncryptionAlgorithm = "aes-256-gcm-chunked"
+
+const (
+	encryptionMagic     = "MBE1"
+	encryptionChunkSize = 64 << 10
+	encryptionFinalFlag = 1 << 31
+)
+
+// EncryptionInfo records how the artifacts of a backup are encrypted. The data key is
+// wrapped by the master key KeyID; rekey re-wraps it without touching the artifacts.
+type EncryptionInfo struct {
+	Algorithm  string `json:"algorithm" bson:"algorithm"`
+	KeyID      string `json:"keyId" bson:"keyId"`
+	WrappedKey string `json:"wrappedKey" bson:"wrappedKey"` // base64 nonce + AES-GCM sealed data key
+}
+
+// Keyring holds the master keys by ID; Active wraps new data keys
+type Keyring struct {
+	keys   map[string][]byte
+	Active string
+}
+
+// BackupKeys is the master keyring, nil when encryption is disabled
+var BackupKeys *Keyring
+
+// LoadKeyring builds the keyring from ENCRYPTION_KEY_FILE and ENCRYPTION_KEY.
+// The key file holds one "<keyID>=<key>" or bare "<key>" per line; keys are 32 bytes
+// in hex or base64. It returns nil when no key is configured.
+func LoadKeyring(keyFile, keyEnv, activeID string) (*Keyring, error) {
+	kr := &Keyring{keys: map[string][]byte{}}
+	add := func(entry, source string) error {
+		id, value := "", entry
+		if _, err := parseMasterKey(entry); err != nil {
+			// Not a bare key, expect <keyID>=<key>
+			id, value, _ = strings.Cut(entry, "=")
+		}
+		key, err := parseMasterKey(strings.TrimSpace(value))
+		if err != nil {
+			return fmt.Errorf("%s: %w", source, err)
+		}
+		id = strings.TrimSpace(id)
+		if id == "" {
+			id = keyFingerprint(key)
+		}
+		kr.keys[id] = key
+		kr.Active = id
+		return nil
+	}
+
+	if keyFile != "" {
+		f, err := os.Open(keyFile)
+		if err != nil {
+			return nil, fmt.Errorf("failed to open ENCRYPTION_KEY_FILE: %w", err)
+		}
+		defer f.Close()
+		scanner := bufio.NewScanner(f)
+		for line := 1; scanner.Scan(); line++ {
+			entry := strings.TrimSpace(scanner.Text())
+			if entry == "" || strings.HasPrefix(entry, "#") {
+				continue
+			}
+			if err := add(entry, fmt.Sprintf("%s:%d", keyFile, line)); err != nil {
+				return nil, err
+			}
+		}
+		if err := scanner.Err(); err != nil {
+			return nil, err
+		}
+	}
+	if keyEnv != "" {
+		if err := add(keyEnv, "ENCRYPTION_KEY"); err != nil {
+			return nil, err
+		}
+	}
+
+	if len(kr.keys) == 0 {
+		if activeID != "" {
+			return nil, fmt.Errorf("ENCRYPTION_KEY_ID is set but no master key is configured")
+		}
+		return nil, nil
+	}
+	if activeID != "" {
+		if _, ok := kr.keys[activeID]; !ok {
+			return nil, fmt.Errorf("ENCRYPTION_KEY_ID %q not found in the configured master keys", activeID)
+		}
+		kr.Active = activeID
+	}
+	return kr, nil
+}
+
+// parseMasterKey decodes a 32-byte key given in hex or base64
+func parseMasterKey(s string) ([]byte, error) {
+	if key, err := hex.DecodeString(s); err == nil && len(key) == 32 {
+		return key, nil
+	}
+	if key, err := base64.StdEncoding.DecodeString(s); err == nil && len(key) == 32 {
+		return key, nil
+	}
+	return nil, errors.New("master key must be 32 bytes in hex or base64")
+}
+
+// keyFingerprint is the default ID of a master key
+func keyFingerprint(key []byte) string {
+	sum := sha256.Sum256(key)
+	return hex.EncodeToString(sum[:8])
+}
+
+// DataKey is the per-backup key that encrypts its artifacts
+type DataKey struct {
+	key  []byte
+	Info EncryptionInfo
+}
+
+// NewDataKey generates a data key wrapped by the active master key
+func (kr *Keyring) NewDataKey() (*DataKey, error) {
+	key := make([]byte, 32)
+	if _, err := rand.Read(key); err != nil {
+		return nil, err
+	}
+	info, err := kr.wrap(kr.Active, key)
+	if err != nil {
+		return nil, err
+	}
+	return &DataKey{key: key, Info: info}, nil
+}
+
+// Unwrap recovers the data key of info with the master key it was wrapped by
+func (kr *Keyring) Unwrap(info EncryptionInfo) (*DataKey, error) {
+	if info.Algorithm != EncryptionAlgorithm {
+		return nil, fmt.Errorf("unsupported encryption %q", info.Algorithm)
+	}
+	master, ok := kr.keys[info.KeyID]
+	if !ok {
+		return nil, fmt.Errorf("master key %q is not configured", info.KeyID)
+	}
+	sealed, err := base64.StdEncoding.DecodeString(info.WrappedKey)
+	if err != nil {
+		return nil, fmt.Errorf("invalid wrapped data key: %w", err)
+	}
+	gcm, err := newGCM(master)
+	if err != nil {
+		return nil, err
+	}
+	if len(sealed) < gcm.NonceSize() {
+		return nil, errors.New("invalid wrapped data key: too short")
+	}
+	key, err := gcm.Open(nil, sealed[:gcm.NonceSize()], sealed[gcm.NonceSize():], []byte(info.KeyID))
+	if err != nil {
+		return nil, fmt.Errorf("failed to unwrap data key with master key %q: %w", info.KeyID, err)
+	}
+	return &DataKey{key: key, Info: info}, nil
+}
+
+// Rewrap wraps the data key of info with the active master key
+func (kr *Keyring) Rewrap(info EncryptionInfo) (EncryptionInfo, error) {
+	dk, err := kr.Unwrap(info)
+	if err != nil {
+		return info, err
+	}
+	return kr.wrap(kr.Active, dk.key)
+}
+
+func (kr *Keyring) wrap(keyID string, key []byte) (EncryptionInfo, error) {
+	gcm, err := newGCM(kr.keys[keyID])
+	if err != nil {
+		return EncryptionInfo{}, err
+	}
+	nonce := make([]byte, gcm.NonceSize())
+	if _, err := rand.Read(nonce); err != nil {
+		return EncryptionInfo{}, err
+	}
+	sealed := gcm.Seal(nonce, nonce, key, []byte(keyID))
+	return EncryptionInfo{
+		Algorithm:  EncryptionAlgorithm,
+		KeyID:      keyID,
+		WrappedKey: base64.StdEncoding.EncodeToString(sealed),
+	}, nil
+}
+
+func newGCM(key []byte) (cipher.AEAD, error) {
+	block, err := aes.NewCipher(key)
+	if err != nil {
+		return nil, err
+	}
+	return cipher.NewGCM(block)
+}
+
+// ArtifactDataKey returns the data key of an encrypted artifact from the manifest next to it,
+// or nil for unencrypted artifacts
+func ArtifactDataKey(ctx context.Context, key string) (*DataKey, error) {
+	if !strings.HasSuffix(key, EncryptedExt) {
+		return nil, nil
+	}
+	if BackupKeys == nil {
+		return nil, fmt.Errorf("%s is encrypted but no master key is configured", key)
+	}
+	m, err := ReadManifest(ctx, ManifestKey(key))
+	if err != nil {
+		return nil, fmt.Errorf("failed to read data key of %s: %w", key, err)
+	}
+	if m.Encryption == nil {
+		return nil, fmt.Errorf("manifest of %s has no encryption info", key)
+	}
+	return BackupKeys.Unwrap(*m.Encryption)
+}
+
+// encryptWriter seals the stream in chunks of encryptionChunkSize. Each chunk is stored as a
+// 4-byte length (high bit marks the final chunk) and the sealed bytes; the nonce is a random
+// per-artifact prefix plus the chunk counter, and the final flag is authenticated so
+// truncation is detected.
+type encryptWriter struct {
+	w       io.Writer
+	gcm     cipher.AEAD
+	nonce   []byte
+	counter uint32
+	buf     []byte
+	err     error
+}
+
+// NewEncryptWriter returns a writer that encrypts to w with dk; Close seals the final chunk
+func NewEncryptWriter(w io.Writer, dk *DataKey) (io.WriteCloser, error) {
+	gcm, err := newGCM(dk.key)
+	if err != nil {
+		return nil, err
+	}
+	nonce := make([]byte, gcm.NonceSize())
+	if _, err := rand.Read(nonce[:8]); err != nil {
+		return nil, err
+	}
+	header := append([]byte(encryptionMagic), nonce[:8]...)
+	if _, err := w.Write(header); err != nil {
+		return nil, err
+	}
+	return &encryptWriter{w: w, gcm: gcm, nonce: nonce, buf: make([]byte, 0, encryptionChunkSize)}, nil
+}
+
+func (e *encryptWriter) Write(p []byte) (int, error) {
+	if e.err != nil {
+		return 0, e.err
+	}
+	n := len(p)
+	for len(p) > 0 {
+		if len(e.buf) == encryptionChunkSize {
+			if e.err = e.seal(false); e.err != nil {
+				return 0, e.err
+			}
+		}
+		k := copy(e.buf[len(e.buf):cap(e.buf)], p)
+		e.buf = e.buf[:len(e.buf)+k]
+		p = p[k:]
+	}
+	return n, nil
+}
+
+func (e *encryptWriter) Close() error {
+	if e.err != nil {
+		return e.err
+	}
+	err := e.seal(true)
+	e.err = err
+	if err == nil {
+		e.err = errors.New("encrypt writer closed")
+	}
+	return err
+}
+
+func (e *encryptWriter) seal(final bool) error {
+	binary.BigEndian.PutUint32(e.nonce[8:], e.counter)
+	e.counter++
+	flag := []byte{0}
+	if final {
+		flag[0] = 1
+	}
+	sealed := e.gcm.Seal(nil, e.nonce, e.buf, flag)
+	length := uint32(len(sealed))
+	if final {
+		length |= encryptionFinalFlag
+	}
+	var hdr [4]byte
+	binary.BigEndian.PutUint32(hdr[:], length)
+	e.buf = e.buf[:0]
+	if _, err := e.w.Write(hdr[:]); err != nil {
+		return err
+	}
+	_, err := e.w.Write(sealed)
+	return err
+}
+
+// decryptReader opens the chunks written by encryptWriter
+type decryptReader struct {
+	r       io.Reader
+	gcm     cipher.AEAD
+	nonce   []byte
+	counter uint32
+	plain   []byte
+	final   bool
+}
+
+// NewDecryptReader returns a reader that decrypts r with dk
+func NewDecryptReader(r io.Reader, dk *DataKey) (io.Reader, error) {
+	gcm, err := newGCM(dk.key)
+	if err != nil {
+		return nil, err
+	}
+	header := make([]byte, len(encryptionMagic)+8)
+	if _, err := io.ReadFull(r, header); err != nil {
+		return nil, fmt.Errorf("encrypted header: %w", err)
+	}
+	if string(header[:len(encryptionMagic)]) != encryptionMagic {
+		return nil, errors.New("not an encrypted artifact")
+	}
+	nonce := make([]byte, gcm.NonceSize())
+	copy(nonce, header[len(encryptionMagic):])
+	return &decryptReader{r: r, gcm: gcm, nonce: nonce}, nil
+}
+
+func (d *decryptReader) Read(p []byte) (int, error) {
+	for len(d.plain) == 0 {
+		if d.final {
+			return 0, io.EOF
+		}
+		if err := d.open(); err != nil {
+			return 0, err
+		}
+	}
+	n := copy(p, d.plain)
+	d.plain = d.plain[n:]
+	return n, nil
+}
+
+func (d *decryptReader) open() error {
+	var hdr [4]byte
+	if _, err := io.ReadFull(d.r, hdr[:]); err != nil {
+		if err == io.EOF {
+			err = io.ErrUnexpectedEOF
+		}
+		return fmt.Errorf("encrypted chunk %d: truncated artifact: %w", d.counter, err)
+	}
+	length := binary.BigEndian.Uint32(hdr[:])
+	final := length&encryptionFinalFlag != 0
+	length &^= encryptionFinalFlag
+	if length > encryptionChunkSize+uint32(d.gcm.Overhead()) {
+		return fmt.Errorf("encrypted chunk %d: invalid length %d", d.counter, length)
+	}
+	sealed := make([]byte, length)
+	if _, err := io.ReadFull(d.r, sealed); err != nil {
+		return fmt.Errorf("encrypted chunk %d: truncated artifact: %w", d.counter, err)
+	}
+
+	binary.BigEndian.PutUint32(d.nonce[8:], d.counter)
+	flag := []byte{0}
+	if final {
+		flag[0] = 1
+	}
+	plain, err := d.gcm.Open(sealed[:0], d.nonce, sealed, flag)
+	if err != nil {
+		return fmt.Errorf("encrypted chunk %d: authentication failed", d.counter)
+	}
+	d.counter++
+	d.plain = plain
+	d.final = final
+	if final {
+		if n, _ := d.r.Read(make([]byte, 1)); n > 0 {
+			return fmt.Errorf("encrypted chunk %d: trailing data after final chunk", d.counter)
+		}
+	}
+	return nil
+}
+
+// runRekeyCommand implements the "rekey" subcommand: the data keys of every backup not yet
+// wrapped by the active master key are re-wrapped in the manifest and backupHistory
+func runRekeyCommand(ctx context.Context, args []string) int {
+	fs := flag.NewFlagSet("rekey", flag.ContinueOnError)
+	var dbPatterns stringList
+	fs.Var(&dbPatterns, "db", "database name or glob, repeatable (default: all)")
+	dryRun := fs.Bool("dry-run", false, "only log which backups would be re-wrapped")
+	if err := fs.Parse(args); err != nil {
+		return 2
+	}
+	if BackupKeys == nil {
+		Error.Printf("rekey: no master key configured (ENCRYPTION_KEY_FILE or ENCRYPTION_KEY)")
+		return 2
+	}
+
+	if err := ConnectMongo(ctx, AppConfig.MongoURI); err != nil {
+		Warn.Printf("rekey: MongoDB unavailable, backupHistory will not be updated: %v", err)
+	} else {
+		defer DisconnectMongo()
+	}
+
+	objects, err := BackupStorage.List(ctx, "")
+	if err != nil {
+		Error.Printf("rekey: %v", err)
+		return 1
+	}
+
+	rewrapped, failed := 0, 0
+	interrupted := false
+	for _, obj := range objects {
+		if ctx.Err() != nil {
+			Warn.Printf("Shutdown signal received, rekey stopped after %d backups", rewrapped)
+			interrupted = true
+			break
+		}
+		if path.Base(obj.Key) != ManifestName || strings.HasPrefix(obj.Key, "_") {
+			continue
+		}
+		m, err := ReadManifest(ctx, obj.Key)
+		if err != nil {
+			Error.Printf("rekey: %v", err)
+			failed++
+			continue
+		}
+		if m.Encryption == nil || m.Encryption.KeyID == BackupKeys.Active || !matchesAny(m.Database, dbPatterns) {
+			continue
+		}
+		if *dryRun {
+			Info.Printf("[DRY-RUN] Rekey would re-wrap: DB=%s Collection=%s KeyID=%s -> %s", m.Database, m.Collection, m.Encryption.KeyID, BackupKeys.Active)
+			rewrapped++
+			continue
+		}
+
+		oldID := m.Encryption.KeyID
+		info, err := BackupKeys.Rewrap(*m.Encryption)
+		if err != nil {
+			Error.Printf("Rekey failed: DB=%s Collection=%s Error=%v", m.Database, m.Collection, err)
+			failed++
+			continue
+		}
+		m.Encryption = &info
+		if err := WriteManifest(ctx, obj.Key, m); err != nil {
+			Error.Printf("Rekey failed: DB=%s Collection=%s Error=%v", m.Database, m.Collection, err)
+			failed++
+			continue
+		}
+		if mongoClient != nil {
+			if err := SetBackupHistoryEncryption(ctx, m.Database, m.Collection, info); err != nil {
+				Warn.Printf("Rekey: failed to update backupHistory: DB=%s Collection=%s Error=%v", m.Database, m.Collection, err)
+			}
+		}
+		Info.Printf("Rekey success: DB=%s Collection=%s KeyID=%s -> %s", m.Database, m.Collection, oldID, info.KeyID)
+		rewrapped++
+	}
+
+	Info.Printf("Rekey finished: rewrapped=%d failed=%d dryRun=%v", rewrapped, failed, *dryRun)
+	if failed > 0 || interrupted {
+		return 1
+	}
+	return 0
+}
+
+// newArtifactWriter stacks codec compression on top of encryption with dk (nil for plain
+// artifacts); closing it flushes both layers
+func newArtifactWriter(w io.Writer, codec Codec, dk *DataKey) (io.WriteCloser, error) {
+	if dk == nil {
+		return codec.NewWriter(w)
+	}
+	enc, err := NewEncryptWriter(w, dk)
+	if err != nil {
+		return nil, err
+	}
+	cw, err := codec.NewWriter(enc)
+	if err != nil {
+		return nil, err
+	}
+	return &stackedWriter{WriteCloser: cw, inner: enc}, nil
+}
+
+type stackedWriter struct {
+	io.WriteCloser
+	inner io.Closer
+}
+
+func (s *stackedWriter) Close() error {
+	if err := s.WriteCloser.Close(); err != nil {
+		return err
+	}
+	return s.inner.Close()
+}
+
+// newArtifactReader decrypts r with dk (nil for plain artifacts) and decompresses it with codec
+func newArtifactReader(r io.Reader, codec Codec, dk *DataKey) (io.ReadCloser, error) {
+	if dk != nil {
+		dr, err := NewDecryptReader(r, dk)
+		if err != nil {
+			return nil, err
+		}
+		r = dr
+	}
+	return codec.NewReader(r)
+}
@@ -0,0 +1,191 @@
+package main
+
+import (
+	"bytes"
+	"crypto/rand"
+	"encoding/base64"
+	"encoding/hex"
+	"io"
+	"os"
+	"path/filepath"
+	"strings"
+	"testing"
+)
+
+func testKeyring(t *testing.T) *Keyring {
+	t.Helper()
+	kr, err := LoadKeyring("", hex.EncodeToString(bytes.Repeat([]byte{7}, 32)), "")
+	if err != nil {
+		t.Fatal(err)
+	}
+	return kr
+}
+
+func encrypt(t *testing.T, plain []byte, codec Codec, dk *DataKey) []byte {
+	t.Helper()
+	var buf bytes.Buffer
+	w, err := newArtifactWriter(&buf, codec, dk)
+	if err != nil {
+		t.Fatal(err)
+	}
+	// Odd write sizes cross the chunk boundaries at arbitrary points
+	for rest := plain; len(rest) > 0; {
+		n := min(len(rest), 10007)
+		if _, err := w.Write(rest[:n]); err != nil {
+			t.Fatal(err)
+		}
+		rest = rest[n:]
+	}
+	if err := w.Close(); err != nil {
+		t.Fatal(err)
+	}
+	return buf.Bytes()
+}
+
+func decrypt(stored []byte, codec Codec, dk *DataKey) ([]byte, error) {
+	r, err := newArtifactReader(bytes.NewReader(stored), codec, dk)
+	if err != nil {
+		return nil, err
+	}
+	defer r.Close()
+	return io.ReadAll(r)
+}
+
+func TestEncryptionRoundTrip(t *testing.T) {
+	kr := testKeyring(t)
+	dk, err := kr.NewDataKey()
+	if err != nil {
+		t.Fatal(err)
+	}
+	random := make([]byte, 3*encryptionChunkSize+17)
+	if _, err := rand.Read(random); err != nil {
+		t.Fatal(err)
+	}
+
+	for _, size := range []int{0, 1, encryptionChunkSize - 1, encryptionChunkSize, encryptionChunkSize + 1, 2 * encryptionChunkSize, len(random)} {
+		for _, name := range []string{"none", "s2", "zstd", "gzip"} {
+			codec, _ := CodecByName(name)
+			plain := random[:size]
+			stored := encrypt(t, plain, codec, dk)
+			got, err := decrypt(stored, codec, dk)
+			if err != nil {
+				t.Fatalf("size %d codec %s: %v", size, name, err)
+			}
+			if !bytes.Equal(got, plain) {
+				t.Fatalf("size %d codec %s: round trip differs", size, name)
+			}
+		}
+	}
+}
+
+func TestEncryptionDetectsTampering(t *testing.T) {
+	kr := testKeyring(t)
+	dk, err := kr.NewDataKey()
+	if err != nil {
+		t.Fatal(err)
+	}
+	none, _ := CodecByName("none")
+	plain := bytes.Repeat([]byte("0123456789"), (2*encryptionChunkSize+500)/10)
+	stored := encrypt(t, plain, none, dk)
+
+	header := len(encryptionMagic) + 8
+	chunk := 4 + encryptionChunkSize + 16 // length prefix, data, GCM tag
+	flipped := append([]byte(nil), stored...)
+	flipped[header+chunk+100] ^= 1
+	swapped := append(append(append([]byte(nil), stored[:header]...), stored[header+chunk:header+2*chunk]...), stored[header:header+chunk]...)
+	swapped = append(swapped, stored[header+2*chunk:]...)
+
+	other, err := kr.NewDataKey()
+	if err != nil {
+		t.Fatal(err)
+	}
+
+	tests := []struct {
+		name   string
+		stored []byte
+		dk     *DataKey
+		want   string
+	}{
+		{"dropped final chunk", stored[:header+2*chunk], dk, "truncated artifact"},
+		{"cut inside a chunk", stored[:header+chunk+10], dk, "truncated artifact"},
+		{"cut inside the header", stored[:5], dk, "encrypted header"},
+		{"flipped bit", flipped, dk, "authentication failed"},
+		{"reordered chunks", swapped, dk, "authentication failed"},
+		{"trailing data", append(append([]byte(nil), stored...), 0), dk, "trailing data"},
+		{"wrong data key", stored, other, "authentication failed"},
+		{"not encrypted", plain, dk, "not an encrypted artifact"},
+	}
+	for _, tt := range tests {
+		t.Run(tt.name, func(t *testing.T) {
+			_, err := decrypt(tt.stored, none, tt.dk)
+			if err == nil || !strings.Contains(err.Error(), tt.want) {
+				t.Errorf("got %v, want an error containing %q", err, tt.want)
+			}
+		})
+	}
+}
+
+func TestKeyringRewrap(t *testing.T) {
+	oldKey := bytes.Repeat([]byte{1}, 32)
+	newKey := bytes.Repeat([]byte{2}, 32)
+	file := filepath.Join(t.TempDir(), "keys")
+	content := "# master keys\nold=" + hex.EncodeToString(oldKey) + "\n\nnew=" + base64.StdEncoding.EncodeToString(newKey) + "\n"
+	if err := os.WriteFile(file, []byte(content), 0600); err != nil {
+		t.Fatal(err)
+	}
+
+	oldRing, err := LoadKeyring(file, "", "old")
+	if err != nil {
+		t.Fatal(err)
+	}
+	dk, err := oldRing.NewDataKey()
+	if err != nil {
+		t.Fatal(err)
+	}
+	if dk.Info.KeyID != "old" {
+		t.Fatalf("data key wrapped by %q, want old", dk.Info.KeyID)
+	}
+
+	ring, err := LoadKeyring(file, "", "")
+	if err != nil {
+		t.Fatal(err)
+	}
+	if ring.Active != "new" {
+		t.Fatalf("active key %q, want the last one in the file", ring.Active)
+	}
+	info, err := ring.Rewrap(dk.Info)
+	if err != nil {
+		t.Fatal(err)
+	}
+	if info.KeyID != "new" || info.WrappedKey == dk.Info.WrappedKey {
+		t.Fatalf("Rewrap = %+v", info)
+	}
+	unwrapped, err := ring.Unwrap(info)
+	if err != nil {
+		t.Fatal(err)
+	}
+	if !bytes.Equal(unwrapped.key, dk.key) {
+		t.Error("re-wrapped data key differs")
+	}
+
+	// The wrapped key is bound to its key ID
+	forged := info
+	forged.KeyID = "old"
+	if _, err := ring.Unwrap(forged); err == nil {
+		t.Error("Unwrap with a forged key ID: expected an error")
+	}
+
+	for _, tt := range []struct{ file, env, active string }{
+		{"", "short", ""},
+		{"", "", "missing"},
+		{file, "", "missing"},
+		{filepath.Join(t.TempDir(), "absent"), "", ""},
+	} {
+		if _, err := LoadKeyring(tt.file, tt.env, tt.active); err == nil {
+			t.Errorf("LoadKeyring(%q, %q, %q): expected an error", tt.file, tt.env, tt.active)
+		}
+	}
+	if kr, err := LoadKeyring("", "", ""); kr != nil || err != nil {
+		t.Errorf("LoadKeyring without keys = %v, %v, want nil, nil", kr, err)
+	}
+}
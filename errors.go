@@ -0,0 +1,144 @@
+package main
+
+import (
+	"context"
+	"errors"
+	"fmt"
+	"io/fs"
+	"os/exec"
+	"strings"
+	"syscall"
+
+	"go.mongodb.org/mongo-driver/mongo"
+)
+
+// Error classes of a failed backup attempt. BackupCollection wraps every error it returns with
+// one of them, so callers decide with errors.Is instead of matching messages.
+var (
+	ErrSkipped     = errors.New("skipped")                // nothing to back up, not a failure
+	ErrAuth        = errors.New("authentication failed")  // bad credentials or missing privileges
+	ErrDiskFull    = errors.New("disk full")              // no space left in BACKUP_PATH
+	ErrToolMissing = errors.New("mongodump not found")    // MONGODUMP_PATH cannot be executed
+	ErrTimeout     = errors.New("timeout")                // BACKUP_TIMEOUT or a status write expired
+	ErrNetwork     = errors.New("network error")          // MongoDB or the storage backend unreachable
+	ErrIntegrity   = errors.New("integrity check failed") // dumped BSON, metadata or archive is corrupt
+)
+
+// errorClasses maps each class to the name stored in backupStatus.errorClass
+var errorClasses = []struct {
+	err  error
+	name string
+}{
+	{ErrInterrupted, "interrupted"},
+	{ErrSkipped, "skipped"},
+	{ErrAuth, "auth"},
+	{ErrDiskFull, "disk_full"},
+	{ErrToolMissing, "tool_missing"},
+	{ErrTimeout, "timeout"},
+	{ErrNetwork, "network"},
+	{ErrIntegrity, "integrity"},
+	{ErrNoMember, "no_member"},
+}
+
+// ErrorClass returns the class name of err, "unknown" when it has none and "" for nil
+func ErrorClass(err error) string {
+	if err == nil {
+		return ""
+	}
+	for _, c := range errorClasses {
+		if errors.Is(err, c.err) {
+			return c.name
+		}
+	}
+	return "unknown"
+}
+
+// withClass wraps err so that errors.Is(err, class) holds; a nil class leaves err unchanged
+func withClass(class, err error) error {
+	if class == nil || err == nil || errors.Is(err, class) {
+		return err
+	}
+	return fmt.Errorf("%w: %w", class, err)
+}
+
+// isRecoverableError reports whether another attempt can succeed. Authentication, a missing
+// mongodump and a full disk need an operator; timeouts, network, integrity, lagging members
+// and unclassified errors are retried.
+func isRecoverableError(err error) bool {
+	switch {
+	case err == nil:
+		return false
+	case errors.Is(err, ErrSkipped), errors.Is(err, ErrInterrupted):
+		return false
+	case errors.Is(err, ErrAuth), errors.Is(err, ErrToolMissing), errors.Is(err, ErrDiskFull):
+		return false
+	}
+	return true
+}
+
+// mongodump output fragments of each error class, matched case-insensitively
+var (
+	// only a missing namespace: users, roles or databases that "do not exist" are real failures
+	skipMessages = []string{"ns not found", "namespacenotfound"}
+	authMessages = []string{
+		"authentication failed", "auth error", "not authorized", "unauthorized",
+		"sasl conversation error", "requires authentication",
+	}
+	diskFullMessages = []string{"no space left on device", "disk quota exceeded"}
+	networkMessages  = []string{
+		"server selection error", "no reachable servers", "connection refused", "connection reset",
+		"i/o timeout", "network is unreachable", "no such host", "connection() error",
+	}
+)
+
+// classifyDumpError returns the class of a failed mongodump run from its error and output
+func classifyDumpError(ctx context.Context, err error, output string) error {
+	var pathErr *fs.PathError
+	switch {
+	case errors.Is(err, exec.ErrNotFound), errors.As(err, &pathErr) && errors.Is(pathErr, fs.ErrNotExist):
+		return ErrToolMissing
+	case errors.Is(err, syscall.ENOSPC):
+		return ErrDiskFull
+	case ctx.Err() == context.DeadlineExceeded:
+		return ErrTimeout
+	}
+	out := strings.ToLower(output)
+	for _, c := range []struct {
+		class    error
+		messages []string
+	}{
+		{ErrAuth, authMessages},
+		{ErrDiskFull, diskFullMessages},
+		{ErrNetwork, networkMessages},
+		{ErrSkipped, skipMessages},
+	} {
+		for _, m := range c.messages {
+			if strings.Contains(out, m) {
+				return c.class
+			}
+		}
+	}
+	return nil
+}
+
+// classifyError returns the class of an error from the filesystem, MongoDB or the storage backend
+func classifyError(err error) error {
+	var netErr interface{ Timeout() bool }
+	switch {
+	case err == nil:
+		return nil
+	case errors.Is(err, syscall.ENOSPC), errors.Is(err, syscall.EDQUOT):
+		return ErrDiskFull
+	case errors.Is(err, context.DeadlineExceeded), mongo.IsTimeout(err):
+		return ErrTimeout
+	case mongo.IsNetworkError(err), errors.Is(err, syscall.ECONNREFUSED), errors.Is(err, syscall.ECONNRESET):
+		return ErrNetwork
+	case errors.As(err, &netErr) && netErr.Timeout():
+		return ErrTimeout
+	}
+	var cmdErr mongo.CommandError
+	if errors.As(err, &cmdErr) && (cmdErr.Code == 13 || cmdErr.Code == 18) { // Unauthorized, AuthenticationFailed
+		return ErrAuth
+	}
+	return nil
+}
@@ -0,0 +1,28 @@
+package main
+
+import (
+	"context"
+	"errors"
+	"testing"
+)
+
+func TestClassifyDumpError(t *testing.T) {
+	exit := errors.New("exit status 1")
+	tests := []struct {
+		output string
+		want   error
+	}{
+		{"2025-02-01T02:00:01.000+0000\tFailed: error running dump: (NamespaceNotFound) ns not found", ErrSkipped},
+		{"Failed: error getting collection options: ns not found", ErrSkipped},
+		{"Failed: (Unauthorized) not authorized on 2024_provider1 to execute command { find: \"GPS_2025_01_31\" }", ErrAuth},
+		{"Failed: can't create session: could not connect to server: server selection error: connection refused", ErrNetwork},
+		{"Failed: error connecting to db server: (UserNotFound) user backup@admin does not exist", nil},
+		{"Failed: (RoleNotFound) role backupRole@admin does not exist", nil},
+		{"Failed: error writing data for collection `2024_provider1.GPS_2025_01_31` to disk: no space left on device", ErrDiskFull},
+	}
+	for _, tt := range tests {
+		if got := classifyDumpError(context.Background(), exit, tt.output); got != tt.want {
+			t.Errorf("classifyDumpError(%q) = %v, want %v", tt.output, got, tt.want)
+		}
+	}
+}
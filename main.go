@@ -1,42 +1,182 @@
 package main
 
 import (
+	"context"
 	"log"
 	"os"
+	"os/signal"
+	"strings"
+	"syscall"
 	"time"
 )
 
 func main() {
-	LoadConfig() // load .env trước
+	warnings, cfgErr := LoadConfig() // load .env và CONFIG_FILE trước
 
 	// Khởi tạo logger, fatal nếu fail
 	if err := InitLogger(AppConfig.LogFile); err != nil {
 		log.Fatalf("Failed to init logger: %v", err)
 	}
+	for _, w := range warnings {
+		Warn.Println(w)
+	}
+	// Báo tất cả lỗi cấu hình một lần rồi dừng
+	if cfgErr != nil {
+		Error.Printf("Invalid configuration:\n%v", cfgErr)
+		os.Exit(1)
+	}
+
+	// Khởi tạo storage backend (local hoặc S3)
+	if err := InitStorage(); err != nil {
+		Error.Printf("Failed to init storage: %v", err)
+		os.Exit(1)
+	}
+
+	// Chọn codec nén từ COMPRESSION (s2, zstd[:level], gzip[:level], none)
+	codec, err := ParseCodec(AppConfig.Compression)
+	if err != nil {
+		Error.Printf("Invalid COMPRESSION: %v", err)
+		os.Exit(1)
+	}
+	BackupCodec = codec
+
+	// Ghi đè cấu hình theo database (timeout, retries, codec, retention, destination)
+	if err := InitDatabaseOverrides(); err != nil {
+		Error.Printf("Invalid database override: %v", err)
+		os.Exit(1)
+	}
+
+	// Chọn database (DB_INCLUDE / DB_EXCLUDE) và collection cần backup (COLLECTIONS)
+	if BackupDatabases, err = ParseDatabaseFilter(AppConfig.DBInclude, AppConfig.DBExclude); err != nil {
+		Error.Printf("Invalid database selection: %v", err)
+		os.Exit(1)
+	}
+	if CollectionTemplates, err = ParseCollectionTemplates(AppConfig.Collections); err != nil {
+		Error.Printf("Invalid COLLECTIONS: %v", err)
+		os.Exit(1)
+	}
+	Info.Printf("Backup selection: include=%s exclude=%s collections=%v",
+		strings.Join(BackupDatabases.Include, ","), strings.Join(BackupDatabases.Exclude, ","), CollectionTemplates)
+
+	// Nạp master key nếu bật mã hóa (ENCRYPTION_KEY_FILE / ENCRYPTION_KEY)
+	keys, err := LoadKeyring(AppConfig.EncryptionKeyFile, AppConfig.EncryptionKey, AppConfig.EncryptionKeyID)
+	if err != nil {
+		Error.Printf("Invalid encryption key configuration: %v", err)
+		os.Exit(1)
+	}
+	BackupKeys = keys
+	if keys != nil {
+		Info.Printf("Encryption enabled: %s KeyID=%s", EncryptionAlgorithm, keys.Active)
+	}
+
+	// Cấu hình kênh thông báo (webhook, Slack, SMTP)
+	InitNotifiers()
+
+	// Subcommand mặc định là "run" (daemon backup định kỳ)
+	command, args := "run", os.Args[1:]
+	if len(args) > 0 && !strings.HasPrefix(args[0], "-") {
+		command, args = args[0], args[1:]
+	}
+
+	// Context gốc bị huỷ khi nhận SIGINT/SIGTERM: ngừng nhận job mới, job đang chạy có SHUTDOWN_GRACE để xong;
+	// các lệnh restore/verify/prune/rekey dừng sau bước đang chạy
+	ctx, stop := signal.NotifyContext(context.Background(), syscall.SIGINT, syscall.SIGTERM)
+	defer stop()
+
+	switch command {
+	case "run":
+		runDaemon(ctx)
+		CloseLogger()
+	case "backup":
+		code := runBackupCommand(ctx, args)
+		CloseLogger()
+		os.Exit(code)
+	case "verify":
+		code := runVerifyCommand(ctx, args)
+		CloseLogger()
+		os.Exit(code)
+	case "prune":
+		code := runPruneCommand(ctx, args)
+		CloseLogger()
+		os.Exit(code)
+	case "restore":
+		code := runRestore(ctx, args)
+		CloseLogger()
+		os.Exit(code)
+	case "rekey":
+		code := runRekeyCommand(ctx, args)
+		CloseLogger()
+		os.Exit(code)
+	default:
+		Error.Printf("Unknown command %q (expected: run, backup, restore, verify, prune, rekey)", command)
+		os.Exit(2)
+	}
+}
+
+// runDaemon runs the scheduled backup loop until ctx is cancelled
+func runDaemon(ctx context.Context) {
 	Info.Println("Mongo Backup Subroutine v2.2 starting...")
 
+	schedules, loc, err := LoadSchedules()
+	if err != nil {
+		Error.Printf("Invalid schedule configuration: %v", err)
+		os.Exit(1)
+	}
+	for _, s := range schedules {
+		Info.Printf("Schedule loaded: cron=%q DB=%s DateOffset=%d TZ=%s", s.Spec, s.DBPattern, s.DateOffset, loc)
+	}
+
 	// Kết nối MongoDB
-	if err := ConnectMongo(AppConfig.MongoURI); err != nil {
+	if err := ConnectMongo(ctx, AppConfig.MongoURI); err != nil {
 		Error.Printf("Failed to connect MongoDB: %v", err)
 		os.Exit(1)
 	}
 	defer DisconnectMongo()
 
-	// Backup định kỳ hằng ngày vào thời điểm AppConfig.ScheduleHour:ScheduleMin
+	// Bật endpoint Prometheus nếu có METRICS_ADDR
+	if AppConfig.MetricsAddr != "" {
+		LoadLastSuccessMetrics(ctx)
+		StartMetricsServer(AppConfig.MetricsAddr)
+	}
+
+	// Chờ tới lần chạy kế tiếp trong các lịch cron (theo múi giờ SCHEDULE_TZ)
 	for {
-		now := time.Now()
-		scheduled := time.Date(now.Year(), now.Month(), now.Day(),
-			AppConfig.ScheduleHour, AppConfig.ScheduleMin, 0, 0, now.Location())
-		if now.After(scheduled) {
-			scheduled = scheduled.Add(24 * time.Hour)
+		next, due := NextScheduledRun(schedules, time.Now().In(loc))
+		if next.IsZero() {
+			SetNextRunMetric(time.Time{})
+			Error.Println("No upcoming scheduled run, stopping")
+			return
 		}
-		sleepDuration := time.Until(scheduled)
+		SetNextRunMetric(next)
+		sleepDuration := time.Until(next)
 		Info.Printf("Next scheduled backup at %s (sleep %s)",
-			scheduled.Format("2006-01-02 15:04:05"), sleepDuration)
-		time.Sleep(sleepDuration)
+			next.Format("2006-01-02 15:04:05 MST"), sleepDuration)
+		timer := time.NewTimer(sleepDuration)
+		select {
+		case <-ctx.Done():
+			timer.Stop()
+			Info.Println("Shutdown signal received, stopping scheduler")
+			return
+		case <-timer.C:
+		}
 
-		// Backup hôm qua
-		backupDate := time.Now().AddDate(0, 0, -1)
-		RunFullBackup(backupDate)
+		// Mỗi lịch backup ngày theo DateOffset; ngày đã qua sẽ bù các ngày bị lỡ (tối đa MAX_RETRY_DAYS ngày)
+		for _, s := range due {
+			if ctx.Err() != nil {
+				break
+			}
+			RunSchedule(ctx, s, next)
+		}
+		if ctx.Err() != nil {
+			Info.Println("Shutdown signal received, in-flight backups drained")
+			return
+		}
+
+		// Xoá các bản backup hết hạn theo chính sách GFS
+		if AppConfig.Retention.Enabled() || AppConfig.RetentionRules != "" || hasRetentionOverrides() {
+			if err := ApplyRetention(ctx, nil, AppConfig.RetentionDryRun); err != nil {
+				Error.Printf("Retention failed: %v", err)
+			}
+		}
 	}
 }
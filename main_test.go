@@ -0,0 +1,15 @@
+package main
+
+import (
+	"io"
+	"log"
+	"os"
+	"testing"
+)
+
+func TestMain(m *testing.M) {
+	Info = log.New(io.Discard, "[INFO] ", log.LstdFlags)
+	Warn = log.New(io.Discard, "[WARN] ", log.LstdFlags)
+	Error = log.New(io.Discard, "[ERROR] ", log.LstdFlags)
+	os.Exit(m.Run())
+}
@@ -0,0 +1,107 @@
+package main
+
+import (
+	"bytes"
+	"context"
+	"encoding/json"
+	"fmt"
+	"os/exec"
+	"path"
+	"strings"
+	"sync"
+	"time"
+)
+
+// ManifestName is the file name of the manifest stored next to the artifacts of a backup
+const ManifestName = "manifest.json"
+
+// ArtifactInfo describes one stored artifact, as recorded in the manifest and backupHistory
+type ArtifactInfo struct {
+	Key            string `json:"key" bson:"key"`
+	URL            string `json:"url" bson:"url"`
+	SHA256         string `json:"sha256" bson:"sha256"` // of the stored (compressed) bytes
+	RawSize        int64  `json:"rawSize" bson:"rawSize"`
+	CompressedSize int64  `json:"compressedSize" bson:"compressedSize"`
+}
+
+// Manifest summarises one backup of a database collection
+type Manifest struct {
+	Database         string         `json:"database"`
+	Collection       string         `json:"collection"`
+	Status           string         `json:"status"`
+	Format           string         `json:"format"` // bson (mongodump --out) or archive
+	Compression      string         `json:"compression"`
+	DocumentCount    int64          `json:"documentCount"`
+	RawSize          int64          `json:"rawSize"`
+	CompressedSize   int64          `json:"compressedSize"`
+	MongodumpVersion string         `json:"mongodumpVersion"`
+	CreatedAt        time.Time      `json:"createdAt"`
+	Files            []ArtifactInfo `json:"files"`
+	// Encryption is nil for unencrypted backups
+	Encryption *EncryptionInfo `json:"encryption,omitempty"`
+	// Source is the member or read preference dumped from, empty for MONGO_URI as configured
+	Source string `json:"source,omitempty"`
+	// Oplog is the oplog window of the dump, nil with OPLOG_MODE=off
+	Oplog *OplogInfo `json:"oplog,omitempty"`
+}
+
+// ManifestKey returns the storage key of the manifest for an artifact key
+func ManifestKey(artifactKey string) string {
+	return path.Join(path.Dir(artifactKey), ManifestName)
+}
+
+// WriteManifest stores m as JSON under key
+func WriteManifest(ctx context.Context, key string, m Manifest) error {
+	data, err := json.MarshalIndent(m, "", "  ")
+	if err != nil {
+		return err
+	}
+	return BackupStorage.Put(ctx, key, bytes.NewReader(data), int64(len(data)))
+}
+
+// ReadManifest loads the manifest stored under key
+func ReadManifest(ctx context.Context, key string) (Manifest, error) {
+	var m Manifest
+	r, err := BackupStorage.Get(ctx, key)
+	if err != nil {
+		return m, err
+	}
+	defer r.Close()
+	if err := json.NewDecoder(r).Decode(&m); err != nil {
+		return m, fmt.Errorf("invalid manifest %s: %w", key, err)
+	}
+	return m, nil
+}
+
+var (
+	mongodumpVersionOnce sync.Once
+	mongodumpVersion     string
+)
+
+// MongodumpVersion returns the version reported by `mongodump --version`, cached for the process
+func MongodumpVersion() string {
+	mongodumpVersionOnce.Do(func() {
+		out, err := exec.Command(AppConfig.MongodumpPath, "--version").Output()
+		if err != nil {
+			Warn.Printf("Failed to get mongodump version: %v", err)
+			mongodumpVersion = "unknown"
+			return
+		}
+		line, _, _ := strings.Cut(string(out), "\n")
+		if _, v, ok := strings.Cut(line, "version:"); ok {
+			line = v
+		}
+		mongodumpVersion = strings.TrimSpace(line)
+	})
+	return mongodumpVersion
+}
+
+// countingWriter counts the bytes written through it
+type countingWriter struct {
+	n int64
+}
+
+func (c *countingWriter) Write(p []byte) (int, error) {
+	c.n += int64(len(p))
+	return len(p), nil
+}
@@ -0,0 +1,128 @@
+package main
+
+import (
+	"context"
+	"errors"
+	"net/http"
+	"sync"
+	"time"
+
+	"github.com/prometheus/client_golang/prometheus"
+	"github.com/prometheus/client_golang/prometheus/promauto"
+	"github.com/prometheus/client_golang/prometheus/promhttp"
+)
+
+var (
+	metricLastSuccess = promauto.NewGaugeVec(prometheus.GaugeOpts{
+		Name: "mongo_backup_last_success_timestamp_seconds",
+		Help: "Unix time of the last successful backup of a database.",
+	}, []string{"database"})
+
+	metricRunDuration = promauto.NewHistogram(prometheus.HistogramOpts{
+		Name:    "mongo_backup_run_duration_seconds",
+		Help:    "Duration of a backup run over the worker pool.",
+		Buckets: prometheus.ExponentialBuckets(30, 2, 10), // 30s .. ~4h
+	})
+
+	metricRawBytes = promauto.NewCounterVec(prometheus.CounterOpts{
+		Name: "mongo_backup_dumped_bytes_total",
+		Help: "Raw bytes dumped by mongodump.",
+	}, []string{"database"})
+
+	metricStoredBytes = promauto.NewCounterVec(prometheus.CounterOpts{
+		Name: "mongo_backup_compressed_bytes_total",
+		Help: "Compressed (and encrypted) bytes written to the storage backend.",
+	}, []string{"database"})
+
+	metricJobs = promauto.NewCounterVec(prometheus.CounterOpts{
+		Name: "mongo_backup_jobs_total",
+		Help: "Backup jobs by final status (success, skipped, failed).",
+	}, []string{"status"})
+
+	metricRetries = promauto.NewCounterVec(prometheus.CounterOpts{
+		Name: "mongo_backup_retries_total",
+		Help: "Failed backup attempts re-queued for a retry.",
+	}, []string{"database"})
+
+	metricWorkers = promauto.NewGauge(prometheus.GaugeOpts{
+		Name: "mongo_backup_workers",
+		Help: "Size of the worker pool of the current run, 0 when idle.",
+	})
+
+	metricWorkersBusy = promauto.NewGauge(prometheus.GaugeOpts{
+		Name: "mongo_backup_workers_busy",
+		Help: "Workers currently running a backup job.",
+	})
+
+	metricThrottleLimit = promauto.NewGauge(prometheus.GaugeOpts{
+		Name: "mongo_backup_throttle_limit",
+		Help: "Dumps the load throttle currently allows at once, 0 when paused or idle.",
+	})
+
+	_ = promauto.NewGaugeFunc(prometheus.GaugeOpts{
+		Name: "mongo_backup_next_run_seconds",
+		Help: "Seconds until the next scheduled run, -1 when none is scheduled.",
+	}, func() float64 {
+		nextRunMu.Lock()
+		defer nextRunMu.Unlock()
+		if nextRun.IsZero() {
+			return -1
+		}
+		return time.Until(nextRun).Seconds()
+	})
+)
+
+var (
+	nextRunMu sync.Mutex
+	nextRun   time.Time
+)
+
+// StartMetricsServer serves /metrics on addr (METRICS_ADDR) in the background
+func StartMetricsServer(addr string) {
+	mux := http.NewServeMux()
+	mux.Handle("/metrics", promhttp.Handler())
+	server := &http.Server{Addr: addr, Handler: mux, ReadHeaderTimeout: 10 * time.Second}
+	go func() {
+		if err := server.ListenAndServe(); err != nil && !errors.Is(err, http.ErrServerClosed) {
+			Error.Printf("Metrics server failed: %v", err)
+		}
+	}()
+	Info.Printf("Metrics listening on %s/metrics", addr)
+}
+
+// LoadLastSuccessMetrics seeds the last-success gauges from backupHistory, so the
+// staleness alert also works right after a restart
+func LoadLastSuccessMetrics(ctx context.Context) {
+	times, err := LastSuccessTimes(ctx)
+	if err != nil {
+		Warn.Printf("Failed to load last successful backups for metrics: %v", err)
+		return
+	}
+	for dbName, t := range times {
+		metricLastSuccess.WithLabelValues(dbName).Set(float64(t.Unix()))
+	}
+}
+
+// SetNextRunMetric records the time of the next scheduled run
+func SetNextRunMetric(t time.Time) {
+	nextRunMu.Lock()
+	nextRun = t
+	nextRunMu.Unlock()
+}
+
+// recordBackupMetrics records the sizes of one successful backup
+func recordBackupMetrics(dbName string, status BackupStatus, rawSize, storedSize int64) {
+	metricRawBytes.WithLabelValues(dbName).Add(float64(rawSize))
+	metricStoredBytes.WithLabelValues(dbName).Add(float64(storedSize))
+	if status == StatusSuccess {
+		metricLastSuccess.WithLabelValues(dbName).SetToCurrentTime()
+	}
+}
+
+// recordJobMetrics records the final outcome of one job
+func recordJobMetrics(res JobResult) {
+	metricJobs.WithLabelValues(string(res.Status)).Inc()
+	if res.Attempts > 1 {
+		metricRetries.WithLabelValues(res.Job.Database).Add(float64(res.Attempts - 1))
+	}
+}
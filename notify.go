@@ -0,0 +1,237 @@
+package main
+
+import (
+	"bytes"
+	"context"
+	"encoding/json"
+	"fmt"
+	"net"
+	"net/http"
+	"net/smtp"
+	"strconv"
+	"strings"
+	"sync"
+	"time"
+)
+
+// Notification modes selected by NOTIFY_MODE
+const (
+	NotifyOnFailure = "failure" // only runs with new failures (default)
+	NotifyAlways    = "always"  // every run
+	NotifyOff       = "off"
+)
+
+// NotifyConfig holds the notification targets; an empty URL or host disables that target
+type NotifyConfig struct {
+	Mode       string
+	WebhookURL string        // NOTIFY_WEBHOOK_URL: generic JSON webhook
+	SlackURL   string        // NOTIFY_SLACK_URL: Slack/Mattermost incoming webhook
+	RateLimit  time.Duration // NOTIFY_RATE_LIMIT: silence for an identical failure
+	SMTP       SMTPConfig
+}
+
+// SMTPConfig holds the SMTP settings of email notifications
+type SMTPConfig struct {
+	Host     string
+	Port     int
+	Username string
+	Password string
+	From     string
+	To       []string
+}
+
+// Notifier delivers a run summary to one target
+type Notifier interface {
+	Name() string
+	Notify(ctx context.Context, run *BackupRun) error
+}
+
+var (
+	notifyMu   sync.Mutex
+	notifiers  []Notifier
+	lastNotify = map[string]time.Time{} // failure fingerprint -> last time it was sent
+)
+
+// InitNotifiers builds the notifiers configured in AppConfig.Notify
+func InitNotifiers() {
+	cfg := AppConfig.Notify
+	notifiers = nil
+	switch cfg.Mode {
+	case NotifyOff:
+		return
+	case NotifyOnFailure, NotifyAlways:
+	default:
+		Warn.Printf("Unknown NOTIFY_MODE %q, using %s", cfg.Mode, NotifyOnFailure)
+		AppConfig.Notify.Mode = NotifyOnFailure
+		cfg.Mode = NotifyOnFailure
+	}
+	client := &http.Client{Timeout: 10 * time.Second}
+	if cfg.WebhookURL != "" {
+		notifiers = append(notifiers, &webhookNotifier{url: cfg.WebhookURL, client: client})
+	}
+	if cfg.SlackURL != "" {
+		notifiers = append(notifiers, &slackNotifier{url: cfg.SlackURL, client: client})
+	}
+	if cfg.SMTP.Host != "" && len(cfg.SMTP.To) > 0 {
+		notifiers = append(notifiers, &smtpNotifier{cfg: cfg.SMTP})
+	}
+	for _, n := range notifiers {
+		Info.Printf("Notifier enabled: %s (mode=%s)", n.Name(), cfg.Mode)
+	}
+}
+
+// NotifyRun sends the run summary to every notifier. In failure mode a run is only sent
+// when it has a failure that was not already sent within NOTIFY_RATE_LIMIT.
+func NotifyRun(run *BackupRun) {
+	if len(notifiers) == 0 || !shouldNotify(run, time.Now()) {
+		return
+	}
+	ctx, cancel := context.WithTimeout(context.Background(), 30*time.Second)
+	defer cancel()
+	for _, n := range notifiers {
+		if err := n.Notify(ctx, run); err != nil {
+			Error.Printf("Notification failed: Notifier=%s RunID=%s Error=%v", n.Name(), run.RunID, err)
+			continue
+		}
+		Info.Printf("Notification sent: Notifier=%s RunID=%s", n.Name(), run.RunID)
+	}
+}
+
+// shouldNotify applies the mode and the per-failure rate limit, and remembers what was sent
+func shouldNotify(run *BackupRun, now time.Time) bool {
+	notifyMu.Lock()
+	defer notifyMu.Unlock()
+
+	fresh := false
+	for _, fp := range failureFingerprints(run) {
+		if last, ok := lastNotify[fp]; ok && now.Sub(last) < AppConfig.Notify.RateLimit {
+			continue
+		}
+		lastNotify[fp] = now
+		fresh = true
+	}
+	if AppConfig.Notify.Mode == NotifyAlways {
+		return true
+	}
+	if !fresh && (run.Failed > 0 || run.Status == RunFailed) {
+		Info.Printf("Notification rate-limited: RunID=%s (same failures already sent within %s)", run.RunID, AppConfig.Notify.RateLimit)
+	}
+	return fresh
+}
+
+// failureFingerprints identifies each failure of a run by database and error class, ignoring
+// the date so a provider failing day after day counts as the same failure. The error text is
+// not used: it carries mongodump output with timestamps that differ on every attempt.
+func failureFingerprints(run *BackupRun) []string {
+	var fps []string
+	if run.Status == RunFailed {
+		fps = append(fps, "run|"+firstLine(run.Error))
+	}
+	for _, r := range run.Results {
+		if r.Status == string(StatusFailed) {
+			fps = append(fps, r.Database+"|"+r.ErrorClass)
+		}
+	}
+	return fps
+}
+
+func firstLine(s string) string {
+	s, _, _ = strings.Cut(s, "\n")
+	if len(s) > 200 {
+		s = s[:200]
+	}
+	return s
+}
+
+// runSummaryText renders a run as plain text for chat and email
+func runSummaryText(run *BackupRun) string {
+	var b strings.Builder
+	fmt.Fprintf(&b, "Backup run %s %s: target=%s jobs=%d success=%d skipped=%d failed=%d duration=%s\n",
+		run.RunID, run.Status, run.TargetDate, run.Jobs, run.Success, run.Skipped, run.Failed,
+		time.Duration(run.DurationSeconds*float64(time.Second)).Round(time.Second))
+	if run.Error != "" {
+		fmt.Fprintf(&b, "Error: %s\n", firstLine(run.Error))
+	}
+	for _, r := range run.Results {
+		if r.Status == string(StatusFailed) {
+			fmt.Fprintf(&b, "[FAILED] DB=%s Date=%s (attempts=%d, class=%s): %s\n", r.Database, r.Date, r.Attempts, r.ErrorClass, firstLine(r.Error))
+		}
+	}
+	return b.String()
+}
+
+// webhookNotifier posts {"event":"backup_run","run":{...}} to a generic JSON webhook
+type webhookNotifier struct {
+	url    string
+	client *http.Client
+}
+
+func (w *webhookNotifier) Name() string { return "webhook" }
+
+func (w *webhookNotifier) Notify(ctx context.Context, run *BackupRun) error {
+	return postJSON(ctx, w.client, w.url, map[string]interface{}{"event": "backup_run", "run": run})
+}
+
+// slackNotifier posts {"text": ...} to a Slack or Mattermost incoming webhook
+type slackNotifier struct {
+	url    string
+	client *http.Client
+}
+
+func (s *slackNotifier) Name() string { return "slack" }
+
+func (s *slackNotifier) Notify(ctx context.Context, run *BackupRun) error {
+	return postJSON(ctx, s.client, s.url, map[string]string{"text": "```\n" + runSummaryText(run) + "```"})
+}
+
+func postJSON(ctx context.Context, client *http.Client, url string, payload interface{}) error {
+	body, err := json.Marshal(payload)
+	if err != nil {
+		return err
+	}
+	req, err := http.NewRequestWithContext(ctx, http.MethodPost, url, bytes.NewReader(body))
+	if err != nil {
+		return err
+	}
+	req.Header.Set("Content-Type", "application/json")
+	resp, err := client.Do(req)
+	if err != nil {
+		return err
+	}
+	defer resp.Body.Close()
+	if resp.StatusCode/100 != 2 {
+		return fmt.Errorf("webhook returned %s", resp.Status)
+	}
+	return nil
+}
+
+// smtpNotifier emails the run summary
+type smtpNotifier struct {
+	cfg SMTPConfig
+}
+
+func (s *smtpNotifier) Name() string { return "smtp" }
+
+func (s *smtpNotifier) Notify(ctx context.Context, run *BackupRun) error {
+	var msg bytes.Buffer
+	fmt.Fprintf(&msg, "From: %s\r\n", s.cfg.From)
+	fmt.Fprintf(&msg, "To: %s\r\n", strings.Join(s.cfg.To, ", "))
+	fmt.Fprintf(&msg, "Subject: [mongo-backup] run %s %s (failed=%d)\r\n", run.TargetDate, run.Status, run.Failed)
+	fmt.Fprintf(&msg, "Date: %s\r\n", time.Now().Format(time.RFC1123Z))
+	msg.WriteString("Content-Type: text/plain; charset=utf-8\r\n\r\n")
+	msg.WriteString(strings.ReplaceAll(runSummaryText(run), "\n", "\r\n"))
+
+	var auth smtp.Auth
+	if s.cfg.Username != "" {
+		auth = smtp.PlainAuth("", s.cfg.Username, s.cfg.Password, s.cfg.Host)
+	}
+	addr := net.JoinHostPort(s.cfg.Host, strconv.Itoa(s.cfg.Port))
+	done := make(chan error, 1)
+	go func() { done <- smtp.SendMail(addr, auth, s.cfg.From, s.cfg.To, msg.Bytes()) }()
+	select {
+	case err := <-done:
+		return err
+	case <-ctx.Done():
+		return ctx.Err()
+	}
+}
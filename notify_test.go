@@ -0,0 +1,234 @@
+package main
+
+import (
+	"bufio"
+	"context"
+	"encoding/json"
+	"io"
+	"net"
+	"net/http"
+	"net/http/httptest"
+	"strings"
+	"testing"
+	"time"
+)
+
+func failedRun(errText string) *BackupRun {
+	return &BackupRun{
+		RunID:      "2025_02_01_02_00_00_abcdef",
+		TargetDate: "2025_01_31",
+		Status:     RunWithFailures,
+		Jobs:       2,
+		Success:    1,
+		Failed:     1,
+		Results: []RunJobSummary{
+			{Database: "2024_provider1", Date: "2025_01_31", Status: string(StatusSuccess), Attempts: 1},
+			{Database: "2024_provider2", Date: "2025_01_31", Status: string(StatusFailed), Attempts: 3, Error: errText, ErrorClass: "network"},
+		},
+	}
+}
+
+func TestWebhookNotifiers(t *testing.T) {
+	var got []map[string]interface{}
+	status := http.StatusOK
+	srv := httptest.NewServer(http.HandlerFunc(func(w http.ResponseWriter, r *http.Request) {
+		if r.Method != http.MethodPost || r.Header.Get("Content-Type") != "application/json" {
+			t.Errorf("got %s with Content-Type %q", r.Method, r.Header.Get("Content-Type"))
+		}
+		var body map[string]interface{}
+		if err := json.NewDecoder(r.Body).Decode(&body); err != nil {
+			t.Errorf("invalid JSON body: %v", err)
+		}
+		got = append(got, body)
+		w.WriteHeader(status)
+	}))
+	defer srv.Close()
+
+	ctx := context.Background()
+	run := failedRun("connection refused")
+	webhook := &webhookNotifier{url: srv.URL, client: srv.Client()}
+	slack := &slackNotifier{url: srv.URL, client: srv.Client()}
+	if err := webhook.Notify(ctx, run); err != nil {
+		t.Fatal(err)
+	}
+	if err := slack.Notify(ctx, run); err != nil {
+		t.Fatal(err)
+	}
+	if len(got) != 2 {
+		t.Fatalf("got %d requests, want 2", len(got))
+	}
+
+	if got[0]["event"] != "backup_run" {
+		t.Errorf("webhook event = %v", got[0]["event"])
+	}
+	sent, _ := got[0]["run"].(map[string]interface{})
+	if sent["runId"] != run.RunID || sent["failed"] != float64(1) {
+		t.Errorf("webhook run = %v", sent)
+	}
+	text, _ := got[1]["text"].(string)
+	for _, want := range []string{run.RunID, "[FAILED] DB=2024_provider2 Date=2025_01_31 (attempts=3, class=network): connection refused"} {
+		if !strings.Contains(text, want) {
+			t.Errorf("slack text %q does not contain %q", text, want)
+		}
+	}
+
+	status = http.StatusInternalServerError
+	if err := webhook.Notify(ctx, run); err == nil || !strings.Contains(err.Error(), "500") {
+		t.Errorf("webhook answering 500: got %v", err)
+	}
+}
+
+// smtpStub accepts one SMTP session without authentication and returns the
+// envelope recipients and message it received
+func smtpStub(t *testing.T) (host string, port int, received <-chan []string) {
+	t.Helper()
+	ln, err := net.Listen("tcp", "127.0.0.1:0")
+	if err != nil {
+		t.Fatal(err)
+	}
+	t.Cleanup(func() { ln.Close() })
+	out := make(chan []string, 1)
+	go func() {
+		conn, err := ln.Accept()
+		if err != nil {
+			return
+		}
+		defer conn.Close()
+		conn.SetDeadline(time.Now().Add(10 * time.Second))
+		r := bufio.NewReader(conn)
+		reply := func(s string) { io.WriteString(conn, s+"\r\n") }
+
+		var session []string
+		reply("220 stub ESMTP")
+		for {
+			line, err := r.ReadString('\n')
+			if err != nil {
+				return
+			}
+			line = strings.TrimRight(line, "\r\n")
+			cmd := strings.ToUpper(line)
+			switch {
+			case strings.HasPrefix(cmd, "EHLO"), strings.HasPrefix(cmd, "HELO"):
+				reply("250 stub")
+			case strings.HasPrefix(cmd, "RCPT TO:"):
+				session = append(session, line)
+				reply("250 OK")
+			case strings.HasPrefix(cmd, "MAIL FROM:"):
+				reply("250 OK")
+			case cmd == "DATA":
+				reply("354 end with .")
+				var msg strings.Builder
+				for {
+					l, err := r.ReadString('\n')
+					if err != nil {
+						return
+					}
+					if l == ".\r\n" {
+						break
+					}
+					msg.WriteString(l)
+				}
+				session = append(session, msg.String())
+				reply("250 queued")
+			case cmd == "QUIT":
+				reply("221 bye")
+				out <- session
+				return
+			default:
+				reply("502 not implemented")
+			}
+		}
+	}()
+	addr := ln.Addr().(*net.TCPAddr)
+	return addr.IP.String(), addr.Port, out
+}
+
+func TestSMTPNotifier(t *testing.T) {
+	host, port, received := smtpStub(t)
+	n := &smtpNotifier{cfg: SMTPConfig{
+		Host: host,
+		Port: port,
+		From: "backup@example.com",
+		To:   []string{"ops@example.com", "dba@example.com"},
+	}}
+	if err := n.Notify(context.Background(), failedRun("connection refused")); err != nil {
+		t.Fatal(err)
+	}
+
+	var session []string
+	select {
+	case session = <-received:
+	case <-time.After(10 * time.Second):
+		t.Fatal("no message received")
+	}
+	if len(session) != 3 {
+		t.Fatalf("session = %q, want two recipients and a message", session)
+	}
+	if !strings.Contains(session[0], "ops@example.com") || !strings.Contains(session[1], "dba@example.com") {
+		t.Errorf("recipients = %q", session[:2])
+	}
+	msg := session[2]
+	for _, want := range []string{
+		"From: backup@example.com\r\n",
+		"To: ops@example.com, dba@example.com\r\n",
+		"Subject: [mongo-backup] run 2025_01_31 completed_with_failures (failed=1)\r\n",
+		"[FAILED] DB=2024_provider2",
+	} {
+		if !strings.Contains(msg, want) {
+			t.Errorf("message does not contain %q:\n%s", want, msg)
+		}
+	}
+}
+
+func TestSMTPNotifierUnreachable(t *testing.T) {
+	ln, err := net.Listen("tcp", "127.0.0.1:0")
+	if err != nil {
+		t.Fatal(err)
+	}
+	port := ln.Addr().(*net.TCPAddr).Port
+	ln.Close()
+
+	n := &smtpNotifier{cfg: SMTPConfig{Host: "127.0.0.1", Port: port, From: "a@example.com", To: []string{"b@example.com"}}}
+	if err := n.Notify(context.Background(), failedRun("x")); err == nil {
+		t.Errorf("expected an error for the closed port %d", port)
+	}
+}
+
+func TestShouldNotifyRateLimit(t *testing.T) {
+	defer func(cfg NotifyConfig) { AppConfig.Notify = cfg }(AppConfig.Notify)
+	defer func(m map[string]time.Time) { lastNotify = m }(lastNotify)
+	AppConfig.Notify = NotifyConfig{Mode: NotifyOnFailure, RateLimit: 6 * time.Hour}
+	lastNotify = map[string]time.Time{}
+
+	now := time.Date(2025, 2, 1, 2, 0, 0, 0, time.UTC)
+	// mongodump output starts with a timestamp that differs on every run
+	output := func(ts string) string {
+		return "exit status 1 (output: " + ts + "\tFailed: error connecting to db server: connection refused)"
+	}
+
+	otherClass := failedRun("authentication failed")
+	otherClass.Results[1].ErrorClass = "auth"
+
+	steps := []struct {
+		name string
+		run  *BackupRun
+		at   time.Time
+		want bool
+	}{
+		{"first failure", failedRun(output("2025-02-01T02:00:01.000+0000")), now, true},
+		{"same failure, new output", failedRun(output("2025-02-01T03:00:01.000+0000")), now.Add(time.Hour), false},
+		{"after the rate limit", failedRun(output("2025-02-01T08:30:01.000+0000")), now.Add(6*time.Hour + time.Minute), true},
+		{"successful run", &BackupRun{Status: RunCompleted}, now.Add(7 * time.Hour), false},
+		{"new error class", otherClass, now.Add(7 * time.Hour), true},
+	}
+	for _, s := range steps {
+		if got := shouldNotify(s.run, s.at); got != s.want {
+			t.Errorf("%s: shouldNotify = %v, want %v", s.name, got, s.want)
+		}
+	}
+
+	AppConfig.Notify.Mode = NotifyAlways
+	if !shouldNotify(&BackupRun{Status: RunCompleted}, now.Add(8*time.Hour)) {
+		t.Error("mode always: successful run not sent")
+	}
+}
@@ -0,0 +1,289 @@
+package main
+
+import (
+	"bufio"
+	"context"
+	"errors"
+	"fmt"
+	"io"
+	"os"
+	"regexp"
+	"strconv"
+	"strings"
+	"time"
+
+	"go.mongodb.org/mongo-driver/bson"
+	"go.mongodb.org/mongo-driver/bson/primitive"
+	"go.mongodb.org/mongo-driver/mongo"
+	"go.mongodb.org/mongo-driver/mongo/options"
+)
+
+// Oplog modes selected by OPLOG_MODE. mongodump --oplog only works for whole-instance dumps,
+// so the oplog window is taken around every database/collection dump instead.
+const (
+	OplogOff     = "off"
+	OplogRecord  = "record"  // store the oplog window of every dump in the manifest and backupHistory
+	OplogCapture = "capture" // also store the oplog entries of the dumped namespace written during the dump
+)
+
+// OplogName is the artifact of the captured oplog entries. Like with mongodump --oplog it
+// sits next to the database folder: <db>/<collection>/oplog.bson
+const OplogName = "oplog.bson"
+
+// oplogBatchSize caps the operations of one applyOps command during a replay
+const oplogBatchSize = 1000
+
+// OplogPoint is an oplog timestamp, written "seconds:ordinal" like mongorestore --oplogLimit
+type OplogPoint struct {
+	T uint32 `bson:"t" json:"t"`
+	I uint32 `bson:"i" json:"i"`
+}
+
+func (p OplogPoint) String() string {
+	return fmt.Sprintf("%d:%d", p.T, p.I)
+}
+
+// Time returns the wall clock second of p
+func (p OplogPoint) Time() time.Time {
+	return time.Unix(int64(p.T), 0)
+}
+
+// After reports whether p is later than q
+func (p OplogPoint) After(q OplogPoint) bool {
+	return p.T > q.T || (p.T == q.T && p.I > q.I)
+}
+
+func (p OplogPoint) timestamp() primitive.Timestamp {
+	return primitive.Timestamp{T: p.T, I: p.I}
+}
+
+// ParseOplogPoint parses "seconds:ordinal", "seconds" or an RFC 3339 time; a time
+// covers every operation of its second
+func ParseOplogPoint(s string) (OplogPoint, error) {
+	s = strings.TrimSpace(s)
+	if t, err := time.Parse(time.RFC3339, s); err == nil {
+		return OplogPoint{T: uint32(t.Unix()), I: ^uint32(0)}, nil
+	}
+	sec, ord, hasOrd := strings.Cut(s, ":")
+	t, err := strconv.ParseUint(sec, 10, 32)
+	if err != nil {
+		return OplogPoint{}, fmt.Errorf("invalid oplog timestamp %q (expected seconds:ordinal or RFC 3339)", s)
+	}
+	p := OplogPoint{T: uint32(t), I: ^uint32(0)}
+	if hasOrd {
+		i, err := strconv.ParseUint(ord, 10, 32)
+		if err != nil {
+			return OplogPoint{}, fmt.Errorf("invalid oplog timestamp %q (expected seconds:ordinal or RFC 3339)", s)
+		}
+		p.I = uint32(i)
+	}
+	return p, nil
+}
+
+// OplogInfo is the oplog window of one dump, stored in the manifest and backupHistory
+type OplogInfo struct {
+	Oldest    OplogPoint `bson:"oldest" json:"oldest"` // oldest entry left in the oplog when the dump started
+	Start     OplogPoint `bson:"start" json:"start"`   // newest entry when the dump started
+	End       OplogPoint `bson:"end" json:"end"`       // newest entry when the dump finished
+	StartTime time.Time  `bson:"startTime" json:"startTime"`
+	EndTime   time.Time  `bson:"endTime" json:"endTime"`
+	// Entries and Key are set with OPLOG_MODE=capture: the entries of the dumped
+	// namespace after Start up to End, and their artifact
+	Entries int64  `bson:"entries,omitempty" json:"entries,omitempty"`
+	Key     string `bson:"key,omitempty" json:"key,omitempty"`
+}
+
+// OplogBounds returns the oldest and newest entries of the oplog of the server mongoClient
+// sends commands to (the primary of a replica set)
+func OplogBounds(parent context.Context) (oldest, newest OplogPoint, err error) {
+	if mongoClient == nil {
+		return oldest, newest, fmt.Errorf("mongoClient is nil")
+	}
+	ctx, cancel := context.WithTimeout(parent, AppConfig.MongoOpTimeout)
+	defer cancel()
+
+	oplog := mongoClient.Database("local").Collection("oplog.rs")
+	read := func(direction int) (OplogPoint, error) {
+		var entry struct {
+			TS primitive.Timestamp `bson:"ts"`
+		}
+		opts := options.FindOne().SetSort(bson.D{{Key: "$natural", Value: direction}}).SetProjection(bson.M{"ts": 1})
+		err := oplog.FindOne(ctx, bson.M{}, opts).Decode(&entry)
+		if errors.Is(err, mongo.ErrNoDocuments) {
+			return OplogPoint{}, fmt.Errorf("local.oplog.rs is empty or missing: OPLOG_MODE needs a replica set")
+		}
+		return OplogPoint{T: entry.TS.T, I: entry.TS.I}, err
+	}
+	if oldest, err = read(1); err != nil {
+		return oldest, newest, fmt.Errorf("failed to read oplog: %w", err)
+	}
+	if newest, err = read(-1); err != nil {
+		return oldest, newest, fmt.Errorf("failed to read oplog: %w", err)
+	}
+	return oldest, newest, nil
+}
+
+// startOplogWindow records the oplog position before a dump. When dumps read from a
+// secondary the window starts DUMP_MAX_LAG earlier, so the entries the member had not
+// applied yet are captured too; replaying them again is harmless.
+func startOplogWindow(ctx context.Context, target DumpTarget) (*OplogInfo, error) {
+	oldest, newest, err := OplogBounds(ctx)
+	if err != nil {
+		return nil, err
+	}
+	start := newest
+	if lag := AppConfig.DumpRead.MaxLag; target.Source != "" && lag > 0 {
+		start = OplogPoint{T: newest.T - min(newest.T, uint32(lag/time.Second))}
+	}
+	return &OplogInfo{Oldest: oldest, Start: start, StartTime: start.Time()}, nil
+}
+
+// finishOplogWindow records the oplog position after a dump
+func finishOplogWindow(ctx context.Context, info *OplogInfo) error {
+	_, newest, err := OplogBounds(ctx)
+	if err != nil {
+		return err
+	}
+	info.End = newest
+	info.EndTime = newest.Time()
+	return nil
+}
+
+// CaptureOplog writes the insert, update and delete entries of dbName.collection (every
+// collection of dbName with all set) after info.Start up to info.End to file and returns their count
+func CaptureOplog(parent context.Context, info *OplogInfo, dbName, collection string, all bool, file string) (int64, error) {
+	ctx, cancel := context.WithTimeout(parent, SettingsFor(dbName).Timeout)
+	defer cancel()
+
+	var ns interface{} = dbName + "." + collection
+	if all {
+		ns = primitive.Regex{Pattern: "^" + regexp.QuoteMeta(dbName+".")}
+	}
+	filter := bson.M{
+		"ts": bson.M{"$gt": info.Start.timestamp(), "$lte": info.End.timestamp()},
+		"op": bson.M{"$in": bson.A{"i", "u", "d"}},
+		"ns": ns,
+	}
+	cursor, err := mongoClient.Database("local").Collection("oplog.rs").Find(ctx, filter)
+	if err != nil {
+		return 0, fmt.Errorf("failed to query oplog: %w", err)
+	}
+	defer cursor.Close(ctx)
+
+	f, err := os.Create(file)
+	if err != nil {
+		return 0, err
+	}
+	defer f.Close()
+	w := bufio.NewWriter(f)
+	var n int64
+	for cursor.Next(ctx) {
+		if _, err := w.Write(cursor.Current); err != nil {
+			return n, err
+		}
+		n++
+	}
+	if err := cursor.Err(); err != nil {
+		return n, fmt.Errorf("failed to read oplog: %w", err)
+	}
+	if err := w.Flush(); err != nil {
+		return n, err
+	}
+	return n, f.Close()
+}
+
+// ReplayOplog applies the oplog entries captured with backup m up to until with applyOps.
+// Namespaces are mapped like the restore: into dbName, and into collection unless it is empty.
+func ReplayOplog(ctx context.Context, m Manifest, dbName, collection string, until OplogPoint) (int, error) {
+	if m.Oplog == nil || m.Oplog.Key == "" {
+		return 0, fmt.Errorf("backup %s.%s has no captured oplog (taken without OPLOG_MODE=capture)", m.Database, m.Collection)
+	}
+	if mongoClient == nil {
+		return 0, fmt.Errorf("mongoClient is nil")
+	}
+	var dk *DataKey
+	if m.Encryption != nil {
+		if BackupKeys == nil {
+			return 0, fmt.Errorf("%s is encrypted but no master key is configured", m.Oplog.Key)
+		}
+		var err error
+		if dk, err = BackupKeys.Unwrap(*m.Encryption); err != nil {
+			return 0, err
+		}
+	}
+	in, err := BackupStorage.Get(ctx, m.Oplog.Key)
+	if err != nil {
+		return 0, err
+	}
+	defer in.Close()
+	reader, err := newArtifactReader(in, CodecFor(m.Oplog.Key, m.Compression), dk)
+	if err != nil {
+		return 0, err
+	}
+	defer reader.Close()
+
+	admin := mongoClient.Database("admin")
+	var batch bson.A
+	applied := 0
+	apply := func() error {
+		if len(batch) == 0 {
+			return nil
+		}
+		if err := admin.RunCommand(ctx, bson.D{{Key: "applyOps", Value: batch}}).Err(); err != nil {
+			return fmt.Errorf("applyOps failed after %d operations: %w", applied, err)
+		}
+		applied += len(batch)
+		batch = nil
+		return nil
+	}
+
+	br := newBsonReader(reader)
+	for {
+		raw, _, err := br.next(false)
+		if err == io.EOF {
+			break
+		}
+		if err != nil {
+			return applied, err
+		}
+		t, i, ok := raw.Lookup("ts").TimestampOK()
+		if !ok {
+			return applied, fmt.Errorf("oplog entry %d has no timestamp", br.docs)
+		}
+		if (OplogPoint{T: t, I: i}).After(until) {
+			break
+		}
+		var op bson.D
+		if err := bson.Unmarshal(raw, &op); err != nil {
+			return applied, err
+		}
+		batch = append(batch, replayEntry(op, m.Database, dbName, collection))
+		if len(batch) >= oplogBatchSize {
+			if err := apply(); err != nil {
+				return applied, err
+			}
+		}
+	}
+	return applied, apply()
+}
+
+// replayEntry maps the namespace of an oplog entry from srcDB into dbName (and collection
+// unless empty) and drops the collection UUID, which only matches the source collection
+func replayEntry(op bson.D, srcDB, dbName, collection string) bson.D {
+	out := make(bson.D, 0, len(op))
+	for _, e := range op {
+		switch e.Key {
+		case "ui":
+			continue
+		case "ns":
+			ns, _ := e.Value.(string)
+			coll := strings.TrimPrefix(ns, srcDB+".")
+			if collection != "" {
+				coll = collection
+			}
+			e.Value = dbName + "." + coll
+		}
+		out = append(out, e)
+	}
+	return out
+}
@@ -0,0 +1,108 @@
+package main
+
+import (
+	"fmt"
+	"path"
+	"time"
+)
+
+// DatabaseSettings are the settings one database is backed up with, after overrides
+type DatabaseSettings struct {
+	Timeout    time.Duration
+	MaxRetries int
+	Codec      Codec
+}
+
+// overrideCodecs holds the parsed compression of each AppConfig.Databases entry, nil when not overridden
+var overrideCodecs []Codec
+
+// InitDatabaseOverrides parses the codecs of the per-database overrides and routes the
+// databases with their own destination to it. Call after InitStorage.
+func InitDatabaseOverrides() error {
+	overrideCodecs = make([]Codec, len(AppConfig.Databases))
+	router := &routedStorage{def: BackupStorage}
+	for i, o := range AppConfig.Databases {
+		if o.Compression != "" {
+			codec, err := ParseCodec(o.Compression)
+			if err != nil {
+				return fmt.Errorf("databases[%d] %s: %w", i, o.Pattern, err)
+			}
+			overrideCodecs[i] = codec
+		}
+		if o.Destination != nil {
+			s, err := newDestinationStorage(*o.Destination)
+			if err != nil {
+				return fmt.Errorf("databases[%d] %s: %w", i, o.Pattern, err)
+			}
+			router.routes = append(router.routes, storageRoute{index: i, storage: s})
+			Info.Printf("Storage destination for DB=%s: %s", o.Pattern, s.URL(""))
+		}
+		Info.Printf("Database override: DB=%s timeout=%s retries=%d compression=%s retention=%v",
+			o.Pattern, o.Timeout, o.MaxRetries, o.Compression, o.Retention)
+	}
+	if len(router.routes) > 0 {
+		BackupStorage = router
+	}
+	return nil
+}
+
+// newDestinationStorage builds the storage of an override destination; S3 settings
+// other than bucket and prefix come from the global S3 configuration
+func newDestinationStorage(d DestinationConfig) (Storage, error) {
+	if d.Backend == "s3" {
+		cfg := AppConfig.S3
+		if d.Bucket != "" {
+			cfg.Bucket = d.Bucket
+		}
+		if d.Prefix != "" {
+			cfg.Prefix = d.Prefix
+		}
+		return NewS3Storage(cfg)
+	}
+	return &LocalStorage{Root: d.Path}, nil
+}
+
+// databaseOverride returns the index of the first override matching dbName, or -1
+func databaseOverride(dbName string) int {
+	for i, o := range AppConfig.Databases {
+		if ok, _ := path.Match(o.Pattern, dbName); ok {
+			return i
+		}
+	}
+	return -1
+}
+
+// SettingsFor returns the settings of dbName: the first matching override of the config
+// file, with the global settings for everything it leaves out
+func SettingsFor(dbName string) DatabaseSettings {
+	s := DatabaseSettings{
+		Timeout:    AppConfig.BackupTimeout,
+		MaxRetries: AppConfig.MaxRetries,
+		Codec:      BackupCodec,
+	}
+	i := databaseOverride(dbName)
+	if i < 0 {
+		return s
+	}
+	o := AppConfig.Databases[i]
+	if o.Timeout > 0 {
+		s.Timeout = o.Timeout
+	}
+	if o.MaxRetries > 0 {
+		s.MaxRetries = o.MaxRetries
+	}
+	if i < len(overrideCodecs) && overrideCodecs[i] != nil {
+		s.Codec = overrideCodecs[i]
+	}
+	return s
+}
+
+// hasRetentionOverrides reports whether any override sets a retention policy
+func hasRetentionOverrides() bool {
+	for _, o := range AppConfig.Databases {
+		if o.Retention != nil {
+			return true
+		}
+	}
+	return false
+}
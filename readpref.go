@@ -0,0 +1,342 @@
+package main
+
+import (
+	"context"
+	"encoding/json"
+	"errors"
+	"fmt"
+	"net"
+	"net/url"
+	"strings"
+	"time"
+)
+
+// Read preference modes accepted by DUMP_READ_PREFERENCE
+var readPreferenceModes = []string{"primary", "primaryPreferred", "secondary", "secondaryPreferred", "nearest"}
+
+// ErrNoMember is the error class of a dump without a replica set member it may read from
+var ErrNoMember = errors.New("no eligible member")
+
+// DumpReadConfig selects the replica set member mongodump reads from. With neither
+// Preference nor Member set MONGO_URI is passed to mongodump unchanged.
+type DumpReadConfig struct {
+	Preference string        // DUMP_READ_PREFERENCE: read preference mode of the dumps
+	Tags       string        // DUMP_READ_TAGS: tag sets "key:value,key:value" separated by ';', in order of preference
+	Member     string        // DUMP_MEMBER: host:port of a (hidden) member dumped over a direct connection
+	MaxLag     time.Duration // DUMP_MAX_LAG: highest replication lag of the member read from, 0 is not checked
+	Fallback   string        // DUMP_READ_FALLBACK: none (fail) or primary
+}
+
+// DumpTarget is how one mongodump run connects to the cluster
+type DumpTarget struct {
+	URI            string
+	ReadPreference string // --readPreference value, empty to keep the URI's
+	Source         string // member or read preference dumped from, for logs and the manifest
+}
+
+// ParseTagSets parses DUMP_READ_TAGS into tag sets
+func ParseTagSets(spec string) ([]map[string]string, error) {
+	var sets []map[string]string
+	for _, entry := range strings.Split(spec, ";") {
+		if entry = strings.TrimSpace(entry); entry == "" {
+			continue
+		}
+		set := map[string]string{}
+		for _, pair := range strings.Split(entry, ",") {
+			k, v, ok := strings.Cut(strings.TrimSpace(pair), ":")
+			if !ok || strings.TrimSpace(k) == "" {
+				return nil, fmt.Errorf("invalid tag %q (expected key:value)", pair)
+			}
+			set[strings.TrimSpace(k)] = strings.TrimSpace(v)
+		}
+		sets = append(sets, set)
+	}
+	return sets, nil
+}
+
+// validateDumpRead checks the combination of the DUMP_READ_* settings
+func validateDumpRead(c DumpReadConfig) error {
+	sets, err := ParseTagSets(c.Tags)
+	if err != nil {
+		return fmt.Errorf("DUMP_READ_TAGS: %w", err)
+	}
+	switch {
+	case c.Member != "" && c.Preference != "":
+		return errors.New("DUMP_MEMBER and DUMP_READ_PREFERENCE cannot both be set")
+	case len(sets) > 0 && c.Preference == "":
+		return errors.New("DUMP_READ_TAGS requires DUMP_READ_PREFERENCE")
+	case len(sets) > 0 && c.Preference == "primary":
+		return errors.New("DUMP_READ_TAGS cannot be used with DUMP_READ_PREFERENCE=primary")
+	}
+	if c.Member != "" {
+		if _, _, err := net.SplitHostPort(c.Member); err != nil {
+			return fmt.Errorf("DUMP_MEMBER: %w", err)
+		}
+	}
+	return nil
+}
+
+// replCandidate is a replica set member with its state from replSetGetStatus and its
+// settings from replSetGetConfig
+type replCandidate struct {
+	ReplSetMember
+	Hidden bool
+	Tags   map[string]string
+	Lag    time.Duration
+}
+
+// SelectDumpTarget checks through replSetGetStatus that the member selected by DUMP_MEMBER
+// or DUMP_READ_PREFERENCE is healthy and within DUMP_MAX_LAG, and returns how mongodump
+// connects to it. Without an eligible member it falls back to the primary with
+// DUMP_READ_FALLBACK=primary, and fails with ErrNoMember otherwise.
+func SelectDumpTarget(parent context.Context) (DumpTarget, error) {
+	cfg := AppConfig.DumpRead
+	target := DumpTarget{URI: AppConfig.MongoURI}
+	if cfg.Preference == "" && cfg.Member == "" {
+		return target, nil
+	}
+	if mongoClient == nil {
+		return target, fmt.Errorf("mongoClient is nil")
+	}
+	ctx, cancel := context.WithTimeout(parent, AppConfig.MongoOpTimeout)
+	defer cancel()
+
+	members, err := ReplSetMembers(ctx)
+	if err != nil {
+		return target, err
+	}
+	if members == nil {
+		if cfg.Member != "" {
+			return target, fmt.Errorf("%w: DUMP_MEMBER=%s needs a replica set", ErrNoMember, cfg.Member)
+		}
+		return target, nil // a standalone server has a single member to read from
+	}
+	configs, err := ReplSetConfigMembers(ctx)
+	if err != nil {
+		return target, err
+	}
+	lags := ReplicationLag(members)
+	candidates := make([]replCandidate, len(members))
+	for i, m := range members {
+		c := configs[m.Name]
+		candidates[i] = replCandidate{ReplSetMember: m, Hidden: c.Hidden, Tags: c.Tags, Lag: lags[m.Name]}
+	}
+
+	var eligible []replCandidate
+	var rejected []string
+	var wanted string
+	if cfg.Member != "" {
+		wanted = "DUMP_MEMBER=" + cfg.Member
+		eligible, rejected = memberCandidates(candidates, cfg)
+	} else {
+		wanted = "DUMP_READ_PREFERENCE=" + cfg.Preference
+		if cfg.Tags != "" {
+			wanted += " DUMP_READ_TAGS=" + cfg.Tags
+		}
+		eligible, rejected = preferenceCandidates(candidates, cfg)
+	}
+
+	if len(eligible) == 0 {
+		detail := strings.Join(rejected, "; ")
+		if cfg.Fallback != "primary" {
+			return target, fmt.Errorf("%w for %s (max lag %s): %s", ErrNoMember, wanted, cfg.MaxLag, detail)
+		}
+		Warn.Printf("No eligible member for %s, falling back to the primary: %s", wanted, detail)
+		uri, err := withoutReadPreference(AppConfig.MongoURI)
+		if err != nil {
+			return target, err
+		}
+		return DumpTarget{URI: uri, ReadPreference: "primary", Source: "primary (fallback)"}, nil
+	}
+
+	if cfg.Member != "" {
+		uri, err := directURI(AppConfig.MongoURI, cfg.Member)
+		if err != nil {
+			return target, err
+		}
+		return DumpTarget{URI: uri, Source: cfg.Member}, nil
+	}
+	uri, err := withoutReadPreference(AppConfig.MongoURI)
+	if err != nil {
+		return target, err
+	}
+	pref, err := readPreferenceArg(cfg)
+	if err != nil {
+		return target, err
+	}
+	names := make([]string, len(eligible))
+	for i, c := range eligible {
+		names[i] = c.Name
+	}
+	return DumpTarget{URI: uri, ReadPreference: pref, Source: cfg.Preference + " " + strings.Join(names, ",")}, nil
+}
+
+// memberCandidates returns the DUMP_MEMBER member if it is healthy and within DUMP_MAX_LAG
+func memberCandidates(candidates []replCandidate, cfg DumpReadConfig) ([]replCandidate, []string) {
+	for _, c := range candidates {
+		if c.Name != cfg.Member {
+			continue
+		}
+		if reason := unhealthy(c, cfg.MaxLag); reason != "" {
+			return nil, []string{c.Name + ": " + reason}
+		}
+		return []replCandidate{c}, nil
+	}
+	return nil, []string{cfg.Member + ": not a member of the replica set"}
+}
+
+// preferenceCandidates returns the healthy members the read preference may select, using
+// the first tag set that matches any of them like the drivers do
+func preferenceCandidates(candidates []replCandidate, cfg DumpReadConfig) ([]replCandidate, []string) {
+	sets, _ := ParseTagSets(cfg.Tags)
+	var primary, secondaries []replCandidate
+	var rejected []string
+	for _, c := range candidates {
+		if reason := unhealthy(c, cfg.MaxLag); reason != "" {
+			rejected = append(rejected, c.Name+": "+reason)
+			continue
+		}
+		switch {
+		case c.StateStr == "PRIMARY":
+			primary = append(primary, c)
+		case c.Hidden:
+			rejected = append(rejected, c.Name+": hidden (use DUMP_MEMBER)")
+		default:
+			secondaries = append(secondaries, c)
+		}
+	}
+	if cfg.Preference == "nearest" {
+		nearest, tagRejected := matchTagSets(append(primary, secondaries...), sets)
+		return nearest, append(rejected, tagRejected...)
+	}
+	secondaries, tagRejected := matchTagSets(secondaries, sets)
+	rejected = append(rejected, tagRejected...)
+
+	switch cfg.Preference {
+	case "primary":
+		return primary, rejected
+	case "secondary":
+		return secondaries, rejected
+	case "primaryPreferred":
+		if len(primary) > 0 {
+			return primary, rejected
+		}
+		return secondaries, rejected
+	default: // secondaryPreferred
+		if len(secondaries) > 0 {
+			return secondaries, rejected
+		}
+		if len(primary) > 0 {
+			Warn.Printf("No eligible secondary for DUMP_READ_PREFERENCE=secondaryPreferred, dumping from the primary: %s", strings.Join(rejected, "; "))
+		}
+		return primary, rejected
+	}
+}
+
+// matchTagSets returns the members matching the first tag set any member matches
+func matchTagSets(members []replCandidate, sets []map[string]string) ([]replCandidate, []string) {
+	if len(sets) == 0 || len(members) == 0 {
+		return members, nil
+	}
+	for _, set := range sets {
+		var matched []replCandidate
+		for _, m := range members {
+			if hasTags(m.Tags, set) {
+				matched = append(matched, m)
+			}
+		}
+		if len(matched) > 0 {
+			return matched, nil
+		}
+	}
+	var rejected []string
+	for _, m := range members {
+		rejected = append(rejected, fmt.Sprintf("%s: tags %v do not match", m.Name, m.Tags))
+	}
+	return nil, rejected
+}
+
+func hasTags(tags, set map[string]string) bool {
+	for k, v := range set {
+		if tags[k] != v {
+			return false
+		}
+	}
+	return true
+}
+
+// unhealthy returns why a member cannot be dumped from, or "" if it can
+func unhealthy(c replCandidate, maxLag time.Duration) string {
+	switch {
+	case c.StateStr != "PRIMARY" && c.StateStr != "SECONDARY":
+		return "state " + c.StateStr
+	case maxLag > 0 && c.Lag > maxLag:
+		return fmt.Sprintf("lag %s > %s", c.Lag.Round(time.Second), maxLag)
+	}
+	return ""
+}
+
+// readPreferenceArg returns the --readPreference value of cfg. The drivers' maxStalenessSeconds
+// (at least 90) keeps mongodump off members that fall behind after the check.
+func readPreferenceArg(cfg DumpReadConfig) (string, error) {
+	sets, err := ParseTagSets(cfg.Tags)
+	if err != nil {
+		return "", err
+	}
+	if len(sets) == 0 && (cfg.MaxLag <= 0 || cfg.Preference == "primary") {
+		return cfg.Preference, nil
+	}
+	pref := map[string]interface{}{"mode": cfg.Preference}
+	if len(sets) > 0 {
+		pref["tagSets"] = sets
+	}
+	if cfg.MaxLag > 0 && cfg.Preference != "primary" {
+		pref["maxStalenessSeconds"] = int(max(cfg.MaxLag, 90*time.Second).Seconds())
+	}
+	data, err := json.Marshal(pref)
+	return string(data), err
+}
+
+// withoutReadPreference removes the read preference options of uri, which mongodump
+// refuses next to --readPreference
+func withoutReadPreference(uri string) (string, error) {
+	u, err := url.Parse(uri)
+	if err != nil {
+		return "", fmt.Errorf("invalid MONGO_URI: %w", err)
+	}
+	q := u.Query()
+	for key := range q {
+		switch strings.ToLower(key) {
+		case "readpreference", "readpreferencetags", "maxstalenessseconds":
+			q.Del(key)
+		}
+	}
+	u.RawQuery = q.Encode()
+	return u.String(), nil
+}
+
+// directURI points uri at a single member with a direct connection; mongodb+srv URIs
+// become mongodb:// URIs with TLS on, as SRV implies
+func directURI(uri, member string) (string, error) {
+	u, err := url.Parse(uri)
+	if err != nil {
+		return "", fmt.Errorf("invalid MONGO_URI: %w", err)
+	}
+	q := u.Query()
+	if u.Scheme == "mongodb+srv" {
+		u.Scheme = "mongodb"
+		if q.Get("tls") == "" && q.Get("ssl") == "" {
+			q.Set("tls", "true")
+		}
+	}
+	u.Host = member
+	for key := range q {
+		switch strings.ToLower(key) {
+		case "replicaset", "readpreference", "readpreferencetags", "maxstalenessseconds":
+			q.Del(key)
+		}
+	}
+	q.Set("directConnection", "true")
+	u.RawQuery = q.Encode()
+	return u.String(), nil
+}
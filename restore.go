@@ -0,0 +1,161 @@
+package main
+
+import (
+	"context"
+	"flag"
+	"fmt"
+	"path"
+	"strings"
+	"time"
+)
+
+// runRestore implements the "restore" subcommand and returns the process exit code
+func runRestore(ctx context.Context, args []string) int {
+	fs := flag.NewFlagSet("restore", flag.ContinueOnError)
+	dbName := fs.String("db", "", "provider database to restore (required)")
+	date := fs.String("date", "", "backup date (YYYY-MM-DD or YYYY_MM_DD)")
+	from := fs.String("from", "", "first backup date of a range")
+	to := fs.String("to", "", "last backup date of a range")
+	targetDB := fs.String("target-db", "", "database to restore into (default: --db)")
+	targetColl := fs.String("target-collection", "", "collection to restore into (default: original name, single date only)")
+	replay := fs.Bool("oplog-replay", false, "replay the oplog captured during the dump (OPLOG_MODE=capture)")
+	until := fs.String("until", "", "replay the captured oplog up to this timestamp (seconds:ordinal or RFC 3339)")
+	if err := fs.Parse(args); err != nil {
+		return 2
+	}
+
+	if *dbName == "" {
+		Error.Println("restore: --db is required")
+		return 2
+	}
+	dates, err := ParseDateArgs(*date, *from, *to)
+	if err != nil {
+		Error.Printf("restore: %v", err)
+		return 2
+	}
+	if *targetColl != "" && len(dates) > 1 {
+		Error.Println("restore: --target-collection can only be used with a single date")
+		return 2
+	}
+	if *targetDB == "" {
+		*targetDB = *dbName
+	}
+	var limit *OplogPoint
+	if *until != "" {
+		p, err := ParseOplogPoint(*until)
+		if err != nil {
+			Error.Printf("restore: --until: %v", err)
+			return 2
+		}
+		limit = &p
+	}
+	// mongorestore connects by itself; replaying the oplog goes through mongoClient
+	if *replay || limit != nil {
+		if err := ConnectMongo(ctx, AppConfig.MongoURI); err != nil {
+			Error.Printf("Failed to connect MongoDB: %v", err)
+			return 1
+		}
+		defer DisconnectMongo()
+	}
+
+	failed := 0
+	for i, d := range dates {
+		if ctx.Err() != nil {
+			Warn.Printf("Shutdown signal received, restore stopped with %d days left", len(dates)-i)
+			failed += len(dates) - i
+			break
+		}
+		files, err := FindBackupFiles(ctx, *dbName, d)
+		if err != nil {
+			Error.Printf("restore: failed to search backups for DB=%s Date=%s: %v", *dbName, FormatDate(d), err)
+			failed++
+			continue
+		}
+		if len(files) == 0 {
+			Warn.Printf("restore: no backup found for DB=%s Date=%s", *dbName, FormatDate(d))
+			failed++
+			continue
+		}
+		if *targetColl != "" && len(files) > 1 {
+			Error.Printf("restore: --target-collection needs a single collection, DB=%s Date=%s has %d files", *dbName, FormatDate(d), len(files))
+			failed++
+			continue
+		}
+
+		Info.Printf("Restoring DB=%s Date=%s into %s (%d files)", *dbName, FormatDate(d), *targetDB, len(files))
+		if err := BulkRestore(ctx, files, *targetDB, *targetColl); err != nil {
+			Error.Printf("restore: DB=%s Date=%s: %v", *dbName, FormatDate(d), err)
+			failed++
+			continue
+		}
+		if *replay || limit != nil {
+			if err := restoreOplog(ctx, files, *targetDB, *targetColl, limit); err != nil {
+				Error.Printf("restore: oplog replay DB=%s Date=%s: %v", *dbName, FormatDate(d), err)
+				failed++
+			}
+		}
+	}
+
+	if failed > 0 {
+		Error.Printf("Restore finished with %d of %d days failed", failed, len(dates))
+		return 1
+	}
+	Info.Printf("Restore finished: %d days restored", len(dates))
+	return 0
+}
+
+// restoreOplog replays the captured oplog of every backup the restored files belong to, up to
+// until or, when nil, to the end of the dump, which makes the restore consistent as of that point
+func restoreOplog(ctx context.Context, files []string, dbName, collection string, until *OplogPoint) error {
+	seen := map[string]bool{}
+	for _, file := range files {
+		key := ManifestKey(file)
+		if seen[key] {
+			continue
+		}
+		seen[key] = true
+		m, err := ReadManifest(ctx, key)
+		if err != nil {
+			return fmt.Errorf("failed to read manifest %s: %w", key, err)
+		}
+		if m.Oplog == nil {
+			return fmt.Errorf("backup %s.%s has no oplog window (taken with OPLOG_MODE=off)", m.Database, m.Collection)
+		}
+		limit := m.Oplog.End
+		if until != nil {
+			limit = *until
+			switch {
+			case m.Oplog.End.After(limit):
+				Warn.Printf("Oplog replay stops at %s before the dump of %s.%s ended at %s: documents may already hold later writes",
+					limit, m.Database, m.Collection, m.Oplog.End)
+			case limit.After(m.Oplog.End):
+				Warn.Printf("Oplog of %s.%s was captured up to %s only, writes after it are not in the backup", m.Database, m.Collection, m.Oplog.End)
+			}
+		}
+		n, err := ReplayOplog(ctx, m, dbName, collection, limit)
+		if err != nil {
+			return err
+		}
+		Info.Printf("Oplog replayed: %s.%s -> %s Entries=%d Until=%s (%s)", m.Database, m.Collection, dbName, n, limit, limit.Time().UTC().Format(time.RFC3339))
+	}
+	return nil
+}
+
+// FindBackupFiles returns the storage keys of the compressed BSON files or archives of dbName
+// for date, over every collection configured in COLLECTIONS
+func FindBackupFiles(ctx context.Context, dbName string, date time.Time) ([]string, error) {
+	var keys []string
+	for _, collection := range CollectionNames(date) {
+		prefix := path.Join(dbName, collection, dbName) + "/"
+		objects, err := BackupStorage.List(ctx, prefix)
+		if err != nil {
+			return nil, err
+		}
+		for _, obj := range objects {
+			if base, _ := SplitArtifactKey(obj.Key); strings.HasSuffix(base, ".bson") || strings.HasSuffix(base, ".archive") {
+				keys = append(keys, obj.Key)
+			}
+		}
+	}
+	return keys, nil
+}
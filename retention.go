@@ -0,0 +1,305 @@
+package main
+
+import (
+	"context"
+	"flag"
+	"fmt"
+	"path"
+	"regexp"
+	"sort"
+	"strconv"
+	"strings"
+	"time"
+)
+
+// RetentionPolicy is a grandfather-father-son rule: keep the newest backup of the
+// last Daily days, of the last Weekly ISO weeks and of the last Monthly months
+type RetentionPolicy struct {
+	Daily   int
+	Weekly  int
+	Monthly int
+}
+
+// Enabled reports whether the policy prunes anything
+func (p RetentionPolicy) Enabled() bool {
+	return p.Daily > 0 || p.Weekly > 0 || p.Monthly > 0
+}
+
+func (p RetentionPolicy) String() string {
+	return fmt.Sprintf("daily=%d weekly=%d monthly=%d", p.Daily, p.Weekly, p.Monthly)
+}
+
+// RetentionRule applies a policy to databases matching a glob pattern
+type RetentionRule struct {
+	Pattern string
+	Policy  RetentionPolicy
+}
+
+// ParseRetentionRules parses RETENTION_RULES entries "pattern=daily:weekly:monthly" separated by ';'
+func ParseRetentionRules(spec string) ([]RetentionRule, error) {
+	var rules []RetentionRule
+	for _, entry := range strings.Split(spec, ";") {
+		entry = strings.TrimSpace(entry)
+		if entry == "" {
+			continue
+		}
+		pattern, counts, ok := strings.Cut(entry, "=")
+		if !ok {
+			return nil, fmt.Errorf("retention rule %q: expected pattern=daily:weekly:monthly", entry)
+		}
+		if _, err := path.Match(pattern, ""); err != nil {
+			return nil, fmt.Errorf("retention rule %q: invalid pattern: %w", entry, err)
+		}
+		policy, err := ParseRetentionPolicy(counts)
+		if err != nil {
+			return nil, fmt.Errorf("retention rule %q: %w", entry, err)
+		}
+		rules = append(rules, RetentionRule{Pattern: strings.TrimSpace(pattern), Policy: policy})
+	}
+	return rules, nil
+}
+
+// ParseRetentionPolicy parses "daily:weekly:monthly"
+func ParseRetentionPolicy(s string) (RetentionPolicy, error) {
+	parts := strings.Split(strings.TrimSpace(s), ":")
+	if len(parts) != 3 {
+		return RetentionPolicy{}, fmt.Errorf("expected daily:weekly:monthly, got %q", s)
+	}
+	var n [3]int
+	for i, p := range parts {
+		v, err := strconv.Atoi(p)
+		if err != nil || v < 0 {
+			return RetentionPolicy{}, fmt.Errorf("invalid count %q", p)
+		}
+		n[i] = v
+	}
+	return RetentionPolicy{Daily: n[0], Weekly: n[1], Monthly: n[2]}, nil
+}
+
+// RetentionPolicyFor returns the retention of the config file override of dbName, else the
+// policy of the first RETENTION_RULES entry matching dbName, or the global
+// RETENTION_DAILY/WEEKLY/MONTHLY policy
+func RetentionPolicyFor(dbName string, rules []RetentionRule) RetentionPolicy {
+	if i := databaseOverride(dbName); i >= 0 && AppConfig.Databases[i].Retention != nil {
+		return *AppConfig.Databases[i].Retention
+	}
+	for _, r := range rules {
+		if ok, _ := path.Match(r.Pattern, dbName); ok {
+			return r.Policy
+		}
+	}
+	return AppConfig.Retention
+}
+
+// RetainedDates returns the dates kept by policy out of dates (any order). A date listed
+// several times, once per collection of the day, counts once.
+func RetainedDates(dates []time.Time, policy RetentionPolicy) map[string]bool {
+	seen := map[string]bool{}
+	var sorted []time.Time
+	for _, d := range dates {
+		if !seen[FormatDate(d)] {
+			seen[FormatDate(d)] = true
+			sorted = append(sorted, d)
+		}
+	}
+	sort.Slice(sorted, func(i, j int) bool { return sorted[i].After(sorted[j]) })
+
+	keep := map[string]bool{}
+	for i := 0; i < len(sorted) && i < policy.Daily; i++ {
+		keep[FormatDate(sorted[i])] = true
+	}
+
+	weeks := map[string]bool{}
+	months := map[string]bool{}
+	for _, d := range sorted {
+		year, week := d.ISOWeek()
+		if wk := fmt.Sprintf("%d-W%02d", year, week); !weeks[wk] && len(weeks) < policy.Weekly {
+			weeks[wk] = true
+			keep[FormatDate(d)] = true
+		}
+		if mk := d.Format("2006-01"); !months[mk] && len(months) < policy.Monthly {
+			months[mk] = true
+			keep[FormatDate(d)] = true
+		}
+	}
+	return keep
+}
+
+// backupDatePattern extracts the date from a backup directory name such as GPS_2025_01_31
+// that no COLLECTIONS template matches
+var backupDatePattern = regexp.MustCompile(`(\d{4}_\d{2}_\d{2})`)
+
+// storedBackup is one dated backup directory of a database in BackupStorage
+type storedBackup struct {
+	Dir  string    // <db>/<collection dir>
+	Date time.Time // backup date, the collection's date minus its template offset
+	Keys []string
+}
+
+// listStoredBackups groups the objects in BackupStorage by database and backup directory
+func listStoredBackups(ctx context.Context) (map[string][]*storedBackup, error) {
+	objects, err := BackupStorage.List(ctx, "")
+	if err != nil {
+		return nil, err
+	}
+
+	byDir := map[string]*storedBackup{}
+	result := map[string][]*storedBackup{}
+	for _, obj := range objects {
+		parts := strings.SplitN(obj.Key, "/", 3)
+		if len(parts) < 3 || strings.HasPrefix(parts[0], "_") {
+			continue
+		}
+		date, ok := CollectionDate(parts[1])
+		if !ok {
+			continue
+		}
+		dir := parts[0] + "/" + parts[1]
+		b, ok := byDir[dir]
+		if !ok {
+			b = &storedBackup{Dir: dir, Date: date}
+			byDir[dir] = b
+			result[parts[0]] = append(result[parts[0]], b)
+		}
+		b.Keys = append(b.Keys, obj.Key)
+	}
+	return result, nil
+}
+
+// prunedBackups returns the backups of one database that policy expires. Only backups with a
+// successful backupHistory entry (done) take a retention slot; failed, partial or leftover
+// directories are pruned once they are older than the last successful backup, whose date is
+// always kept. Nothing newer than it is pruned, as it may still be written or retried.
+func prunedBackups(backups []*storedBackup, done map[string]bool, policy RetentionPolicy) []*storedBackup {
+	var last time.Time
+	var dates []time.Time
+	for _, b := range backups {
+		if done[path.Base(b.Dir)] {
+			dates = append(dates, b.Date)
+			if b.Date.After(last) {
+				last = b.Date
+			}
+		}
+	}
+	keep := RetainedDates(dates, policy)
+
+	var pruned []*storedBackup
+	for _, b := range backups {
+		if (done[path.Base(b.Dir)] && keep[FormatDate(b.Date)]) || !b.Date.Before(last) {
+			continue
+		}
+		pruned = append(pruned, b)
+	}
+	return pruned
+}
+
+// ApplyRetention prunes expired backups of the databases matching dbPatterns (all if empty).
+// Every collection of the date of the last successful backup of a database is always kept.
+func ApplyRetention(ctx context.Context, dbPatterns []string, dryRun bool) error {
+	rules, err := ParseRetentionRules(AppConfig.RetentionRules)
+	if err != nil {
+		return err
+	}
+	stored, err := listStoredBackups(ctx)
+	if err != nil {
+		return fmt.Errorf("failed to list stored backups: %w", err)
+	}
+
+	dbNames := make([]string, 0, len(stored))
+	for dbName := range stored {
+		dbNames = append(dbNames, dbName)
+	}
+	sort.Strings(dbNames)
+
+	prunedDirs, failed := 0, 0
+	for _, dbName := range dbNames {
+		if ctx.Err() != nil {
+			Warn.Printf("Retention stopped: pruned=%d failed=%d dryRun=%v", prunedDirs, failed, dryRun)
+			return fmt.Errorf("retention interrupted: %w", context.Cause(ctx))
+		}
+		if !matchesAny(dbName, dbPatterns) {
+			continue
+		}
+		policy := RetentionPolicyFor(dbName, rules)
+		if !policy.Enabled() {
+			continue
+		}
+
+		done, err := SuccessfulBackups(ctx, dbName)
+		if err != nil || len(done) == 0 {
+			Warn.Printf("Retention skipped: DB=%s Reason=no known successful backup (err=%v)", dbName, err)
+			continue
+		}
+
+		for _, b := range prunedBackups(stored[dbName], done, policy) {
+			collection := path.Base(b.Dir)
+			reason := policy.String()
+			if !done[collection] {
+				reason = "incomplete"
+			}
+			if dryRun {
+				Info.Printf("[DRY-RUN] Retention would prune: DB=%s Collection=%s Files=%d (%s)", dbName, collection, len(b.Keys), reason)
+				prunedDirs++
+				continue
+			}
+			if err := pruneBackup(ctx, dbName, collection, b.Keys); err != nil {
+				Error.Printf("Retention prune failed: DB=%s Collection=%s Error=%v", dbName, collection, err)
+				failed++
+				continue
+			}
+			Info.Printf("Retention pruned: DB=%s Collection=%s Files=%d (%s)", dbName, collection, len(b.Keys), reason)
+			prunedDirs++
+		}
+	}
+
+	Info.Printf("Retention finished: pruned=%d failed=%d dryRun=%v", prunedDirs, failed, dryRun)
+	if failed > 0 {
+		return fmt.Errorf("%d backups could not be pruned", failed)
+	}
+	return nil
+}
+
+// pruneBackup deletes the artifacts of one backup and marks its history as pruned
+func pruneBackup(ctx context.Context, dbName, collection string, keys []string) error {
+	for _, key := range keys {
+		if err := BackupStorage.Delete(ctx, key); err != nil {
+			return fmt.Errorf("failed to delete %s: %w", key, err)
+		}
+	}
+	return MarkBackupHistory(ctx, dbName, collection, StatusPruned, "expired by retention policy")
+}
+
+func matchesAny(name string, patterns []string) bool {
+	if len(patterns) == 0 {
+		return true
+	}
+	for _, p := range patterns {
+		if ok, _ := path.Match(p, name); ok {
+			return true
+		}
+	}
+	return false
+}
+
+// runPruneCommand implements the "prune" subcommand and returns the process exit code
+func runPruneCommand(ctx context.Context, args []string) int {
+	fs := flag.NewFlagSet("prune", flag.ContinueOnError)
+	var dbPatterns stringList
+	fs.Var(&dbPatterns, "db", "database name or glob, repeatable (default: all databases in storage)")
+	dryRun := fs.Bool("dry-run", AppConfig.RetentionDryRun, "only log what would be pruned")
+	if err := fs.Parse(args); err != nil {
+		return 2
+	}
+
+	if err := ConnectMongo(ctx, AppConfig.MongoURI); err != nil {
+		Error.Printf("Failed to connect MongoDB: %v", err)
+		return 1
+	}
+	defer DisconnectMongo()
+
+	if err := ApplyRetention(ctx, dbPatterns, *dryRun); err != nil {
+		Error.Printf("prune: %v", err)
+		return 1
+	}
+	return 0
+}
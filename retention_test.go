@@ -0,0 +1,136 @@
+package main
+
+import (
+	"path"
+	"sort"
+	"strings"
+	"testing"
+	"time"
+)
+
+func days(from string, n, copies int) []time.Time {
+	start, _ := time.ParseInLocation("2006-01-02", from, time.Local)
+	var dates []time.Time
+	for i := 0; i < n; i++ {
+		for c := 0; c < copies; c++ {
+			dates = append(dates, start.AddDate(0, 0, i))
+		}
+	}
+	return dates
+}
+
+func formatDates(dates []time.Time) []string {
+	var out []string
+	for _, d := range dates {
+		out = append(out, FormatDate(d))
+	}
+	return out
+}
+
+func keptDates(keep map[string]bool) []string {
+	var out []string
+	for d := range keep {
+		out = append(out, d)
+	}
+	sort.Strings(out)
+	return out
+}
+
+func TestRetainedDates(t *testing.T) {
+	gfs := []string{
+		"2025_02_28", "2025_03_31", "2025_04_13", "2025_04_20",
+		"2025_04_24", "2025_04_25", "2025_04_26", "2025_04_27", "2025_04_28", "2025_04_29", "2025_04_30",
+	}
+	tests := []struct {
+		name   string
+		dates  []time.Time
+		policy RetentionPolicy
+		want   []string
+	}{
+		{"grandfather-father-son", days("2025-01-01", 120, 1), RetentionPolicy{Daily: 7, Weekly: 4, Monthly: 3}, gfs},
+		// Every COLLECTIONS template stores its own directory for the same date
+		{"one entry per collection", days("2025-01-01", 120, 3), RetentionPolicy{Daily: 7, Weekly: 4, Monthly: 3}, gfs},
+		{"daily only", days("2025-01-01", 30, 3), RetentionPolicy{Daily: 14}, formatDates(days("2025-01-17", 14, 1))},
+		{"fewer backups than the policy", days("2025-01-01", 3, 2), RetentionPolicy{Daily: 7, Weekly: 4, Monthly: 3}, []string{"2025_01_01", "2025_01_02", "2025_01_03"}},
+		{"disabled", days("2025-01-01", 10, 1), RetentionPolicy{}, nil},
+	}
+	for _, tt := range tests {
+		t.Run(tt.name, func(t *testing.T) {
+			// Order must not matter
+			var dates []time.Time
+			for i := len(tt.dates) - 1; i >= 0; i -= 2 {
+				dates = append(dates, tt.dates[i])
+			}
+			for i := len(tt.dates) - 2; i >= 0; i -= 2 {
+				dates = append(dates, tt.dates[i])
+			}
+			got := keptDates(RetainedDates(dates, tt.policy))
+			if len(got) != len(tt.want) {
+				t.Fatalf("kept %d dates %v, want %d %v", len(got), got, len(tt.want), tt.want)
+			}
+			for i := range got {
+				if got[i] != tt.want[i] {
+					t.Fatalf("kept %v, want %v", got, tt.want)
+				}
+			}
+		})
+	}
+}
+
+func TestParseRetentionRules(t *testing.T) {
+	rules, err := ParseRetentionRules(" 2024_* = 7:4:12 ; archive_*=0:0:24;")
+	if err != nil {
+		t.Fatal(err)
+	}
+	want := []RetentionRule{
+		{Pattern: "2024_*", Policy: RetentionPolicy{Daily: 7, Weekly: 4, Monthly: 12}},
+		{Pattern: "archive_*", Policy: RetentionPolicy{Monthly: 24}},
+	}
+	if len(rules) != len(want) {
+		t.Fatalf("got %d rules, want %d", len(rules), len(want))
+	}
+	for i := range want {
+		if rules[i] != want[i] {
+			t.Errorf("rule %d = %+v, want %+v", i, rules[i], want[i])
+		}
+	}
+
+	for _, spec := range []string{"2024_*", "2024_*=7:4", "2024_*=7:-1:3", "2024_*=a:b:c", "[=1:1:1"} {
+		if _, err := ParseRetentionRules(spec); err == nil {
+			t.Errorf("ParseRetentionRules(%q): expected an error", spec)
+		}
+	}
+}
+
+func TestPrunedBackups(t *testing.T) {
+	var backups []*storedBackup
+	done := map[string]bool{}
+	for _, d := range days("2025-01-01", 20, 1) {
+		dir := "GPS_" + FormatDate(d)
+		backups = append(backups, &storedBackup{Dir: "2024_provider1/" + dir, Date: d})
+		// the newest days failed, or are still being written
+		if d.Day() <= 16 {
+			done[dir] = true
+		}
+	}
+	// failed days in between take no daily slot
+	delete(done, "GPS_2025_01_15")
+	delete(done, "GPS_2025_01_14")
+
+	var pruned []string
+	for _, b := range prunedBackups(backups, done, RetentionPolicy{Daily: 3}) {
+		pruned = append(pruned, path.Base(b.Dir))
+	}
+	want := []string{
+		"GPS_2025_01_01", "GPS_2025_01_02", "GPS_2025_01_03", "GPS_2025_01_04", "GPS_2025_01_05",
+		"GPS_2025_01_06", "GPS_2025_01_07", "GPS_2025_01_08", "GPS_2025_01_09", "GPS_2025_01_10",
+		"GPS_2025_01_11", "GPS_2025_01_14", "GPS_2025_01_15",
+	}
+	if strings.Join(pruned, " ") != strings.Join(want, " ") {
+		t.Errorf("pruned %v, want %v", pruned, want)
+	}
+
+	if got := prunedBackups(backups, map[string]bool{}, RetentionPolicy{Daily: 3}); len(got) != 0 {
+		t.Errorf("without a successful backup %d backups pruned, want none", len(got))
+	}
+}
@@ -0,0 +1,138 @@
+package main
+
+import (
+	"bytes"
+	"context"
+	"crypto/rand"
+	"encoding/hex"
+	"encoding/json"
+	"time"
+)
+
+// Run statuses recorded in backupRuns
+const (
+	RunCompleted    = "completed"               // every job succeeded or was skipped
+	RunWithFailures = "completed_with_failures" // at least one job failed
+	RunFailed       = "failed"                  // the run could not start its jobs
+	RunInterrupted  = "interrupted"             // stopped by a shutdown before every job finished
+)
+
+// RunJobSummary is the outcome of one database/date job of a run
+type RunJobSummary struct {
+	Database        string `bson:"database" json:"database"`
+	Date            string `bson:"date" json:"date"`
+	Status          string `bson:"status" json:"status"`
+	Attempts        int    `bson:"attempts" json:"attempts"`
+	RawBytes        int64  `bson:"rawBytes" json:"rawBytes"`
+	CompressedBytes int64  `bson:"compressedBytes" json:"compressedBytes"`
+	Error           string `bson:"error,omitempty" json:"error,omitempty"`
+	ErrorClass      string `bson:"errorClass,omitempty" json:"errorClass,omitempty"`
+	SkipReason      string `bson:"skipReason,omitempty" json:"skipReason,omitempty"`
+}
+
+// BackupRun is one document of the admin.backupRuns collection, also written as
+// _runs/<runId>.json in the storage backend
+type BackupRun struct {
+	RunID           string          `bson:"runId" json:"runId"`
+	TargetDate      string          `bson:"targetDate" json:"targetDate"`
+	Status          string          `bson:"status" json:"status"`
+	StartedAt       time.Time       `bson:"startedAt" json:"startedAt"`
+	FinishedAt      time.Time       `bson:"finishedAt" json:"finishedAt"`
+	DurationSeconds float64         `bson:"durationSeconds" json:"durationSeconds"`
+	Jobs            int             `bson:"jobs" json:"jobs"`
+	Success         int             `bson:"success" json:"success"`
+	Skipped         int             `bson:"skipped" json:"skipped"`
+	Failed          int             `bson:"failed" json:"failed"`
+	Interrupted     int             `bson:"interrupted" json:"interrupted"`
+	RawBytes        int64           `bson:"rawBytes" json:"rawBytes"`
+	CompressedBytes int64           `bson:"compressedBytes" json:"compressedBytes"`
+	Error           string          `bson:"error,omitempty" json:"error,omitempty"`
+	Results         []RunJobSummary `bson:"results" json:"results"`
+}
+
+// NewBackupRun starts a run for targetDate with a new run ID
+func NewBackupRun(targetDate time.Time) *BackupRun {
+	now := time.Now()
+	suffix := make([]byte, 3)
+	rand.Read(suffix)
+	return &BackupRun{
+		RunID:      now.Format("2006_01_02_15_04_05") + "_" + hex.EncodeToString(suffix),
+		TargetDate: FormatDate(targetDate),
+		StartedAt:  now,
+	}
+}
+
+// Finish summarises results, stores the run in backupRuns and writes its JSON report.
+// A non-nil err marks a run that could not start its jobs.
+func (r *BackupRun) Finish(results []JobResult, err error) {
+	r.FinishedAt = time.Now()
+	r.DurationSeconds = r.FinishedAt.Sub(r.StartedAt).Seconds()
+	r.Jobs = len(results)
+	for _, res := range results {
+		s := RunJobSummary{
+			Database:        res.Job.Database,
+			Date:            FormatDate(res.Job.Date),
+			Status:          string(res.Status),
+			Attempts:        res.Attempts,
+			RawBytes:        res.RawSize,
+			CompressedBytes: res.CompressedSize,
+			SkipReason:      res.SkipReason,
+		}
+		if res.Error != nil {
+			s.Error = res.Error.Error()
+			s.ErrorClass = ErrorClass(res.Error)
+		}
+		switch res.Status {
+		case StatusSuccess:
+			r.Success++
+		case StatusSkipped:
+			r.Skipped++
+		case StatusInterrupted:
+			r.Interrupted++
+		default:
+			r.Failed++
+		}
+		r.RawBytes += res.RawSize
+		r.CompressedBytes += res.CompressedSize
+		r.Results = append(r.Results, s)
+	}
+
+	switch {
+	case err != nil:
+		r.Status = RunFailed
+		r.Error = err.Error()
+	case r.Interrupted > 0:
+		r.Status = RunInterrupted
+	case r.Failed > 0:
+		r.Status = RunWithFailures
+	default:
+		r.Status = RunCompleted
+	}
+
+	Info.Printf("Run finished: RunID=%s Status=%s Jobs=%d success=%d skipped=%d failed=%d interrupted=%d Duration=%s",
+		r.RunID, r.Status, r.Jobs, r.Success, r.Skipped, r.Failed, r.Interrupted, r.FinishedAt.Sub(r.StartedAt).Round(time.Second))
+
+	// The summary is recorded even when the run was stopped by a shutdown
+	ctx := context.Background()
+	if err := SaveBackupRun(ctx, r); err != nil {
+		Error.Printf("Failed to save run summary: RunID=%s Error=%v", r.RunID, err)
+	}
+	if err := writeRunReport(ctx, r); err != nil {
+		Error.Printf("Failed to write run report: RunID=%s Error=%v", r.RunID, err)
+	}
+	NotifyRun(r)
+}
+
+// writeRunReport writes the run summary to _runs/<runId>.json in the storage backend
+func writeRunReport(ctx context.Context, r *BackupRun) error {
+	data, err := json.MarshalIndent(r, "", "  ")
+	if err != nil {
+		return err
+	}
+	key := "_runs/" + r.RunID + ".json"
+	if err := BackupStorage.Put(ctx, key, bytes.NewReader(data), int64(len(data))); err != nil {
+		return err
+	}
+	Info.Printf("Run report written: %s", BackupStorage.URL(key))
+	return nil
+}
@@ -0,0 +1,283 @@
+package main
+
+import (
+	"context"
+	"fmt"
+	"strconv"
+	"strings"
+	"time"
+)
+
+// CronSchedule is a parsed standard 5-field cron expression (minute hour day-of-month month day-of-week)
+type CronSchedule struct {
+	minute, hour, dom, month, dow uint64
+	domAny, dowAny                bool
+}
+
+var cronMacros = map[string]string{
+	"@yearly":   "0 0 1 1 *",
+	"@annually": "0 0 1 1 *",
+	"@monthly":  "0 0 1 * *",
+	"@weekly":   "0 0 * * 0",
+	"@daily":    "0 0 * * *",
+	"@midnight": "0 0 * * *",
+	"@hourly":   "0 * * * *",
+}
+
+// ParseCron parses a 5-field cron expression or one of the @hourly/@daily/... macros
+func ParseCron(expr string) (*CronSchedule, error) {
+	spec := strings.TrimSpace(expr)
+	if m, ok := cronMacros[spec]; ok {
+		spec = m
+	}
+	fields := strings.Fields(spec)
+	if len(fields) != 5 {
+		return nil, fmt.Errorf("cron %q: expected 5 fields, got %d", expr, len(fields))
+	}
+
+	var c CronSchedule
+	var err error
+	if c.minute, err = parseCronField(fields[0], 0, 59); err != nil {
+		return nil, fmt.Errorf("cron %q minute: %w", expr, err)
+	}
+	if c.hour, err = parseCronField(fields[1], 0, 23); err != nil {
+		return nil, fmt.Errorf("cron %q hour: %w", expr, err)
+	}
+	if c.dom, err = parseCronField(fields[2], 1, 31); err != nil {
+		return nil, fmt.Errorf("cron %q day-of-month: %w", expr, err)
+	}
+	if c.month, err = parseCronField(fields[3], 1, 12); err != nil {
+		return nil, fmt.Errorf("cron %q month: %w", expr, err)
+	}
+	if c.dow, err = parseCronField(fields[4], 0, 7); err != nil {
+		return nil, fmt.Errorf("cron %q day-of-week: %w", expr, err)
+	}
+	// 7 is an alias for Sunday
+	if c.dow&(1<<7) != 0 {
+		c.dow |= 1
+	}
+	c.domAny = fields[2] == "*" || fields[2] == "?"
+	c.dowAny = fields[4] == "*" || fields[4] == "?"
+	// Days such as "30 2" (February 30th) pass the field ranges but never come
+	if c.Next(time.Now().UTC()).IsZero() {
+		return nil, fmt.Errorf("cron %q never matches", expr)
+	}
+	return &c, nil
+}
+
+// parseCronField parses a comma separated list of values, ranges and steps into a bitset
+func parseCronField(field string, min, max int) (uint64, error) {
+	var bits uint64
+	for _, part := range strings.Split(field, ",") {
+		rangePart, step := part, 1
+		if i := strings.Index(part, "/"); i >= 0 {
+			s, err := strconv.Atoi(part[i+1:])
+			if err != nil || s <= 0 {
+				return 0, fmt.Errorf("invalid step in %q", part)
+			}
+			rangePart, step = part[:i], s
+		}
+
+		lo, hi := min, max
+		switch {
+		case rangePart == "*" || rangePart == "?":
+		case strings.Contains(rangePart, "-"):
+			bounds := strings.SplitN(rangePart, "-", 2)
+			var err1, err2 error
+			lo, err1 = strconv.Atoi(bounds[0])
+			hi, err2 = strconv.Atoi(bounds[1])
+			if err1 != nil || err2 != nil {
+				return 0, fmt.Errorf("invalid range %q", part)
+			}
+		default:
+			v, err := strconv.Atoi(rangePart)
+			if err != nil {
+				return 0, fmt.Errorf("invalid value %q", part)
+			}
+			lo, hi = v, v
+			if step > 1 {
+				hi = max
+			}
+		}
+		if lo < min || hi > max || lo > hi {
+			return 0, fmt.Errorf("%q out of range %d-%d", part, min, max)
+		}
+		for v := lo; v <= hi; v += step {
+			bits |= 1 << uint(v)
+		}
+	}
+	return bits, nil
+}
+
+func (c *CronSchedule) dayMatches(t time.Time) bool {
+	domOK := c.dom&(1<<uint(t.Day())) != 0
+	dowOK := c.dow&(1<<uint(t.Weekday())) != 0
+	// Standard cron: when both day fields are restricted, either one matching is enough
+	if !c.domAny && !c.dowAny {
+		return domOK || dowOK
+	}
+	return domOK && dowOK
+}
+
+// Next returns the first matching wall-clock minute strictly after t, in t's location, or the
+// zero time when nothing matches within 5 years. Fields are stepped on the calendar rather
+// than by fixed 24h offsets, so DST changes do not shift the schedule; a wall-clock time
+// repeated by a DST fall-back fires once unless the spec runs every hour, and one skipped
+// by a spring-forward does not fire that day.
+func (c *CronSchedule) Next(t time.Time) time.Time {
+	loc := t.Location()
+	t = t.Truncate(time.Minute).Add(time.Minute)
+	yearLimit := t.Year() + 5
+
+	for t.Year() <= yearLimit {
+		if c.month&(1<<uint(t.Month())) == 0 {
+			t = forward(t, time.Date(t.Year(), t.Month()+1, 1, 0, 0, 0, 0, loc))
+			continue
+		}
+		if !c.dayMatches(t) {
+			t = forward(t, time.Date(t.Year(), t.Month(), t.Day()+1, 0, 0, 0, 0, loc))
+			continue
+		}
+		if c.hour&(1<<uint(t.Hour())) == 0 {
+			// Step in elapsed time: time.Date would resolve an hour repeated by a DST
+			// fall-back to its second occurrence, which never fires
+			t = t.Add(time.Duration(60-t.Minute()) * time.Minute)
+			continue
+		}
+		if c.minute&(1<<uint(t.Minute())) == 0 || (c.hour != everyHour && isRepeatedWallClock(t)) {
+			t = t.Add(time.Minute)
+			continue
+		}
+		return t
+	}
+	return time.Time{}
+}
+
+// everyHour is the hour field of a spec such as "0 * * * *", which also fires in the hour
+// repeated by a DST fall-back so that no hourly run is lost
+const everyHour = 1<<24 - 1
+
+// forward returns next, moved past t when time.Date normalized a wall-clock time
+// inside a DST gap to an instant that is not after t
+func forward(t, next time.Time) time.Time {
+	for !next.After(t) {
+		next = next.Add(time.Hour)
+	}
+	return next
+}
+
+// isRepeatedWallClock reports whether t is the second occurrence of a wall-clock time after a DST fall-back
+func isRepeatedWallClock(t time.Time) bool {
+	_, offNow := t.Zone()
+	_, offBefore := t.Add(-3 * time.Hour).Zone()
+	if offBefore <= offNow {
+		return false
+	}
+	earlier := t.Add(-time.Duration(offBefore-offNow) * time.Second)
+	return earlier.Hour() == t.Hour() && earlier.Minute() == t.Minute()
+}
+
+// Schedule is one scheduled backup: when it fires, which databases and which day it backs up
+type Schedule struct {
+	Spec       string
+	Cron       *CronSchedule
+	DBPattern  string
+	DateOffset int // days relative to the fire time, -1 = yesterday, 0 = today (partial)
+}
+
+// ParseSchedules parses SCHEDULES entries separated by ';', each as "cron|dbPattern|dateOffset".
+// dbPattern defaults to "*" and dateOffset to -1.
+func ParseSchedules(spec string) ([]Schedule, error) {
+	var schedules []Schedule
+	for _, entry := range strings.Split(spec, ";") {
+		entry = strings.TrimSpace(entry)
+		if entry == "" {
+			continue
+		}
+		parts := strings.Split(entry, "|")
+		if len(parts) > 3 {
+			return nil, fmt.Errorf("schedule %q: expected cron|dbPattern|dateOffset", entry)
+		}
+
+		cron, err := ParseCron(parts[0])
+		if err != nil {
+			return nil, err
+		}
+		s := Schedule{Spec: strings.TrimSpace(parts[0]), Cron: cron, DBPattern: "*", DateOffset: -1}
+		if len(parts) > 1 && strings.TrimSpace(parts[1]) != "" {
+			s.DBPattern = strings.TrimSpace(parts[1])
+		}
+		if len(parts) > 2 && strings.TrimSpace(parts[2]) != "" {
+			if s.DateOffset, err = strconv.Atoi(strings.TrimSpace(parts[2])); err != nil {
+				return nil, fmt.Errorf("schedule %q: invalid date offset %q", entry, parts[2])
+			}
+		}
+		schedules = append(schedules, s)
+	}
+	if len(schedules) == 0 {
+		return nil, fmt.Errorf("no schedules configured")
+	}
+	return schedules, nil
+}
+
+// LoadSchedules builds the schedule list from SCHEDULES, falling back to SCHEDULE_HOUR/SCHEDULE_MINUTE
+func LoadSchedules() ([]Schedule, *time.Location, error) {
+	loc := time.Local
+	if AppConfig.ScheduleTZ != "" {
+		l, err := time.LoadLocation(AppConfig.ScheduleTZ)
+		if err != nil {
+			return nil, nil, fmt.Errorf("invalid SCHEDULE_TZ %q: %w", AppConfig.ScheduleTZ, err)
+		}
+		loc = l
+	}
+
+	spec := AppConfig.Schedules
+	if spec == "" {
+		spec = fmt.Sprintf("%d %d * * *|*|-1", AppConfig.ScheduleMin, AppConfig.ScheduleHour)
+	}
+	schedules, err := ParseSchedules(spec)
+	return schedules, loc, err
+}
+
+// NextScheduledRun returns the earliest fire time after now and every schedule due at that time
+func NextScheduledRun(schedules []Schedule, now time.Time) (time.Time, []Schedule) {
+	var next time.Time
+	var due []Schedule
+	for _, s := range schedules {
+		t := s.Cron.Next(now)
+		if t.IsZero() {
+			continue
+		}
+		switch {
+		case next.IsZero() || t.Before(next):
+			next, due = t, []Schedule{s}
+		case t.Equal(next):
+			due = append(due, s)
+		}
+	}
+	return next, due
+}
+
+// RunSchedule runs one schedule fired at firedAt. Past days go through RunFullBackup with
+// backfill; today or later is a partial day and is re-dumped on every run.
+func RunSchedule(ctx context.Context, s Schedule, firedAt time.Time) *BackupRun {
+	date := firedAt.AddDate(0, 0, s.DateOffset)
+	Info.Printf("Running schedule %q: DB=%s Date=%s", s.Spec, s.DBPattern, FormatDate(date))
+
+	if s.DateOffset < 0 {
+		return RunFullBackup(ctx, date, []string{s.DBPattern})
+	}
+
+	dbs, err := ExpandDatabasePatterns(ctx, []string{s.DBPattern})
+	if err != nil {
+		Error.Printf("Failed to list databases: %v", err)
+		run := NewBackupRun(date)
+		run.Finish(nil, err)
+		return run
+	}
+	var jobs []BackupJob
+	for _, dbName := range dbs {
+		jobs = append(jobs, BackupJob{Database: dbName, Date: date, Force: true, Partial: true})
+	}
+	return RunBackupJobs(ctx, date, jobs)
+}
@@ -0,0 +1,131 @@
+package main
+
+import (
+	"testing"
+	"time"
+)
+
+func TestParseCronRejectsInvalid(t *testing.T) {
+	for _, expr := range []string{
+		"",
+		"0 2 * *",
+		"60 2 * * *",
+		"0 24 * * *",
+		"0 2 0 * *",
+		"0 2 * 13 *",
+		"0 2 * * 8",
+		"0 5-2 * * *",
+		"*/0 * * * *",
+		"a 2 * * *",
+		"@every 5m",
+		"0 0 30 2 *",
+		"0 0 31 4,6,9,11 *",
+	} {
+		if _, err := ParseCron(expr); err == nil {
+			t.Errorf("ParseCron(%q): expected an error", expr)
+		}
+	}
+}
+
+func TestCronNext(t *testing.T) {
+	berlin, err := time.LoadLocation("Europe/Berlin")
+	if err != nil {
+		t.Skipf("time zone data not available: %v", err)
+	}
+	at := func(s string) time.Time {
+		layout := "2006-01-02 15:04"
+		if len(s) > len(layout) {
+			layout += " MST" // wall-clock times repeated by a fall-back need the zone
+		}
+		v, err := time.ParseInLocation(layout, s, berlin)
+		if err != nil {
+			t.Fatal(err)
+		}
+		return v
+	}
+
+	tests := []struct {
+		name string
+		expr string
+		from time.Time
+		want []time.Time
+	}{
+		{"daily", "30 2 * * *", at("2025-01-10 02:30"), []time.Time{at("2025-01-11 02:30"), at("2025-01-12 02:30")}},
+		{"steps and lists", "*/20 1,3 * * *", at("2025-01-10 01:45"), []time.Time{at("2025-01-10 03:00"), at("2025-01-10 03:20"), at("2025-01-10 03:40"), at("2025-01-11 01:00")}},
+		{"macro", "@monthly", at("2025-01-10 00:00"), []time.Time{at("2025-02-01 00:00"), at("2025-03-01 00:00")}},
+		{"sunday as 7", "0 4 * * 7", at("2025-01-10 00:00"), []time.Time{at("2025-01-12 04:00"), at("2025-01-19 04:00")}},
+		{"day of month or week", "0 0 13 * 5", at("2025-06-10 00:00"), []time.Time{at("2025-06-13 00:00"), at("2025-06-20 00:00"), at("2025-06-27 00:00"), at("2025-07-04 00:00"), at("2025-07-11 00:00"), at("2025-07-13 00:00")}},
+		// 2025-03-30 02:00 CET jumps to 03:00 CEST: 02:30 does not exist that day
+		{"spring forward gap", "30 2 * * *", at("2025-03-29 12:00"), []time.Time{at("2025-03-31 02:30")}},
+		{"spring forward after gap", "0 3 * * *", at("2025-03-29 12:00"), []time.Time{at("2025-03-30 03:00"), at("2025-03-31 03:00")}},
+		{"spring forward daily length", "0 12 * * *", at("2025-03-29 12:00"), []time.Time{at("2025-03-30 12:00"), at("2025-03-31 12:00")}},
+		// 2025-10-26 03:00 CEST falls back to 02:00 CET: 02:30 happens twice and fires once
+		{"fall back repeat", "30 2 * * *", at("2025-10-25 12:00"), []time.Time{at("2025-10-26 02:30 CEST"), at("2025-10-27 02:30")}},
+		{"fall back hourly", "@hourly", at("2025-10-26 01:30"), []time.Time{at("2025-10-26 02:00 CEST"), at("2025-10-26 02:00 CET"), at("2025-10-26 03:00"), at("2025-10-26 04:00")}},
+		{"fall back every 20 minutes", "*/20 * * * *", at("2025-10-26 02:30 CEST"), []time.Time{at("2025-10-26 02:40 CEST"), at("2025-10-26 02:00 CET"), at("2025-10-26 02:20 CET")}},
+		{"fall back hour steps", "0 */2 * * *", at("2025-10-26 01:30"), []time.Time{at("2025-10-26 02:00 CEST"), at("2025-10-26 04:00")}},
+		{"leap day", "0 0 29 2 *", at("2025-01-10 00:00"), []time.Time{at("2028-02-29 00:00")}},
+	}
+	for _, tt := range tests {
+		t.Run(tt.name, func(t *testing.T) {
+			c, err := ParseCron(tt.expr)
+			if err != nil {
+				t.Fatal(err)
+			}
+			from := tt.from
+			for i, want := range tt.want {
+				got := c.Next(from)
+				if !got.Equal(want) {
+					t.Fatalf("Next #%d after %s = %s, want %s", i+1, from, got, want)
+				}
+				from = got
+			}
+		})
+	}
+}
+
+func TestCronNextFallBackFiresOnce(t *testing.T) {
+	berlin, err := time.LoadLocation("Europe/Berlin")
+	if err != nil {
+		t.Skipf("time zone data not available: %v", err)
+	}
+	c, err := ParseCron("30 2 * * *")
+	if err != nil {
+		t.Fatal(err)
+	}
+	// First 02:30 is CEST (+02:00); the second, one hour later, is CET (+01:00)
+	first := time.Date(2025, 10, 26, 0, 30, 0, 0, time.UTC).In(berlin)
+	if got := c.Next(first); got.Day() != 27 {
+		t.Fatalf("Next after the first 02:30 = %s, want the next day", got)
+	}
+}
+
+func TestParseSchedules(t *testing.T) {
+	schedules, err := ParseSchedules(" 0 2 * * * ; @hourly|2024_*|0 ;30 3 * * 1||-2")
+	if err != nil {
+		t.Fatal(err)
+	}
+	want := []struct {
+		spec, pattern string
+		offset        int
+	}{
+		{"0 2 * * *", "*", -1},
+		{"@hourly", "2024_*", 0},
+		{"30 3 * * 1", "*", -2},
+	}
+	if len(schedules) != len(want) {
+		t.Fatalf("got %d schedules, want %d", len(schedules), len(want))
+	}
+	for i, w := range want {
+		s := schedules[i]
+		if s.Spec != w.spec || s.DBPattern != w.pattern || s.DateOffset != w.offset {
+			t.Errorf("schedule %d = %q|%q|%d, want %q|%q|%d", i, s.Spec, s.DBPattern, s.DateOffset, w.spec, w.pattern, w.offset)
+		}
+	}
+
+	for _, spec := range []string{"", " ; ", "0 2 * * *|a|b|c", "0 2 * * *|*|x"} {
+		if _, err := ParseSchedules(spec); err == nil {
+			t.Errorf("ParseSchedules(%q): expected an error", spec)
+		}
+	}
+}
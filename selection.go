@@ -0,0 +1,257 @@
+package main
+
+import (
+	"fmt"
+	"path"
+	"regexp"
+	"strconv"
+	"strings"
+	"time"
+)
+
+// DefaultDBInclude matches the YYYY_providerId provider databases
+const DefaultDBInclude = "[0-9][0-9][0-9][0-9]_*"
+
+// DefaultCollections is the daily GPS collection GPS_YYYY_MM_DD
+const DefaultCollections = "GPS_{date}"
+
+// AllCollectionsPrefix names the backup of a whole database (COLLECTIONS=*), e.g. ALL_2025_01_31
+const AllCollectionsPrefix = "ALL_"
+
+// DatabaseFilter selects the databases to back up: a database is selected when it
+// matches one Include glob and no Exclude glob
+type DatabaseFilter struct {
+	Include []string
+	Exclude []string
+}
+
+// BackupDatabases is the database selection parsed from DB_INCLUDE/DB_EXCLUDE
+var BackupDatabases = DatabaseFilter{Include: []string{DefaultDBInclude}}
+
+// ParseDatabaseFilter parses comma separated DB_INCLUDE and DB_EXCLUDE globs;
+// an empty include list selects the provider databases
+func ParseDatabaseFilter(include, exclude string) (DatabaseFilter, error) {
+	var f DatabaseFilter
+	var err error
+	if f.Include, err = splitGlobs(include); err != nil {
+		return f, fmt.Errorf("DB_INCLUDE: %w", err)
+	}
+	if f.Exclude, err = splitGlobs(exclude); err != nil {
+		return f, fmt.Errorf("DB_EXCLUDE: %w", err)
+	}
+	if len(f.Include) == 0 {
+		f.Include = []string{DefaultDBInclude}
+	}
+	return f, nil
+}
+
+func splitGlobs(spec string) ([]string, error) {
+	var globs []string
+	for _, p := range strings.Split(spec, ",") {
+		if p = strings.TrimSpace(p); p == "" {
+			continue
+		}
+		if _, err := path.Match(p, ""); err != nil {
+			return nil, fmt.Errorf("invalid pattern %q: %w", p, err)
+		}
+		globs = append(globs, p)
+	}
+	return globs, nil
+}
+
+// Match reports whether dbName is selected
+func (f DatabaseFilter) Match(dbName string) bool {
+	for _, p := range f.Exclude {
+		if ok, _ := path.Match(p, dbName); ok {
+			return false
+		}
+	}
+	return matchesAny(dbName, f.Include)
+}
+
+// CollectionTemplate names one daily collection, e.g. "events_{YYYY}{MM}{DD}".
+// The backup date plus Offset days is rendered into the {YYYY}, {MM}, {DD} and
+// {date} (YYYY_MM_DD) placeholders. The template "*" backs up every collection.
+type CollectionTemplate struct {
+	Template string
+	Offset   int
+	pattern  *regexp.Regexp // matches rendered names, capturing year, month and day
+}
+
+// CollectionTemplates is the list parsed from COLLECTIONS
+var CollectionTemplates = mustParseCollectionTemplates(DefaultCollections)
+
+var placeholderPattern = regexp.MustCompile(`\{(YYYY|MM|DD|date)\}`)
+
+// ParseCollectionTemplates parses COLLECTIONS entries separated by ';', each as "template|dateOffset".
+// dateOffset defaults to 0; an empty spec is the daily GPS collection.
+func ParseCollectionTemplates(spec string) ([]CollectionTemplate, error) {
+	if strings.TrimSpace(spec) == "" {
+		spec = DefaultCollections
+	}
+	var templates []CollectionTemplate
+	seen := map[string]bool{}
+	for _, entry := range strings.Split(spec, ";") {
+		entry = strings.TrimSpace(entry)
+		if entry == "" {
+			continue
+		}
+		tmpl, offset, hasOffset := strings.Cut(entry, "|")
+		t := CollectionTemplate{Template: strings.TrimSpace(tmpl)}
+		if hasOffset && strings.TrimSpace(offset) != "" {
+			v, err := strconv.Atoi(strings.TrimSpace(offset))
+			if err != nil {
+				return nil, fmt.Errorf("collection template %q: invalid date offset %q", entry, offset)
+			}
+			t.Offset = v
+		}
+		if err := t.compile(); err != nil {
+			return nil, fmt.Errorf("collection template %q: %w", entry, err)
+		}
+		if seen[t.Template] {
+			return nil, fmt.Errorf("collection template %q is listed twice", t.Template)
+		}
+		seen[t.Template] = true
+		templates = append(templates, t)
+	}
+	if len(templates) > 1 && seen["*"] {
+		return nil, fmt.Errorf("collection template \"*\" backs up every collection and cannot be combined with other templates")
+	}
+	return templates, nil
+}
+
+func mustParseCollectionTemplates(spec string) []CollectionTemplate {
+	templates, err := ParseCollectionTemplates(spec)
+	if err != nil {
+		panic(err)
+	}
+	return templates
+}
+
+// compile checks the placeholders and builds the pattern that maps a name back to its date
+func (t *CollectionTemplate) compile() error {
+	tmpl := t.Template
+	if t.All() {
+		tmpl = AllCollectionsPrefix + "{date}"
+	}
+	if strings.ContainsAny(tmpl, "/\\$\x00") || strings.HasPrefix(tmpl, "system.") {
+		return fmt.Errorf("not a valid collection name")
+	}
+	have := map[string]bool{}
+	for _, m := range placeholderPattern.FindAllStringSubmatch(tmpl, -1) {
+		have[m[1]] = true
+	}
+	if !have["date"] && !(have["YYYY"] && have["MM"] && have["DD"]) {
+		return fmt.Errorf("must contain {date} or all of {YYYY}, {MM} and {DD}")
+	}
+	if rest := placeholderPattern.ReplaceAllString(tmpl, ""); strings.ContainsAny(rest, "{}") {
+		return fmt.Errorf("unknown placeholder (expected {YYYY}, {MM}, {DD} or {date})")
+	}
+
+	var re strings.Builder
+	re.WriteString("^")
+	last := 0
+	for _, loc := range placeholderPattern.FindAllStringSubmatchIndex(tmpl, -1) {
+		re.WriteString(regexp.QuoteMeta(tmpl[last:loc[0]]))
+		switch tmpl[loc[2]:loc[3]] {
+		case "YYYY":
+			re.WriteString(`(?P<YYYY>\d{4})`)
+		case "MM":
+			re.WriteString(`(?P<MM>\d{2})`)
+		case "DD":
+			re.WriteString(`(?P<DD>\d{2})`)
+		case "date":
+			re.WriteString(`(?P<YYYY>\d{4})_(?P<MM>\d{2})_(?P<DD>\d{2})`)
+		}
+		last = loc[1]
+	}
+	re.WriteString(regexp.QuoteMeta(tmpl[last:]))
+	re.WriteString("$")
+	pattern, err := regexp.Compile(re.String())
+	if err != nil {
+		return err
+	}
+	t.pattern = pattern
+	return nil
+}
+
+// All reports whether the template backs up every collection of the database
+func (t CollectionTemplate) All() bool {
+	return t.Template == "*"
+}
+
+func (t CollectionTemplate) String() string {
+	if t.Offset != 0 {
+		return fmt.Sprintf("%s|%d", t.Template, t.Offset)
+	}
+	return t.Template
+}
+
+// Name returns the collection backed up for the backup date, or ALL_<date> for "*"
+func (t CollectionTemplate) Name(date time.Time) string {
+	d := date.AddDate(0, 0, t.Offset)
+	if t.All() {
+		return AllCollectionsPrefix + FormatDate(d)
+	}
+	return placeholderPattern.ReplaceAllStringFunc(t.Template, func(p string) string {
+		switch p {
+		case "{YYYY}":
+			return d.Format("2006")
+		case "{MM}":
+			return d.Format("01")
+		case "{DD}":
+			return d.Format("02")
+		default:
+			return FormatDate(d)
+		}
+	})
+}
+
+// Date returns the backup date of a collection name rendered from the template
+func (t CollectionTemplate) Date(name string) (time.Time, bool) {
+	m := t.pattern.FindStringSubmatch(name)
+	if m == nil {
+		return time.Time{}, false
+	}
+	parts := map[string]string{}
+	for i, group := range t.pattern.SubexpNames() {
+		if group != "" {
+			parts[group] = m[i]
+		}
+	}
+	d, err := time.ParseInLocation("2006_01_02", parts["YYYY"]+"_"+parts["MM"]+"_"+parts["DD"], time.Local)
+	if err != nil {
+		return time.Time{}, false
+	}
+	return d.AddDate(0, 0, -t.Offset), true
+}
+
+// CollectionNames returns the collections configured in COLLECTIONS for the backup date
+func CollectionNames(date time.Time) []string {
+	names := make([]string, len(CollectionTemplates))
+	for i, t := range CollectionTemplates {
+		names[i] = t.Name(date)
+	}
+	return names
+}
+
+// CollectionDate returns the backup date of a backed up collection name. Names from
+// templates no longer configured fall back to the YYYY_MM_DD found in the name.
+func CollectionDate(name string) (time.Time, bool) {
+	for _, t := range CollectionTemplates {
+		if d, ok := t.Date(name); ok {
+			return d, true
+		}
+	}
+	m := backupDatePattern.FindString(name)
+	if m == "" {
+		return time.Time{}, false
+	}
+	d, err := time.ParseInLocation("2006_01_02", m, time.Local)
+	return d, err == nil
+}
+
+// IsAllCollections reports whether a backup name stands for a whole-database backup
+func IsAllCollections(name string) bool {
+	return strings.HasPrefix(name, AllCollectionsPrefix)
+}
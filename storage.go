@@ -0,0 +1,353 @@
+package main
+
+import (
+	"context"
+	"errors"
+	"fmt"
+	"io"
+	"io/fs"
+	"os"
+	"path"
+	"path/filepath"
+	"sort"
+	"strings"
+	"time"
+
+	"github.com/minio/minio-go/v7"
+	"github.com/minio/minio-go/v7/pkg/credentials"
+)
+
+// ErrObjectNotFound is returned by Storage.Stat and Storage.Get for missing keys
+var ErrObjectNotFound = errors.New("object not found")
+
+// ObjectInfo describes one stored backup artifact
+type ObjectInfo struct {
+	Key     string
+	Size    int64
+	ModTime time.Time
+}
+
+// Storage is a destination for backup artifacts. Keys are slash separated paths
+// relative to the storage root, e.g. "<db>/GPS_<date>/<db>/GPS_<date>.bson.s2".
+type Storage interface {
+	// Put stores r under key; size may be -1 when unknown
+	Put(ctx context.Context, key string, r io.Reader, size int64) error
+	Get(ctx context.Context, key string) (io.ReadCloser, error)
+	// List returns every object whose key starts with prefix, sorted by key
+	List(ctx context.Context, prefix string) ([]ObjectInfo, error)
+	Delete(ctx context.Context, key string) error
+	Stat(ctx context.Context, key string) (ObjectInfo, error)
+	// URL returns the location of key recorded in backupHistory
+	URL(key string) string
+}
+
+// BackupStorage is the storage backend the backup pipeline writes through
+var BackupStorage Storage
+
+// InitStorage creates BackupStorage from STORAGE_BACKEND
+func InitStorage() error {
+	switch AppConfig.StorageBackend {
+	case "", "local":
+		BackupStorage = &LocalStorage{Root: AppConfig.BackupPath}
+	case "s3":
+		s, err := NewS3Storage(AppConfig.S3)
+		if err != nil {
+			return err
+		}
+		BackupStorage = s
+	default:
+		return fmt.Errorf("unknown STORAGE_BACKEND %q (expected local or s3)", AppConfig.StorageBackend)
+	}
+	Info.Printf("Storage backend ready: %s", BackupStorage.URL(""))
+	return nil
+}
+
+// routedStorage sends the keys of a database (the first key segment) to the destination of
+// its per-database override and every other key to the default backend
+type routedStorage struct {
+	def    Storage
+	routes []storageRoute
+}
+
+type storageRoute struct {
+	index   int // AppConfig.Databases entry
+	storage Storage
+}
+
+// For returns the backend that stores key
+func (r *routedStorage) For(key string) Storage {
+	dbName, _, _ := strings.Cut(key, "/")
+	if i := databaseOverride(dbName); i >= 0 {
+		for _, route := range r.routes {
+			if route.index == i {
+				return route.storage
+			}
+		}
+	}
+	return r.def
+}
+
+func (r *routedStorage) Put(ctx context.Context, key string, rd io.Reader, size int64) error {
+	return r.For(key).Put(ctx, key, rd, size)
+}
+
+func (r *routedStorage) Get(ctx context.Context, key string) (io.ReadCloser, error) {
+	return r.For(key).Get(ctx, key)
+}
+
+// List merges the listings of every backend, keeping each key from the backend it routes to
+func (r *routedStorage) List(ctx context.Context, prefix string) ([]ObjectInfo, error) {
+	backends := []Storage{r.def}
+	for _, route := range r.routes {
+		backends = append(backends, route.storage)
+	}
+	var objects []ObjectInfo
+	for _, b := range backends {
+		list, err := b.List(ctx, prefix)
+		if err != nil {
+			return nil, err
+		}
+		for _, obj := range list {
+			if r.For(obj.Key) == b {
+				objects = append(objects, obj)
+			}
+		}
+	}
+	sort.Slice(objects, func(i, j int) bool { return objects[i].Key < objects[j].Key })
+	return objects, nil
+}
+
+func (r *routedStorage) Delete(ctx context.Context, key string) error {
+	return r.For(key).Delete(ctx, key)
+}
+
+func (r *routedStorage) Stat(ctx context.Context, key string) (ObjectInfo, error) {
+	return r.For(key).Stat(ctx, key)
+}
+
+func (r *routedStorage) URL(key string) string {
+	return r.For(key).URL(key)
+}
+
+// StorageFor returns the backend BackupStorage stores key in
+func StorageFor(key string) Storage {
+	if r, ok := BackupStorage.(*routedStorage); ok {
+		return r.For(key)
+	}
+	return BackupStorage
+}
+
+// LocalStorage stores artifacts on the local filesystem under Root
+type LocalStorage struct {
+	Root string
+}
+
+func (l *LocalStorage) path(key string) string {
+	return filepath.Join(l.Root, filepath.FromSlash(key))
+}
+
+// Put writes to a temporary file and renames it, so readers never see a partial artifact
+func (l *LocalStorage) Put(ctx context.Context, key string, r io.Reader, size int64) error {
+	dst := l.path(key)
+	if err := os.MkdirAll(filepath.Dir(dst), 0755); err != nil {
+		return err
+	}
+	tmp, err := os.CreateTemp(filepath.Dir(dst), filepath.Base(dst)+".tmp-*")
+	if err != nil {
+		return err
+	}
+	if _, err := io.Copy(tmp, r); err != nil {
+		tmp.Close()
+		os.Remove(tmp.Name())
+		return fmt.Errorf("failed to write %s: %w", dst, err)
+	}
+	if err := tmp.Close(); err != nil {
+		os.Remove(tmp.Name())
+		return err
+	}
+	return os.Rename(tmp.Name(), dst)
+}
+
+func (l *LocalStorage) Get(ctx context.Context, key string) (io.ReadCloser, error) {
+	f, err := os.Open(l.path(key))
+	if errors.Is(err, fs.ErrNotExist) {
+		return nil, fmt.Errorf("%s: %w", key, ErrObjectNotFound)
+	}
+	return f, err
+}
+
+func (l *LocalStorage) List(ctx context.Context, prefix string) ([]ObjectInfo, error) {
+	// Walk the deepest directory fully covered by prefix, then filter on the full prefix
+	walkRoot := l.path(path.Dir(prefix))
+	if strings.HasSuffix(prefix, "/") {
+		walkRoot = l.path(prefix)
+	}
+
+	var objects []ObjectInfo
+	err := filepath.WalkDir(walkRoot, func(p string, d fs.DirEntry, err error) error {
+		if err != nil {
+			if errors.Is(err, fs.ErrNotExist) {
+				return nil
+			}
+			return err
+		}
+		if d.IsDir() || strings.Contains(d.Name(), ".tmp-") {
+			return nil
+		}
+		rel, err := filepath.Rel(l.Root, p)
+		if err != nil {
+			return err
+		}
+		key := filepath.ToSlash(rel)
+		if !strings.HasPrefix(key, prefix) {
+			return nil
+		}
+		info, err := d.Info()
+		if err != nil {
+			return err
+		}
+		objects = append(objects, ObjectInfo{Key: key, Size: info.Size(), ModTime: info.ModTime()})
+		return nil
+	})
+	sort.Slice(objects, func(i, j int) bool { return objects[i].Key < objects[j].Key })
+	return objects, err
+}
+
+// Delete removes the file and then every parent directory left empty, up to Root
+func (l *LocalStorage) Delete(ctx context.Context, key string) error {
+	p := l.path(key)
+	if err := os.Remove(p); err != nil && !errors.Is(err, fs.ErrNotExist) {
+		return err
+	}
+	root := filepath.Clean(l.Root)
+	for dir := filepath.Dir(p); dir != root && strings.HasPrefix(dir, root); dir = filepath.Dir(dir) {
+		if os.Remove(dir) != nil {
+			break
+		}
+	}
+	return nil
+}
+
+func (l *LocalStorage) Stat(ctx context.Context, key string) (ObjectInfo, error) {
+	info, err := os.Stat(l.path(key))
+	if errors.Is(err, fs.ErrNotExist) {
+		return ObjectInfo{}, fmt.Errorf("%s: %w", key, ErrObjectNotFound)
+	}
+	if err != nil {
+		return ObjectInfo{}, err
+	}
+	return ObjectInfo{Key: key, Size: info.Size(), ModTime: info.ModTime()}, nil
+}
+
+func (l *LocalStorage) URL(key string) string {
+	p := l.path(key)
+	if abs, err := filepath.Abs(p); err == nil {
+		p = abs
+	}
+	return "file://" + filepath.ToSlash(p)
+}
+
+// S3Config holds the settings of an S3-compatible object store (AWS S3, MinIO, ...)
+type S3Config struct {
+	Endpoint  string
+	Bucket    string
+	Prefix    string
+	AccessKey string
+	SecretKey string
+	Region    string
+	UseSSL    bool
+	PartSize  uint64 // multipart upload part size in bytes
+}
+
+// S3Storage stores artifacts in an S3-compatible bucket
+type S3Storage struct {
+	client   *minio.Client
+	bucket   string
+	prefix   string
+	partSize uint64
+}
+
+// NewS3Storage connects to the bucket and checks that it exists
+func NewS3Storage(cfg S3Config) (*S3Storage, error) {
+	if cfg.Endpoint == "" || cfg.Bucket == "" {
+		return nil, fmt.Errorf("S3_ENDPOINT and S3_BUCKET are required for the s3 storage backend")
+	}
+	client, err := minio.New(cfg.Endpoint, &minio.Options{
+		Creds:  credentials.NewStaticV4(cfg.AccessKey, cfg.SecretKey, ""),
+		Secure: cfg.UseSSL,
+		Region: cfg.Region,
+	})
+	if err != nil {
+		return nil, fmt.Errorf("failed to create S3 client: %w", err)
+	}
+
+	ctx, cancel := context.WithTimeout(context.Background(), 10*time.Second)
+	defer cancel()
+	exists, err := client.BucketExists(ctx, cfg.Bucket)
+	if err != nil {
+		return nil, fmt.Errorf("failed to check bucket %s: %w", cfg.Bucket, err)
+	}
+	if !exists {
+		return nil, fmt.Errorf("bucket %s does not exist", cfg.Bucket)
+	}
+
+	prefix := strings.Trim(cfg.Prefix, "/")
+	if prefix != "" {
+		prefix += "/"
+	}
+	return &S3Storage{client: client, bucket: cfg.Bucket, prefix: prefix, partSize: cfg.PartSize}, nil
+}
+
+// Put uploads r; artifacts larger than one part (or of unknown size) use multipart uploads
+func (s *S3Storage) Put(ctx context.Context, key string, r io.Reader, size int64) error {
+	_, err := s.client.PutObject(ctx, s.bucket, s.prefix+key, r, size, minio.PutObjectOptions{
+		ContentType: "application/octet-stream",
+		PartSize:    s.partSize,
+	})
+	if err != nil {
+		return fmt.Errorf("failed to upload %s: %w", s.URL(key), err)
+	}
+	return nil
+}
+
+func (s *S3Storage) Get(ctx context.Context, key string) (io.ReadCloser, error) {
+	// Stat first so a missing key fails here instead of on the first Read
+	if _, err := s.Stat(ctx, key); err != nil {
+		return nil, err
+	}
+	return s.client.GetObject(ctx, s.bucket, s.prefix+key, minio.GetObjectOptions{})
+}
+
+func (s *S3Storage) List(ctx context.Context, prefix string) ([]ObjectInfo, error) {
+	var objects []ObjectInfo
+	for obj := range s.client.ListObjects(ctx, s.bucket, minio.ListObjectsOptions{Prefix: s.prefix + prefix, Recursive: true}) {
+		if obj.Err != nil {
+			return nil, fmt.Errorf("failed to list %s: %w", s.URL(prefix), obj.Err)
+		}
+		objects = append(objects, ObjectInfo{
+			Key:     strings.TrimPrefix(obj.Key, s.prefix),
+			Size:    obj.Size,
+			ModTime: obj.LastModified,
+		})
+	}
+	return objects, nil
+}
+
+func (s *S3Storage) Delete(ctx context.Context, key string) error {
+	return s.client.RemoveObject(ctx, s.bucket, s.prefix+key, minio.RemoveObjectOptions{})
+}
+
+func (s *S3Storage) Stat(ctx context.Context, key string) (ObjectInfo, error) {
+	info, err := s.client.StatObject(ctx, s.bucket, s.prefix+key, minio.StatObjectOptions{})
+	if err != nil {
+		if minio.ToErrorResponse(err).Code == "NoSuchKey" {
+			return ObjectInfo{}, fmt.Errorf("%s: %w", key, ErrObjectNotFound)
+		}
+		return ObjectInfo{}, err
+	}
+	return ObjectInfo{Key: key, Size: info.Size, ModTime: info.LastModified}, nil
+}
+
+func (s *S3Storage) URL(key string) string {
+	return fmt.Sprintf("s3://%s/%s%s", s.bucket, s.prefix, key)
+}
@@ -0,0 +1,219 @@
+package main
+
+import (
+	"bytes"
+	"context"
+	"errors"
+	"fmt"
+	"io"
+	"os"
+	"path/filepath"
+	"testing"
+	"time"
+
+	"github.com/minio/minio-go/v7"
+	"github.com/minio/minio-go/v7/pkg/credentials"
+)
+
+func TestLocalStorage(t *testing.T) {
+	root := t.TempDir()
+	testStorage(t, &LocalStorage{Root: root})
+
+	// Delete leaves no empty directories behind
+	entries, err := os.ReadDir(root)
+	if err != nil {
+		t.Fatal(err)
+	}
+	if len(entries) != 0 {
+		t.Errorf("storage root not empty after deleting every object: %v", entries)
+	}
+}
+
+func TestLocalStorageHidesPartialUploads(t *testing.T) {
+	root := t.TempDir()
+	s := &LocalStorage{Root: root}
+	ctx := context.Background()
+
+	failing := io.MultiReader(bytes.NewReader([]byte("partial")), errReader{errors.New("disk gone")})
+	if err := s.Put(ctx, "db/c/a.bson", failing, -1); err == nil {
+		t.Fatal("Put: expected the read error")
+	}
+	if _, err := s.Stat(ctx, "db/c/a.bson"); !errors.Is(err, ErrObjectNotFound) {
+		t.Errorf("Stat after a failed Put: got %v, want ErrObjectNotFound", err)
+	}
+	if err := os.WriteFile(filepath.Join(root, "db", "c", "b.bson.tmp-1"), []byte("x"), 0644); err != nil {
+		t.Fatal(err)
+	}
+	list, err := s.List(ctx, "db/")
+	if err != nil {
+		t.Fatal(err)
+	}
+	if len(list) != 0 {
+		t.Errorf("List shows temporary files: %v", list)
+	}
+}
+
+// TestS3Storage runs against an S3-compatible server such as MinIO, e.g.
+//
+//	docker run -p 9000:9000 minio/minio server /data
+//	TEST_S3_ENDPOINT=localhost:9000 go test -run S3 .
+func TestS3Storage(t *testing.T) {
+	endpoint := os.Getenv("TEST_S3_ENDPOINT")
+	if endpoint == "" {
+		t.Skip("TEST_S3_ENDPOINT not set")
+	}
+	cfg := S3Config{
+		Endpoint:  endpoint,
+		Bucket:    envOr("TEST_S3_BUCKET", "mongo-backup-test"),
+		Prefix:    fmt.Sprintf("test-%d", time.Now().UnixNano()),
+		AccessKey: envOr("TEST_S3_ACCESS_KEY", "minioadmin"),
+		SecretKey: envOr("TEST_S3_SECRET_KEY", "minioadmin"),
+		UseSSL:    os.Getenv("TEST_S3_USE_SSL") == "true",
+		PartSize:  5 << 20,
+	}
+	client, err := minio.New(cfg.Endpoint, &minio.Options{
+		Creds:  credentials.NewStaticV4(cfg.AccessKey, cfg.SecretKey, ""),
+		Secure: cfg.UseSSL,
+	})
+	if err != nil {
+		t.Fatal(err)
+	}
+	ctx := context.Background()
+	if exists, err := client.BucketExists(ctx, cfg.Bucket); err != nil {
+		t.Fatal(err)
+	} else if !exists {
+		if err := client.MakeBucket(ctx, cfg.Bucket, minio.MakeBucketOptions{}); err != nil {
+			t.Fatal(err)
+		}
+	}
+
+	if _, err := NewS3Storage(S3Config{Endpoint: cfg.Endpoint, Bucket: cfg.Bucket + "-missing",
+		AccessKey: cfg.AccessKey, SecretKey: cfg.SecretKey, UseSSL: cfg.UseSSL}); err == nil {
+		t.Error("NewS3Storage: expected an error for a missing bucket")
+	}
+
+	s, err := NewS3Storage(cfg)
+	if err != nil {
+		t.Fatal(err)
+	}
+	testStorage(t, s)
+
+	// Unknown sizes and artifacts over one part go through a multipart upload
+	big := bytes.Repeat([]byte("0123456789abcdef"), (6<<20)/16)
+	if err := s.Put(ctx, "db/big.bson", bytes.NewReader(big), -1); err != nil {
+		t.Fatal(err)
+	}
+	defer s.Delete(ctx, "db/big.bson")
+	if got := readKey(t, s, "db/big.bson"); !bytes.Equal(got, big) {
+		t.Errorf("multipart object differs: %d bytes, want %d", len(got), len(big))
+	}
+}
+
+// testStorage checks the Storage contract the backup pipeline relies on
+func testStorage(t *testing.T, s Storage) {
+	t.Helper()
+	ctx := context.Background()
+	objects := map[string]string{
+		"db1/GPS_2025_01_31/db1/GPS_2025_01_31.bson.s2": "bson",
+		"db1/GPS_2025_01_31/manifest.json":              "{}",
+		"db1/GPS_2025_02_01/manifest.json":              "{}",
+		"db10/GPS_2025_01_31/manifest.json":             "{}",
+	}
+	for key, data := range objects {
+		if err := s.Put(ctx, key, bytes.NewReader([]byte(data)), int64(len(data))); err != nil {
+			t.Fatalf("Put %s: %v", key, err)
+		}
+	}
+
+	for key, data := range objects {
+		if got := readKey(t, s, key); string(got) != data {
+			t.Errorf("Get %s = %q, want %q", key, got, data)
+		}
+		info, err := s.Stat(ctx, key)
+		if err != nil {
+			t.Fatalf("Stat %s: %v", key, err)
+		}
+		if info.Key != key || info.Size != int64(len(data)) {
+			t.Errorf("Stat %s = %+v", key, info)
+		}
+	}
+
+	for _, tt := range []struct {
+		prefix string
+		want   []string
+	}{
+		{"db1/", []string{
+			"db1/GPS_2025_01_31/db1/GPS_2025_01_31.bson.s2",
+			"db1/GPS_2025_01_31/manifest.json",
+			"db1/GPS_2025_02_01/manifest.json",
+		}},
+		{"db1/GPS_2025_01", []string{
+			"db1/GPS_2025_01_31/db1/GPS_2025_01_31.bson.s2",
+			"db1/GPS_2025_01_31/manifest.json",
+		}},
+		{"db1", []string{
+			"db1/GPS_2025_01_31/db1/GPS_2025_01_31.bson.s2",
+			"db1/GPS_2025_01_31/manifest.json",
+			"db1/GPS_2025_02_01/manifest.json",
+			"db10/GPS_2025_01_31/manifest.json",
+		}},
+		{"db2/", nil},
+	} {
+		list, err := s.List(ctx, tt.prefix)
+		if err != nil {
+			t.Fatalf("List %q: %v", tt.prefix, err)
+		}
+		var keys []string
+		for _, obj := range list {
+			keys = append(keys, obj.Key)
+		}
+		if fmt.Sprint(keys) != fmt.Sprint(tt.want) {
+			t.Errorf("List %q = %v, want %v", tt.prefix, keys, tt.want)
+		}
+	}
+
+	missing := "db1/GPS_2025_01_30/manifest.json"
+	if _, err := s.Stat(ctx, missing); !errors.Is(err, ErrObjectNotFound) {
+		t.Errorf("Stat of a missing key: got %v, want ErrObjectNotFound", err)
+	}
+	if _, err := s.Get(ctx, missing); !errors.Is(err, ErrObjectNotFound) {
+		t.Errorf("Get of a missing key: got %v, want ErrObjectNotFound", err)
+	}
+
+	for key := range objects {
+		if err := s.Delete(ctx, key); err != nil {
+			t.Fatalf("Delete %s: %v", key, err)
+		}
+		if _, err := s.Stat(ctx, key); !errors.Is(err, ErrObjectNotFound) {
+			t.Errorf("Stat after Delete %s: got %v, want ErrObjectNotFound", key, err)
+		}
+	}
+	if err := s.Delete(ctx, missing); err != nil {
+		t.Errorf("Delete of a missing key: %v", err)
+	}
+}
+
+func readKey(t *testing.T, s Storage, key string) []byte {
+	t.Helper()
+	r, err := s.Get(context.Background(), key)
+	if err != nil {
+		t.Fatalf("Get %s: %v", key, err)
+	}
+	defer r.Close()
+	data, err := io.ReadAll(r)
+	if err != nil {
+		t.Fatalf("Get %s: %v", key, err)
+	}
+	return data
+}
+
+func envOr(key, def string) string {
+	if v := os.Getenv(key); v != "" {
+		return v
+	}
+	return def
+}
+
+type errReader struct{ err error }
+
+func (r errReader) Read([]byte) (int, error) { return 0, r.err }
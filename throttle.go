@@ -0,0 +1,193 @@
+package main
+
+import (
+	"context"
+	"fmt"
+	"strings"
+	"sync"
+	"time"
+)
+
+// ThrottleConfig holds the load thresholds of the source cluster; a zero threshold is not checked
+type ThrottleConfig struct {
+	Interval       time.Duration // THROTTLE_INTERVAL: load sampling period, 0 disables the throttle
+	MaxReplLag     time.Duration // THROTTLE_MAX_REPL_LAG
+	MaxQueuedReads int           // THROTTLE_MAX_QUEUED_READS
+	MaxConnections int           // THROTTLE_MAX_CONNECTIONS
+}
+
+// Throttle limits the dumps running at once by the load of the source cluster. Above a
+// threshold the limit is halved, above twice a threshold dumps are paused; below all
+// thresholds it grows back by one per sample. Running dumps are never stopped.
+type Throttle struct {
+	mu      sync.Mutex
+	max     int
+	limit   int
+	running int
+	changed chan struct{} // closed and replaced whenever limit or running changes
+	reason  string        // thresholds crossed twice over while dumps are paused
+}
+
+// StartThrottle samples the cluster load every THROTTLE_INTERVAL until ctx is done and
+// returns the throttle of a worker pool of the given size, nil when throttling is disabled.
+// The first sample is taken before it returns, so a loaded cluster is not hit at full speed.
+func StartThrottle(ctx context.Context, workers int) *Throttle {
+	cfg := AppConfig.Throttle
+	if cfg.Interval <= 0 || mongoClient == nil {
+		return nil
+	}
+	t := &Throttle{max: workers, limit: workers, changed: make(chan struct{})}
+	metricThrottleLimit.Set(float64(workers))
+	t.adjust(ctx)
+	go func() {
+		defer metricThrottleLimit.Set(0)
+		ticker := time.NewTicker(cfg.Interval)
+		defer ticker.Stop()
+		for {
+			select {
+			case <-ctx.Done():
+				return
+			case <-ticker.C:
+				t.adjust(ctx)
+			}
+		}
+	}()
+	return t
+}
+
+// acquire waits until a dump may start. It fails when ctx is done, or with ErrTimeout once
+// dumps have been paused for maxPause, so a cluster that stays overloaded fails the job
+// instead of stalling the run; maxPause <= 0 waits without a deadline.
+func (t *Throttle) acquire(ctx context.Context, maxPause time.Duration) error {
+	if t == nil {
+		return nil
+	}
+	var pausedSince time.Time
+	for {
+		t.mu.Lock()
+		if t.running < t.limit {
+			t.running++
+			t.mu.Unlock()
+			return nil
+		}
+		changed, paused, reason := t.changed, t.limit == 0, t.reason
+		t.mu.Unlock()
+
+		var deadline <-chan time.Time
+		if paused && maxPause > 0 {
+			if pausedSince.IsZero() {
+				pausedSince = time.Now()
+			}
+			left := maxPause - time.Since(pausedSince)
+			if left <= 0 {
+				return fmt.Errorf("%w: dumps paused by the load throttle for %s (%s)", ErrTimeout, maxPause, reason)
+			}
+			deadline = time.After(left)
+		} else if !paused {
+			pausedSince = time.Time{}
+		}
+		select {
+		case <-changed:
+		case <-deadline:
+		case <-ctx.Done():
+			return context.Cause(ctx)
+		}
+	}
+}
+
+// release ends a dump started with acquire
+func (t *Throttle) release() {
+	if t == nil {
+		return
+	}
+	t.mu.Lock()
+	t.running--
+	t.notify()
+	t.mu.Unlock()
+}
+
+// notify wakes the waiting workers; t.mu must be held
+func (t *Throttle) notify() {
+	close(t.changed)
+	t.changed = make(chan struct{})
+}
+
+// adjust samples the cluster load and applies it; a failed sample keeps the current limit
+func (t *Throttle) adjust(ctx context.Context) {
+	load, err := SampleClusterLoad(ctx)
+	if ctx.Err() != nil {
+		return
+	}
+	if err != nil {
+		t.mu.Lock()
+		Warn.Printf("Throttle: load sample failed, keeping %d/%d workers: %v", t.limit, t.max, err)
+		t.mu.Unlock()
+		return
+	}
+	t.apply(load)
+}
+
+// apply sets the limit for a load sample, logging every change and every sample that
+// keeps the pool below its size
+func (t *Throttle) apply(load ClusterLoad) {
+	t.mu.Lock()
+	defer t.mu.Unlock()
+	old := t.limit
+	over, severe := checkLoad(load, AppConfig.Throttle)
+	limit := old
+	switch {
+	case len(severe) > 0:
+		limit = 0
+	case len(over) > 0:
+		limit = old / 2
+		if old <= 1 {
+			limit = old
+		}
+	default:
+		limit = min(old+1, t.max)
+	}
+
+	switch {
+	case limit == 0 && old > 0:
+		Warn.Printf("Throttle: pausing dumps (%s): %s", strings.Join(severe, ", "), load)
+	case limit < old:
+		Warn.Printf("Throttle: shrinking workers %d -> %d (%s): %s", old, limit, strings.Join(over, ", "), load)
+	case limit > old && old == 0:
+		Info.Printf("Throttle: resuming dumps with %d/%d workers: %s", limit, t.max, load)
+	case limit > old:
+		Info.Printf("Throttle: growing workers %d -> %d: %s", old, limit, load)
+	case limit == 0:
+		Warn.Printf("Throttle: dumps still paused (%s): %s", strings.Join(severe, ", "), load)
+	case limit < t.max:
+		Warn.Printf("Throttle: holding at %d/%d workers (%s): %s", limit, t.max, strings.Join(append(severe, over...), ", "), load)
+	}
+	if limit == 0 {
+		t.reason = strings.Join(severe, ", ")
+	}
+	if limit != old {
+		t.limit = limit
+		metricThrottleLimit.Set(float64(limit))
+		t.notify()
+	}
+}
+
+// checkLoad returns the thresholds load crosses, and those it crosses twice over
+func checkLoad(load ClusterLoad, cfg ThrottleConfig) (over, severe []string) {
+	check := func(name string, value, threshold int64, format func(int64) string) {
+		if threshold <= 0 || value < threshold {
+			return
+		}
+		reason := fmt.Sprintf("%s %s >= %s", name, format(value), format(threshold))
+		if value >= 2*threshold {
+			severe = append(severe, reason)
+		} else {
+			over = append(over, reason)
+		}
+	}
+	duration := func(v int64) string { return time.Duration(v).String() }
+	count := func(v int64) string { return fmt.Sprint(v) }
+	check("replication lag", int64(load.ReplLag), int64(cfg.MaxReplLag), duration)
+	check("queued reads", load.QueuedReads, int64(cfg.MaxQueuedReads), count)
+	check("connections", load.Connections, int64(cfg.MaxConnections), count)
+	return over, severe
+}
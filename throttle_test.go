@@ -0,0 +1,120 @@
+package main
+
+import (
+	"context"
+	"errors"
+	"testing"
+	"time"
+)
+
+func TestMaxReplicationLag(t *testing.T) {
+	now := time.Date(2025, 2, 1, 2, 0, 0, 0, time.UTC)
+	members := []ReplSetMember{
+		{Name: "a:27017", StateStr: "PRIMARY", OptimeDate: now},
+		{Name: "b:27017", StateStr: "SECONDARY", OptimeDate: now.Add(-5 * time.Second)},
+		{Name: "c:27017", StateStr: "SECONDARY", OptimeDate: now.Add(-time.Hour)},
+		{Name: "d:27017", StateStr: "SECONDARY", OptimeDate: now.Add(-10 * time.Minute)},
+		{Name: "e:27017", StateStr: "SECONDARY", OptimeDate: now.Add(-2 * time.Hour)},
+		{Name: "f:27017", StateStr: "ARBITER"},
+	}
+	configs := map[string]ReplSetConfigMember{
+		"c:27017": {Host: "c:27017", Hidden: true, SecondaryDelaySecs: 3600},
+		"d:27017": {Host: "d:27017", Hidden: true},
+		"e:27017": {Host: "e:27017", SlaveDelay: 7200},
+	}
+	if got := maxReplicationLag(members, configs); got != 5*time.Second {
+		t.Errorf("lag with hidden and delayed members = %s, want 5s", got)
+	}
+	if got := maxReplicationLag(members, nil); got != 2*time.Hour {
+		t.Errorf("lag without their configuration = %s, want 2h", got)
+	}
+}
+
+func TestCheckLoad(t *testing.T) {
+	cfg := ThrottleConfig{MaxReplLag: time.Minute, MaxQueuedReads: 100}
+	tests := []struct {
+		load         ClusterLoad
+		over, severe int
+	}{
+		{ClusterLoad{ReplLag: 59 * time.Second, QueuedReads: 99, Connections: 1e6}, 0, 0},
+		{ClusterLoad{ReplLag: time.Minute, QueuedReads: 10}, 1, 0},
+		{ClusterLoad{ReplLag: 2 * time.Minute, QueuedReads: 150}, 1, 1},
+	}
+	for _, tt := range tests {
+		over, severe := checkLoad(tt.load, cfg)
+		if len(over) != tt.over || len(severe) != tt.severe {
+			t.Errorf("checkLoad(%s) = %q, %q, want %d over and %d severe", tt.load, over, severe, tt.over, tt.severe)
+		}
+	}
+}
+
+func TestThrottleApply(t *testing.T) {
+	defer func(cfg ThrottleConfig) { AppConfig.Throttle = cfg }(AppConfig.Throttle)
+	AppConfig.Throttle = ThrottleConfig{MaxReplLag: time.Minute}
+
+	th := &Throttle{max: 8, limit: 8, changed: make(chan struct{})}
+	for _, step := range []struct {
+		lag   time.Duration
+		limit int
+	}{
+		{time.Minute, 4},
+		{90 * time.Second, 2},
+		{2 * time.Minute, 0},
+		{time.Hour, 0},
+		{0, 1},
+		{0, 2},
+		{time.Minute, 1},
+		{time.Minute, 1},
+	} {
+		th.apply(ClusterLoad{ReplLag: step.lag})
+		if th.limit != step.limit {
+			t.Fatalf("after a lag of %s: limit %d, want %d", step.lag, th.limit, step.limit)
+		}
+	}
+}
+
+func TestThrottleAcquire(t *testing.T) {
+	defer func(cfg ThrottleConfig) { AppConfig.Throttle = cfg }(AppConfig.Throttle)
+	AppConfig.Throttle = ThrottleConfig{MaxReplLag: time.Minute}
+	ctx := context.Background()
+
+	th := &Throttle{max: 1, limit: 1, changed: make(chan struct{})}
+	if err := th.acquire(ctx, time.Second); err != nil {
+		t.Fatal(err)
+	}
+	// A full pool is not a pause: the wait ends when the running dump does
+	go func() {
+		time.Sleep(100 * time.Millisecond)
+		th.release()
+	}()
+	if err := th.acquire(ctx, time.Millisecond); err != nil {
+		t.Fatalf("waiting for a running dump: %v", err)
+	}
+	th.release()
+
+	th.apply(ClusterLoad{ReplLag: time.Hour})
+	start := time.Now()
+	err := th.acquire(ctx, 200*time.Millisecond)
+	if !errors.Is(err, ErrTimeout) {
+		t.Fatalf("paused throttle: got %v, want ErrTimeout", err)
+	}
+	if waited := time.Since(start); waited < 200*time.Millisecond {
+		t.Errorf("gave up after %s, want 200ms", waited)
+	}
+
+	// Dumps resumed within the pause limit start
+	go func() {
+		time.Sleep(100 * time.Millisecond)
+		th.apply(ClusterLoad{})
+	}()
+	if err := th.acquire(ctx, 5*time.Second); err != nil {
+		t.Fatalf("resumed throttle: %v", err)
+	}
+
+	cancelled, cancel := context.WithCancelCause(ctx)
+	cancel(ErrInterrupted)
+	th.apply(ClusterLoad{ReplLag: time.Hour})
+	if err := th.acquire(cancelled, 0); !errors.Is(err, ErrInterrupted) {
+		t.Errorf("cancelled context: got %v, want ErrInterrupted", err)
+	}
+}
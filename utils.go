@@ -2,15 +2,20 @@ package main
 
 import (
 	"context"
+	"crypto/sha256"
+	"encoding/hex"
 	"encoding/json"
+	"errors"
 	"fmt"
 	"io"
 	"os"
 	"os/exec"
+	"path"
 	"path/filepath"
+	"strings"
 	"time"
 
-	"github.com/klauspost/compress/s2"
+	"go.mongodb.org/mongo-driver/bson/primitive"
 )
 
 // FormatDate returns YYYY_MM_DD
@@ -18,9 +23,25 @@ func FormatDate(t time.Time) string {
 	return t.Format("2006_01_02")
 }
 
+// ParseDate parses a YYYY-MM-DD or YYYY_MM_DD date in local time
+func ParseDate(s string) (time.Time, error) {
+	for _, layout := range []string{"2006-01-02", "2006_01_02"} {
+		if t, err := time.ParseInLocation(layout, s, time.Local); err == nil {
+			return t, nil
+		}
+	}
+	return time.Time{}, fmt.Errorf("invalid date %q (expected YYYY-MM-DD)", s)
+}
+
+// DayEnd returns the midnight that ends the day of t, in t's location
+func DayEnd(t time.Time) time.Time {
+	y, m, d := t.Date()
+	return time.Date(y, m, d+1, 0, 0, 0, 0, t.Location())
+}
+
 // BackupDir returns backup folder path, creates it if missing
-func BackupDir(dbName string, date time.Time) (string, error) {
-	dir := filepath.Join(AppConfig.BackupPath, dbName, fmt.Sprintf("GPS_%s", FormatDate(date)))
+func BackupDir(dbName, collection string) (string, error) {
+	dir := filepath.Join(AppConfig.BackupPath, dbName, collection)
 	if err := os.MkdirAll(dir, 0755); err != nil {
 		Error.Printf("Failed to create backup directory: %v", err)
 		return "", err
@@ -29,45 +50,187 @@ func BackupDir(dbName string, date time.Time) (string, error) {
 	return dir, nil
 }
 
-// CompressFilesS2 compress multiple files to .s2 format
-func CompressFilesS2(files map[string]string) error {
-	for src, dst := range files {
-		in, err := os.Open(src)
-		if err != nil {
-			return fmt.Errorf("failed to open %s: %w", src, err)
-		}
-		out, err := os.Create(dst)
+// ArtifactKey returns the storage key of the compressed artifact for a raw file under BACKUP_PATH.
+// Keys mirror the local layout plus the codec extension, e.g. <db>/GPS_<date>/<db>/GPS_<date>.bson.s2
+func ArtifactKey(rawPath string, codec Codec) string {
+	rel, err := filepath.Rel(AppConfig.BackupPath, rawPath)
+	if err != nil {
+		rel = filepath.Base(rawPath)
+	}
+	return filepath.ToSlash(rel) + codec.Ext()
+}
+
+// LocalPath returns the path under BACKUP_PATH that corresponds to a storage key
+func LocalPath(key string) string {
+	return filepath.Join(AppConfig.BackupPath, filepath.FromSlash(key))
+}
+
+// isStoredArtifact reports whether file is the one local storage keeps key in, as it is for
+// an uncompressed, unencrypted artifact stored under BACKUP_PATH. Such a file is the backup
+// itself and must never be written to or removed as a raw or staging file.
+func isStoredArtifact(file, key string) bool {
+	l, local := StorageFor(key).(*LocalStorage)
+	return local && l.path(key) == filepath.Clean(file)
+}
+
+// CompressFile compresses a local file with codec, encrypts it with dk unless nil, and stores
+// it in BackupStorage under key. The SHA-256 and size of the stored bytes are computed on the fly.
+func CompressFile(ctx context.Context, codec Codec, dk *DataKey, src, key string) (ArtifactInfo, error) {
+	info := ArtifactInfo{Key: key, URL: BackupStorage.URL(key)}
+
+	in, err := os.Open(src)
+	if err != nil {
+		return info, fmt.Errorf("failed to open %s: %w", src, err)
+	}
+	defer in.Close()
+
+	rawCount := &countingWriter{}
+	hasher := sha256.New()
+	compressedCount := &countingWriter{}
+
+	pr, pw := io.Pipe()
+	// Backends that ignore ctx still stop when the pipe is closed
+	stop := context.AfterFunc(ctx, func() { pr.CloseWithError(context.Cause(ctx)) })
+	defer stop()
+	done := make(chan error, 1)
+	go func() {
+		writer, err := newArtifactWriter(io.MultiWriter(pw, hasher, compressedCount), codec, dk)
 		if err != nil {
-			in.Close()
-			return fmt.Errorf("failed to create %s: %w", dst, err)
+			pw.CloseWithError(err)
+			done <- err
+			return
 		}
-
-		writer := s2.NewWriter(out)
 		buf := make([]byte, 1<<20)
-		if _, err := io.CopyBuffer(writer, in, buf); err != nil {
-			writer.Close()
-			in.Close()
-			out.Close()
-			return fmt.Errorf("failed to compress %s: %w", src, err)
+		_, err = io.CopyBuffer(writer, io.TeeReader(in, rawCount), buf)
+		if cerr := writer.Close(); err == nil {
+			err = cerr
 		}
+		pw.CloseWithError(err)
+		done <- err
+	}()
 
-		writer.Close()
-		in.Close()
-		out.Close()
-		Info.Printf("Compressed %s -> %s", src, dst)
+	putErr := BackupStorage.Put(ctx, key, pr, -1)
+	// Unblock the compressor if Put gave up before reading everything
+	pr.CloseWithError(putErr)
+	compressErr := <-done
+
+	if putErr != nil {
+		return info, fmt.Errorf("failed to store %s: %w", key, putErr)
 	}
-	return nil
+	if compressErr != nil {
+		return info, fmt.Errorf("failed to compress %s: %w", src, compressErr)
+	}
+
+	info.SHA256 = hex.EncodeToString(hasher.Sum(nil))
+	info.RawSize = rawCount.n
+	info.CompressedSize = compressedCount.n
+	Info.Printf("Compressed %s -> %s (sha256=%s)", src, info.URL, info.SHA256)
+	return info, nil
 }
 
-// DecompressFileS2 decompress a .s2 file
-func DecompressFileS2(srcPath, dstPath string) error {
-	in, err := os.Open(srcPath)
+// StreamArchive runs cmd and streams its stdout through archive validation, SHA-256, codec
+// compression and encryption with dk (unless nil) into BackupStorage under key, in a single
+// pass. The artifact is only committed when the dump exits cleanly and the archive validates.
+func StreamArchive(ctx context.Context, codec Codec, dk *DataKey, cmd *exec.Cmd, key string) (ArtifactInfo, BsonStats, error) {
+	info := ArtifactInfo{Key: key, URL: BackupStorage.URL(key)}
+	var stats BsonStats
+
+	stdout, err := cmd.StdoutPipe()
 	if err != nil {
-		Error.Printf("Failed to open %s: %v", srcPath, err)
+		return info, stats, err
+	}
+
+	// Validator reads its own copy of the stream; a corrupt archive closes the pipe and stops the copy
+	valR, valW := io.Pipe()
+	valDone := make(chan error, 1)
+	go func() {
+		var err error
+		stats, err = ValidateArchiveStream(valR)
+		valR.CloseWithError(err)
+		valDone <- err
+	}()
+
+	// Upload runs concurrently and aborts when the pipe is closed with an error
+	storeR, storeW := io.Pipe()
+	putDone := make(chan error, 1)
+	go func() {
+		err := BackupStorage.Put(ctx, key, storeR, -1)
+		storeR.CloseWithError(err)
+		putDone <- err
+	}()
+
+	abort := func(err error) (ArtifactInfo, BsonStats, error) {
+		storeW.CloseWithError(err)
+		<-putDone
+		return info, stats, err
+	}
+
+	hasher := sha256.New()
+	rawCount := &countingWriter{}
+	compressedCount := &countingWriter{}
+	writer, err := newArtifactWriter(io.MultiWriter(storeW, hasher, compressedCount), codec, dk)
+	if err == nil {
+		err = cmd.Start()
+	}
+	if err != nil {
+		valW.Close()
+		<-valDone
+		return abort(fmt.Errorf("failed to start mongodump: %w", err))
+	}
+
+	buf := make([]byte, 1<<20)
+	_, copyErr := io.CopyBuffer(io.MultiWriter(writer, valW, rawCount), stdout, buf)
+	if copyErr != nil {
+		// mongodump would block on a full pipe otherwise
+		cmd.Process.Kill()
+	}
+	valW.CloseWithError(copyErr)
+	valErr := <-valDone
+	waitErr := cmd.Wait()
+
+	// A validator that rejects the archive closes its pipe with the corruption error, which
+	// the copy then returns. Any other copy error is a storage failure; the validator only
+	// reports it second hand as a truncated archive.
+	var corruptErr *BsonCorruptionError
+	switch {
+	case errors.As(copyErr, &corruptErr):
+		return abort(copyErr)
+	case copyErr != nil:
+		return abort(fmt.Errorf("failed to store %s: %w", key, copyErr))
+	case waitErr != nil:
+		return abort(waitErr)
+	case valErr != nil:
+		return abort(valErr)
+	}
+
+	if err := writer.Close(); err != nil {
+		return abort(fmt.Errorf("failed to compress archive: %w", err))
+	}
+	storeW.Close()
+	if err := <-putDone; err != nil {
+		return info, stats, fmt.Errorf("failed to store %s: %w", key, err)
+	}
+
+	info.SHA256 = hex.EncodeToString(hasher.Sum(nil))
+	info.RawSize = rawCount.n
+	info.CompressedSize = compressedCount.n
+	Info.Printf("Streamed archive -> %s (sha256=%s)", info.URL, info.SHA256)
+	return info, stats, nil
+}
+
+// DecompressFile decrypts (with dk, unless nil) and decompresses an artifact from BackupStorage to a local file
+func DecompressFile(ctx context.Context, codec Codec, dk *DataKey, srcKey, dstPath string) error {
+	in, err := BackupStorage.Get(ctx, srcKey)
+	if err != nil {
+		Error.Printf("Failed to open %s: %v", srcKey, err)
 		return err
 	}
 	defer in.Close()
 
+	if err := os.MkdirAll(filepath.Dir(dstPath), 0755); err != nil {
+		Error.Printf("Failed to create %s: %v", filepath.Dir(dstPath), err)
+		return err
+	}
 	out, err := os.Create(dstPath)
 	if err != nil {
 		Error.Printf("Failed to create %s: %v", dstPath, err)
@@ -75,27 +238,37 @@ func DecompressFileS2(srcPath, dstPath string) error {
 	}
 	defer out.Close()
 
-	reader := s2.NewReader(in)
+	reader, err := newArtifactReader(in, codec, dk)
+	if err != nil {
+		Error.Printf("Failed to open %s decoder for %s: %v", codec.Name(), srcKey, err)
+		return err
+	}
+	defer reader.Close()
 	if _, err := io.Copy(out, reader); err != nil {
-		Error.Printf("Failed to decompress %s -> %s: %v", srcPath, dstPath, err)
+		Error.Printf("Failed to decompress %s -> %s: %v", srcKey, dstPath, err)
 		return err
 	}
 
-	Info.Printf("Decompressed %s -> %s", srcPath, dstPath)
+	Info.Printf("Decompressed %s -> %s (%s)", srcKey, dstPath, codec.Name())
 	return nil
 }
 
-// CheckBsonIntegrity validates BSON file using bsondump --quiet
-func CheckBsonIntegrity(bsonPath string) error {
-	if _, err := os.Stat(bsonPath); os.IsNotExist(err) {
-		return fmt.Errorf("bson file does not exist: %s", bsonPath)
+// CheckBsonIntegrity validates a BSON file in-process and returns its document and byte counts
+func CheckBsonIntegrity(bsonPath string) (BsonStats, error) {
+	f, err := os.Open(bsonPath)
+	if os.IsNotExist(err) {
+		return BsonStats{}, fmt.Errorf("bson file does not exist: %s", bsonPath)
+	}
+	if err != nil {
+		return BsonStats{}, fmt.Errorf("bson file open failed: %v", err)
 	}
+	defer f.Close()
 
-	cmd := exec.Command("bsondump", "--quiet", bsonPath)
-	if err := cmd.Run(); err != nil {
-		return fmt.Errorf("bson integrity check failed: %v", err)
+	stats, err := ValidateBsonStream(f)
+	if err != nil {
+		return stats, fmt.Errorf("bson integrity check failed: %w", err)
 	}
-	return nil
+	return stats, nil
 }
 
 // CheckMetadataIntegrity validates metadata.json
@@ -114,60 +287,277 @@ func CheckMetadataIntegrity(metaPath string) error {
 	return nil
 }
 
+// BackupHistory is one document of the admin.backupHistory collection
+type BackupHistory struct {
+	Database         string          `bson:"database"`
+	Collection       string          `bson:"collection"`
+	BsonFile         string          `bson:"bsonFile"` // storage key
+	MetaFile         string          `bson:"metaFile"` // storage key
+	ManifestFile     string          `bson:"manifestFile"`
+	BsonURL          string          `bson:"bsonUrl"`
+	MetaURL          string          `bson:"metaUrl"`
+	FileSize         int64           `bson:"fileSize"`
+	RawSize          int64           `bson:"rawSize"`
+	CompressedSize   int64           `bson:"compressedSize"`
+	DocumentCount    int64           `bson:"documentCount"`
+	MongodumpVersion string          `bson:"mongodumpVersion"`
+	Files            []ArtifactInfo  `bson:"files"`
+	Status           string          `bson:"status"`
+	Format           string          `bson:"format"` // bson (mongodump --out) or archive
+	Compression      string          `bson:"compression"`
+	Encryption       *EncryptionInfo `bson:"encryption,omitempty"`
+	Oplog            *OplogInfo      `bson:"oplog,omitempty"`
+	Message          string          `bson:"message"`
+	Timestamp        time.Time       `bson:"timestamp"`
+
+	// ID is set on documents read back, inserts leave it to the server
+	ID primitive.ObjectID `bson:"_id,omitempty"`
+}
+
 // SaveBackupHistory inserts backup record into MongoDB
-func SaveBackupHistory(dbName, collection, bsonFile, metaFile string, fileSize int64, status, compression, msg string) error {
+func SaveBackupHistory(parent context.Context, h BackupHistory) error {
+	if mongoClient == nil {
+		return fmt.Errorf("mongoClient is nil")
+	}
+	if h.Timestamp.IsZero() {
+		h.Timestamp = time.Now()
+	}
+	ctx, cancel := context.WithTimeout(parent, AppConfig.MongoOpTimeout)
+	defer cancel()
+
 	coll := mongoClient.Database("admin").Collection("backupHistory")
-	_, err := coll.InsertOne(context.Background(), map[string]interface{}{
-		"database":    dbName,
-		"collection":  collection,
-		"bsonFile":    bsonFile,
-		"metaFile":    metaFile,
-		"fileSize":    fileSize,
-		"status":      status,
-		"compression": compression,
-		"message":     msg,
-		"timestamp":   time.Now(),
+	_, err := coll.InsertOne(ctx, h)
+	return err
+}
+
+// ListBackupHistory returns the backupHistory documents with one of the given statuses
+func ListBackupHistory(parent context.Context, statuses ...BackupStatus) ([]BackupHistory, error) {
+	if mongoClient == nil {
+		return nil, fmt.Errorf("mongoClient is nil")
+	}
+	ctx, cancel := context.WithTimeout(parent, AppConfig.MongoQueryTimeout)
+	defer cancel()
+
+	values := make([]string, len(statuses))
+	for i, st := range statuses {
+		values[i] = string(st)
+	}
+	coll := mongoClient.Database("admin").Collection("backupHistory")
+	cursor, err := coll.Find(ctx, map[string]interface{}{
+		"status": map[string]interface{}{"$in": values},
+	})
+	if err != nil {
+		return nil, fmt.Errorf("failed to query backup history: %w", err)
+	}
+	var history []BackupHistory
+	if err := cursor.All(ctx, &history); err != nil {
+		return nil, fmt.Errorf("failed to read backup history: %w", err)
+	}
+	return history, nil
+}
+
+// MarkBackupHistory moves the successful or partial history of a backup to status
+func MarkBackupHistory(parent context.Context, dbName, collection string, status BackupStatus, msg string) error {
+	if mongoClient == nil {
+		return fmt.Errorf("mongoClient is nil")
+	}
+	ctx, cancel := context.WithTimeout(parent, AppConfig.MongoOpTimeout)
+	defer cancel()
+
+	coll := mongoClient.Database("admin").Collection("backupHistory")
+	_, err := coll.UpdateMany(ctx, map[string]interface{}{
+		"database":   dbName,
+		"collection": collection,
+		"status":     map[string]interface{}{"$in": []string{string(StatusSuccess), string(StatusPartial)}},
+	}, map[string]interface{}{
+		"$set": map[string]interface{}{
+			"status":          string(status),
+			"statusMessage":   msg,
+			"statusUpdatedAt": time.Now(),
+		},
+	})
+	return err
+}
+
+// MarkBackupHistoryID moves one history document to status
+func MarkBackupHistoryID(parent context.Context, id primitive.ObjectID, status BackupStatus, msg string) error {
+	if mongoClient == nil {
+		return fmt.Errorf("mongoClient is nil")
+	}
+	ctx, cancel := context.WithTimeout(parent, AppConfig.MongoOpTimeout)
+	defer cancel()
+
+	coll := mongoClient.Database("admin").Collection("backupHistory")
+	_, err := coll.UpdateByID(ctx, id, map[string]interface{}{
+		"$set": map[string]interface{}{
+			"status":          string(status),
+			"statusMessage":   msg,
+			"statusUpdatedAt": time.Now(),
+		},
 	})
 	return err
 }
 
-// BulkRestore restores multiple .s2 backup files into MongoDB
-func BulkRestore(restoreList []string, dbName, collection string) {
-	for _, s2BsonFile := range restoreList {
-		bsonFile := s2BsonFile[:len(s2BsonFile)-3]                // remove .s2
-		metaFile := bsonFile[:len(bsonFile)-5] + ".metadata.json" // replace .bson
-		s2MetaFile := metaFile + ".s2"
+// SetBackupHistoryEncryption records re-wrapped encryption info on the history of a backup
+func SetBackupHistoryEncryption(parent context.Context, dbName, collection string, info EncryptionInfo) error {
+	if mongoClient == nil {
+		return fmt.Errorf("mongoClient is nil")
+	}
+	ctx, cancel := context.WithTimeout(parent, AppConfig.MongoOpTimeout)
+	defer cancel()
+
+	coll := mongoClient.Database("admin").Collection("backupHistory")
+	_, err := coll.UpdateMany(ctx, map[string]interface{}{
+		"database":   dbName,
+		"collection": collection,
+		"encryption": map[string]interface{}{"$exists": true},
+	}, map[string]interface{}{
+		"$set": map[string]interface{}{"encryption": info},
+	})
+	return err
+}
+
+// MongorestorePath derives the mongorestore binary from MongodumpPath
+func MongorestorePath() string {
+	dir, base := filepath.Split(AppConfig.MongodumpPath)
+	if !strings.Contains(base, "mongodump") {
+		return "mongorestore"
+	}
+	return filepath.Join(dir, strings.Replace(base, "mongodump", "mongorestore", 1))
+}
+
+// restoreArchive streams an archive artifact into mongorestore --archive without staging it on disk
+func restoreArchive(ctx context.Context, key string, dk *DataKey, dbName, collection string) error {
+	base, codec := SplitArtifactKey(key)
+	srcDB, _, _ := strings.Cut(key, "/")
+	srcColl := strings.TrimSuffix(filepath.Base(base), ".archive")
+	if collection == "" {
+		collection = srcColl
+	}
+
+	// A whole-database archive (COLLECTIONS=*) restores every collection under its own name
+	nsInclude, nsFrom, nsTo := srcDB+"."+srcColl, srcDB+"."+srcColl, dbName+"."+collection
+	if IsAllCollections(srcColl) {
+		if collection != srcColl {
+			return fmt.Errorf("%s holds every collection of %s and cannot be restored into one collection", key, srcDB)
+		}
+		nsInclude, nsFrom, nsTo = srcDB+".*", srcDB+".$coll$", dbName+".$coll$"
+	}
+
+	in, err := BackupStorage.Get(ctx, key)
+	if err != nil {
+		return err
+	}
+	defer in.Close()
+
+	cmd := exec.CommandContext(ctx, MongorestorePath(),
+		"--uri", AppConfig.MongoURI,
+		"--archive",
+		"--drop",
+		"--nsInclude", nsInclude,
+		"--nsFrom", nsFrom,
+		"--nsTo", nsTo,
+	)
+	reader, err := newArtifactReader(in, codec, dk)
+	if err != nil {
+		return err
+	}
+	defer reader.Close()
+	cmd.Stdin = reader
+	output, err := cmd.CombinedOutput()
+	if err != nil {
+		return fmt.Errorf("%v\nOutput: %s", err, string(output))
+	}
+	Info.Printf("Restore successful for %s -> %s (archive)", key, nsTo)
+	return nil
+}
+
+// stageRestoreFiles returns a local BSON file with the content of bsonKey, and its metadata
+// next to it, for mongorestore. An uncompressed, unencrypted artifact on local storage is
+// restored in place; anything else is decoded into a temporary directory removed by cleanup.
+func stageRestoreFiles(ctx context.Context, bsonKey, metaKey string, codec Codec, dk *DataKey) (string, func(), error) {
+	base, _ := SplitArtifactKey(bsonKey)
+	if file := LocalPath(base); codec.Ext() == "" && dk == nil && isStoredArtifact(file, bsonKey) {
+		return file, func() {}, nil
+	}
+
+	dir, err := os.MkdirTemp("", "mongo-restore-")
+	if err != nil {
+		return "", nil, err
+	}
+	cleanup := func() {
+		if !AppConfig.KeepRawFiles {
+			os.RemoveAll(dir)
+			Info.Printf("Cleaned up raw files for %s", bsonKey)
+		}
+	}
+	bsonFile := filepath.Join(dir, path.Base(base))
+	metaFile := strings.TrimSuffix(bsonFile, ".bson") + ".metadata.json"
+	if err := DecompressFile(ctx, codec, dk, bsonKey, bsonFile); err != nil {
+		os.RemoveAll(dir)
+		return "", nil, err
+	}
+	if err := DecompressFile(ctx, codec, dk, metaKey, metaFile); err != nil {
+		Warn.Printf("Failed to decompress metadata: %s -> %s", metaKey, metaFile)
+	}
+	return bsonFile, cleanup, nil
+}
 
-		// Decompress
-		if err := DecompressFileS2(s2BsonFile, bsonFile); err != nil {
-			Error.Printf("Failed to decompress BSON: %s -> %s", s2BsonFile, bsonFile)
+// BulkRestore restores multiple .bson or .archive artifacts from BackupStorage into MongoDB.
+// The decoder is picked from each key's extension, so mixed-codec backups restore together;
+// encrypted artifacts are decrypted with the data key from their manifest.
+// An empty collection restores each file into the collection it was dumped from.
+func BulkRestore(ctx context.Context, restoreList []string, dbName, collection string) error {
+	failed := 0
+	for _, bsonKey := range restoreList {
+		base, codec := SplitArtifactKey(bsonKey)
+		dk, err := ArtifactDataKey(ctx, bsonKey)
+		if err != nil {
+			Error.Printf("Failed to decrypt %s: %v", bsonKey, err)
+			failed++
+			continue
+		}
+		if strings.HasSuffix(base, ".archive") {
+			if err := restoreArchive(ctx, bsonKey, dk, dbName, collection); err != nil {
+				Error.Printf("mongorestore failed for %s: %v", bsonKey, err)
+				failed++
+			}
 			continue
 		}
-		if err := DecompressFileS2(s2MetaFile, metaFile); err != nil {
-			Warn.Printf("Failed to decompress metadata: %s -> %s", s2MetaFile, metaFile)
+
+		metaKey := strings.TrimSuffix(base, ".bson") + ".metadata.json" + strings.TrimPrefix(bsonKey, base)
+		targetColl := collection
+		if targetColl == "" {
+			targetColl = strings.TrimSuffix(path.Base(base), ".bson")
 		}
 
-		restoreFolder := filepath.Dir(bsonFile)
-		restoreCmdPath := AppConfig.MongodumpPath[:len(AppConfig.MongodumpPath)-4] + "restore"
-		cmd := exec.Command(restoreCmdPath,
+		bsonFile, cleanup, err := stageRestoreFiles(ctx, bsonKey, metaKey, codec, dk)
+		if err != nil {
+			Error.Printf("Failed to decompress BSON: %s: %v", bsonKey, err)
+			failed++
+			continue
+		}
+
+		cmd := exec.CommandContext(ctx, MongorestorePath(),
 			"--uri", AppConfig.MongoURI,
 			"--db", dbName,
-			"--collection", collection,
+			"--collection", targetColl,
 			"--drop",
-			restoreFolder,
+			bsonFile,
 		)
 
 		output, err := cmd.CombinedOutput()
+		cleanup()
 		if err != nil {
-			Error.Printf("mongorestore failed for %s: %v\nOutput: %s", restoreFolder, err, string(output))
+			Error.Printf("mongorestore failed for %s: %v\nOutput: %s", bsonFile, err, string(output))
+			failed++
 			continue
 		}
-		Info.Printf("Restore successful for %s (BSON + metadata)", restoreFolder)
+		Info.Printf("Restore successful for %s -> %s.%s (BSON + metadata)", bsonKey, dbName, targetColl)
+	}
 
-		if !AppConfig.KeepRawFiles {
-			os.Remove(bsonFile)
-			os.Remove(metaFile)
-			Info.Printf("Cleaned up raw files for %s", restoreFolder)
-		}
+	if failed > 0 {
+		return fmt.Errorf("%d of %d restores failed", failed, len(restoreList))
 	}
+	return nil
 }
@@ -0,0 +1,141 @@
+package main
+
+import (
+	"bytes"
+	"context"
+	"errors"
+	"fmt"
+	"io"
+	"os"
+	"os/exec"
+	"path/filepath"
+	"syscall"
+	"testing"
+)
+
+// fullStorage fails every upload like a full disk
+type fullStorage struct{ LocalStorage }
+
+func (fullStorage) Put(ctx context.Context, key string, r io.Reader, size int64) error {
+	return fmt.Errorf("failed to write %s: %w", key, syscall.ENOSPC)
+}
+
+func TestStreamArchive(t *testing.T) {
+	cat, err := exec.LookPath("cat")
+	if err != nil {
+		t.Skip("cat not found")
+	}
+	dir := t.TempDir()
+	docs := mustMarshal(t, map[string]int{"_id": 1}, map[string]int{"_id": 2})
+	valid := archiveStream(t, docs)
+	corrupt := append([]byte(nil), valid...)
+	corrupt[len(corrupt)-10] = 0x7e // inside the last document
+	write := func(name string, data []byte) string {
+		p := filepath.Join(dir, name)
+		if err := os.WriteFile(p, data, 0644); err != nil {
+			t.Fatal(err)
+		}
+		return p
+	}
+	validPath, corruptPath := write("valid.archive", valid), write("corrupt.archive", corrupt)
+
+	defer func(s Storage) { BackupStorage = s }(BackupStorage)
+	store := &LocalStorage{Root: filepath.Join(dir, "store")}
+	ctx := context.Background()
+	const key = "db/GPS_2025_01_31/db/GPS_2025_01_31.archive"
+
+	BackupStorage = store
+	info, stats, err := StreamArchive(ctx, noneCodec{}, nil, exec.Command(cat, validPath), key)
+	if err != nil {
+		t.Fatal(err)
+	}
+	if stats.Documents != 2 || info.RawSize != int64(len(valid)) || info.SHA256 == "" {
+		t.Errorf("info = %+v, stats = %+v", info, stats)
+	}
+	if stored := readKey(t, store, key); string(stored) != string(valid) {
+		t.Errorf("stored archive differs from the dump")
+	}
+
+	var corruptErr *BsonCorruptionError
+	_, _, err = StreamArchive(ctx, noneCodec{}, nil, exec.Command(cat, corruptPath), key+".2")
+	if !errors.As(err, &corruptErr) {
+		t.Errorf("corrupt archive: got %v, want a *BsonCorruptionError", err)
+	}
+	if _, err := store.Stat(ctx, key+".2"); !errors.Is(err, ErrObjectNotFound) {
+		t.Errorf("corrupt archive was stored: %v", err)
+	}
+
+	BackupStorage = &fullStorage{}
+	_, _, err = StreamArchive(ctx, noneCodec{}, nil, exec.Command(cat, validPath), key)
+	if errors.As(err, &corruptErr) || !errors.Is(err, syscall.ENOSPC) {
+		t.Errorf("failed upload: got %v, want the storage error", err)
+	}
+	if class := classifyError(err); class != ErrDiskFull {
+		t.Errorf("failed upload classified as %v, want %v", class, ErrDiskFull)
+	}
+}
+
+func TestBulkRestoreKeepsArtifacts(t *testing.T) {
+	tools := t.TempDir()
+	// The fake mongorestore copies the BSON file and metadata it is given next to itself
+	script := "#!/bin/sh\nfor a; do last=$a; done\n" +
+		"cp \"$last\" \"$(dirname \"$0\")/restored.bson\" && cp \"${last%.bson}.metadata.json\" \"$(dirname \"$0\")/restored.metadata.json\"\n"
+	if err := os.WriteFile(filepath.Join(tools, "mongorestore"), []byte(script), 0755); err != nil {
+		t.Fatal(err)
+	}
+
+	defer func(cfg Config, s Storage) { AppConfig, BackupStorage = cfg, s }(AppConfig, BackupStorage)
+	AppConfig.MongodumpPath = filepath.Join(tools, "mongodump")
+	AppConfig.KeepRawFiles = false
+	ctx := context.Background()
+	bson := bytes.Join(mustMarshal(t, map[string]int{"_id": 1}, map[string]int{"_id": 2}), nil)
+	meta := []byte(`{"indexes":[]}`)
+
+	for _, name := range []string{"none", "s2"} {
+		t.Run(name, func(t *testing.T) {
+			AppConfig.BackupPath = t.TempDir()
+			store := &LocalStorage{Root: AppConfig.BackupPath}
+			BackupStorage = store
+			codec, _ := CodecByName(name)
+			bsonKey := "2024_provider1/GPS_2025_01_31/2024_provider1/GPS_2025_01_31.bson" + codec.Ext()
+			metaKey := "2024_provider1/GPS_2025_01_31/2024_provider1/GPS_2025_01_31.metadata.json" + codec.Ext()
+			stored := map[string][]byte{}
+			for key, data := range map[string][]byte{bsonKey: bson, metaKey: meta} {
+				var buf bytes.Buffer
+				w, err := newArtifactWriter(&buf, codec, nil)
+				if err != nil {
+					t.Fatal(err)
+				}
+				w.Write(data)
+				w.Close()
+				stored[key] = buf.Bytes()
+				if err := store.Put(ctx, key, bytes.NewReader(buf.Bytes()), int64(buf.Len())); err != nil {
+					t.Fatal(err)
+				}
+			}
+
+			if err := BulkRestore(ctx, []string{bsonKey}, "restored", ""); err != nil {
+				t.Fatal(err)
+			}
+			for key, data := range stored {
+				if got := readKey(t, store, key); !bytes.Equal(got, data) {
+					t.Errorf("artifact %s changed by the restore: %d bytes, want %d", key, len(got), len(data))
+				}
+			}
+			for file, want := range map[string][]byte{"restored.bson": bson, "restored.metadata.json": meta} {
+				got, err := os.ReadFile(filepath.Join(tools, file))
+				if err != nil || !bytes.Equal(got, want) {
+					t.Errorf("mongorestore got %s = %q (%v), want %q", file, got, err, want)
+				}
+			}
+			// Nothing is staged next to the artifacts
+			list, err := store.List(ctx, "")
+			if err != nil {
+				t.Fatal(err)
+			}
+			if len(list) != len(stored) {
+				t.Errorf("storage holds %d files after the restore, want %d: %v", len(list), len(stored), list)
+			}
+		})
+	}
+}
@@ -0,0 +1,373 @@
+package main
+
+import (
+	"bytes"
+	"context"
+	"crypto/sha256"
+	"encoding/hex"
+	"encoding/json"
+	"flag"
+	"fmt"
+	"io"
+	"os"
+	"path"
+	"sort"
+	"strings"
+	"time"
+
+	"go.mongodb.org/mongo-driver/bson/primitive"
+)
+
+// VerifyTarget is one stored backup to verify
+type VerifyTarget struct {
+	Database      string
+	Collection    string
+	Files         []ArtifactInfo
+	DocumentCount int64  // -1 when nothing was recorded
+	Compression   string // recorded codec; empty to pick it from the file extension
+	Encryption    *EncryptionInfo
+	HistoryID     primitive.ObjectID // backupHistory document, zero for targets found in storage
+}
+
+// VerifyResult is the outcome of verifying one backup
+type VerifyResult struct {
+	Database   string   `json:"database"`
+	Collection string   `json:"collection"`
+	Status     string   `json:"status"` // ok or corrupt
+	Documents  int64    `json:"documents"`
+	Problems   []string `json:"problems,omitempty"`
+	Notes      []string `json:"notes,omitempty"`
+}
+
+// VerifyReport is written at the end of a verify run
+type VerifyReport struct {
+	Source     string         `json:"source"`
+	StartedAt  time.Time      `json:"startedAt"`
+	FinishedAt time.Time      `json:"finishedAt"`
+	Checked    int            `json:"checked"`
+	OK         int            `json:"ok"`
+	Corrupt    int            `json:"corrupt"`
+	Results    []VerifyResult `json:"results"`
+}
+
+// VerifyBackup decompresses every artifact of t as a stream, checks it against the
+// recorded checksum, parses every BSON document and compares the document count
+func VerifyBackup(ctx context.Context, t VerifyTarget) VerifyResult {
+	res := VerifyResult{Database: t.Database, Collection: t.Collection, Status: "ok"}
+
+	var dk *DataKey
+	if t.Encryption != nil {
+		var err error
+		if BackupKeys == nil {
+			err = fmt.Errorf("master key %q is not configured", t.Encryption.KeyID)
+		} else {
+			dk, err = BackupKeys.Unwrap(*t.Encryption)
+		}
+		if err != nil {
+			res.Status = string(StatusCorrupt)
+			res.Problems = append(res.Problems, fmt.Sprintf("cannot decrypt: %v", err))
+			return res
+		}
+	}
+
+	for _, a := range t.Files {
+		docs, problems, notes := verifyArtifact(ctx, a, t.Compression, dk)
+		res.Problems = append(res.Problems, problems...)
+		res.Notes = append(res.Notes, notes...)
+		if docs >= 0 {
+			res.Documents += docs
+		}
+	}
+
+	if t.DocumentCount >= 0 && res.Documents != t.DocumentCount {
+		res.Problems = append(res.Problems, fmt.Sprintf("document count %d, recorded %d", res.Documents, t.DocumentCount))
+	}
+	if len(res.Problems) > 0 {
+		res.Status = string(StatusCorrupt)
+	}
+	return res
+}
+
+// verifyArtifact streams one artifact and returns its document count (-1 if not a BSON file)
+func verifyArtifact(ctx context.Context, a ArtifactInfo, compression string, dk *DataKey) (int64, []string, []string) {
+	var problems, notes []string
+	docs := int64(-1)
+	if strings.HasSuffix(a.Key, EncryptedExt) && dk == nil {
+		return docs, []string{fmt.Sprintf("%s: encrypted but no data key is recorded", a.Key)}, nil
+	}
+
+	r, err := BackupStorage.Get(ctx, a.Key)
+	if err != nil {
+		return docs, []string{fmt.Sprintf("%s: %v", a.Key, err)}, nil
+	}
+	defer r.Close()
+
+	hasher := sha256.New()
+	tee := io.TeeReader(r, hasher)
+	base, _ := SplitArtifactKey(a.Key)
+	codec := CodecFor(a.Key, compression)
+	reader, err := newArtifactReader(tee, codec, dk)
+	if err != nil {
+		return docs, []string{fmt.Sprintf("%s: %s decoder: %v", a.Key, codec.Name(), err)}, nil
+	}
+	defer reader.Close()
+
+	switch {
+	case path.Base(base) == OplogName:
+		// captured oplog entries, not counted as documents of the backup
+		if _, err := ValidateBsonStream(reader); err != nil {
+			problems = append(problems, fmt.Sprintf("%s: invalid oplog BSON: %v", a.Key, err))
+		}
+	case strings.HasSuffix(base, ".bson"):
+		stats, err := ValidateBsonStream(reader)
+		docs = stats.Documents
+		if err != nil {
+			problems = append(problems, fmt.Sprintf("%s: invalid BSON: %v", a.Key, err))
+		}
+	case strings.HasSuffix(base, ".archive"):
+		stats, err := ValidateArchiveStream(reader)
+		docs = stats.Documents
+		if err != nil {
+			problems = append(problems, fmt.Sprintf("%s: invalid archive: %v", a.Key, err))
+		}
+	case strings.HasSuffix(base, ".metadata.json"):
+		var tmp map[string]interface{}
+		if err := json.NewDecoder(reader).Decode(&tmp); err != nil {
+			problems = append(problems, fmt.Sprintf("%s: invalid metadata JSON: %v", a.Key, err))
+		}
+	default:
+		if _, err := io.Copy(io.Discard, reader); err != nil {
+			problems = append(problems, fmt.Sprintf("%s: decompress failed: %v", a.Key, err))
+		}
+	}
+
+	// Drain the rest so the checksum covers the whole object
+	if _, err := io.Copy(io.Discard, tee); err != nil {
+		problems = append(problems, fmt.Sprintf("%s: read failed: %v", a.Key, err))
+		return docs, problems, notes
+	}
+
+	sum := hex.EncodeToString(hasher.Sum(nil))
+	switch {
+	case a.SHA256 == "":
+		notes = append(notes, fmt.Sprintf("%s: no checksum recorded", a.Key))
+	case sum != a.SHA256:
+		problems = append(problems, fmt.Sprintf("%s: sha256 %s, recorded %s", a.Key, sum, a.SHA256))
+	}
+	return docs, problems, notes
+}
+
+// verifyTargetsFromHistory builds targets from the newest successful or partial backupHistory
+// document of every backup. Older documents of a re-taken backup describe overwritten
+// artifacts and are not checked, nor are backups whose newest document is already corrupt.
+func verifyTargetsFromHistory(ctx context.Context) ([]VerifyTarget, error) {
+	history, err := ListBackupHistory(ctx, StatusSuccess, StatusPartial, StatusCorrupt)
+	if err != nil {
+		return nil, err
+	}
+	latest := map[[2]string]BackupHistory{}
+	for _, h := range history {
+		key := [2]string{h.Database, h.Collection}
+		if cur, ok := latest[key]; !ok || h.Timestamp.After(cur.Timestamp) {
+			latest[key] = h
+		}
+	}
+	var targets []VerifyTarget
+	for _, h := range latest {
+		if h.Status == string(StatusCorrupt) {
+			continue
+		}
+		t := VerifyTarget{Database: h.Database, Collection: h.Collection, Files: h.Files, DocumentCount: h.DocumentCount, Compression: h.Compression, Encryption: h.Encryption, HistoryID: h.ID}
+		if len(h.Files) == 0 {
+			// Recorded before checksums existed
+			t.Files = []ArtifactInfo{{Key: h.BsonFile}}
+			if h.MetaFile != "" {
+				t.Files = append(t.Files, ArtifactInfo{Key: h.MetaFile})
+			}
+			t.DocumentCount = -1
+		}
+		targets = append(targets, t)
+	}
+	return targets, nil
+}
+
+// verifyTargetsFromStorage builds targets by walking the manifests in BackupStorage;
+// backups without a readable manifest are checked for content only
+func verifyTargetsFromStorage(ctx context.Context) ([]VerifyTarget, error) {
+	objects, err := BackupStorage.List(ctx, "")
+	if err != nil {
+		return nil, err
+	}
+
+	var targets []VerifyTarget
+	manifests := map[string]bool{}
+	for _, obj := range objects {
+		if path.Base(obj.Key) != ManifestName {
+			continue
+		}
+		m, err := ReadManifest(ctx, obj.Key)
+		if err != nil {
+			Warn.Printf("Unreadable manifest, checking content only: %s: %v", obj.Key, err)
+			continue
+		}
+		manifests[path.Dir(obj.Key)] = true
+		targets = append(targets, VerifyTarget{Database: m.Database, Collection: m.Collection, Files: m.Files, DocumentCount: m.DocumentCount, Compression: m.Compression, Encryption: m.Encryption})
+	}
+
+	for _, obj := range objects {
+		if manifests[path.Dir(obj.Key)] {
+			continue
+		}
+		dbName, _, _ := strings.Cut(obj.Key, "/")
+		base, _ := SplitArtifactKey(obj.Key)
+		if path.Base(base) == OplogName {
+			continue // listed in the manifest of the backup
+		}
+		if strings.HasSuffix(base, ".archive") {
+			targets = append(targets, VerifyTarget{
+				Database:      dbName,
+				Collection:    strings.TrimSuffix(path.Base(base), ".archive"),
+				Files:         []ArtifactInfo{{Key: obj.Key}},
+				DocumentCount: -1,
+			})
+			continue
+		}
+		if !strings.HasSuffix(base, ".bson") {
+			continue
+		}
+		metaKey := strings.TrimSuffix(base, ".bson") + ".metadata.json" + strings.TrimPrefix(obj.Key, base)
+		targets = append(targets, VerifyTarget{
+			Database:      dbName,
+			Collection:    strings.TrimSuffix(path.Base(base), ".bson"),
+			Files:         []ArtifactInfo{{Key: obj.Key}, {Key: metaKey}},
+			DocumentCount: -1,
+		})
+	}
+	return targets, nil
+}
+
+// runVerifyCommand implements the "verify" subcommand and returns the process exit code
+func runVerifyCommand(ctx context.Context, args []string) int {
+	fs := flag.NewFlagSet("verify", flag.ContinueOnError)
+	var dbPatterns stringList
+	fs.Var(&dbPatterns, "db", "database name or glob, repeatable (default: all)")
+	source := fs.String("source", "history", "where to find backups: history (backupHistory) or storage (manifests)")
+	date := fs.String("date", "", "only verify this backup date")
+	from := fs.String("from", "", "only verify backups from this date")
+	to := fs.String("to", "", "only verify backups up to this date")
+	reportPath := fs.String("report", "", "local path of the JSON report (default: _reports/ in the storage backend)")
+	if err := fs.Parse(args); err != nil {
+		return 2
+	}
+
+	var dates map[string]bool
+	if *date != "" || *from != "" || *to != "" {
+		list, err := ParseDateArgs(*date, *from, *to)
+		if err != nil {
+			Error.Printf("verify: %v", err)
+			return 2
+		}
+		dates = map[string]bool{}
+		for _, d := range list {
+			dates[FormatDate(d)] = true
+		}
+	}
+
+	if err := ConnectMongo(ctx, AppConfig.MongoURI); err != nil {
+		Error.Printf("Failed to connect MongoDB: %v", err)
+		return 1
+	}
+	defer DisconnectMongo()
+
+	var targets []VerifyTarget
+	var err error
+	switch *source {
+	case "history":
+		targets, err = verifyTargetsFromHistory(ctx)
+	case "storage":
+		targets, err = verifyTargetsFromStorage(ctx)
+	default:
+		Error.Printf("verify: unknown --source %q (expected history or storage)", *source)
+		return 2
+	}
+	if err != nil {
+		Error.Printf("verify: %v", err)
+		return 1
+	}
+	sort.Slice(targets, func(i, j int) bool {
+		if targets[i].Database != targets[j].Database {
+			return targets[i].Database < targets[j].Database
+		}
+		return targets[i].Collection < targets[j].Collection
+	})
+
+	report := VerifyReport{Source: *source, StartedAt: time.Now()}
+	interrupted := false
+	for _, t := range targets {
+		if ctx.Err() != nil {
+			Warn.Printf("Shutdown signal received, verify stopped after %d backups", report.Checked)
+			interrupted = true
+			break
+		}
+		if !matchesAny(t.Database, dbPatterns) {
+			continue
+		}
+		if d, _ := CollectionDate(t.Collection); dates != nil && !dates[FormatDate(d)] {
+			continue
+		}
+
+		res := VerifyBackup(ctx, t)
+		report.Checked++
+		if res.Status == string(StatusCorrupt) {
+			report.Corrupt++
+			Error.Printf("[CORRUPT] DB=%s Collection=%s Problems=%s", res.Database, res.Collection, strings.Join(res.Problems, "; "))
+			if err := markCorrupt(ctx, t, strings.Join(res.Problems, "; ")); err != nil {
+				Error.Printf("Failed to mark backup history corrupt: DB=%s Collection=%s Error=%v", res.Database, res.Collection, err)
+			}
+		} else {
+			report.OK++
+			Info.Printf("[OK] DB=%s Collection=%s Docs=%d", res.Database, res.Collection, res.Documents)
+		}
+		report.Results = append(report.Results, res)
+	}
+	report.FinishedAt = time.Now()
+
+	if err := writeVerifyReport(context.WithoutCancel(ctx), report, *reportPath); err != nil {
+		Error.Printf("Failed to write verify report: %v", err)
+	}
+	Info.Printf("Verify finished: checked=%d ok=%d corrupt=%d", report.Checked, report.OK, report.Corrupt)
+	if report.Corrupt > 0 || interrupted {
+		return 1
+	}
+	return 0
+}
+
+// markCorrupt flags the history of a corrupt backup: the verified document itself, or every
+// current document of the backup when it was found in storage
+func markCorrupt(ctx context.Context, t VerifyTarget, msg string) error {
+	if t.HistoryID.IsZero() {
+		return MarkBackupHistory(ctx, t.Database, t.Collection, StatusCorrupt, msg)
+	}
+	return MarkBackupHistoryID(ctx, t.HistoryID, StatusCorrupt, msg)
+}
+
+// writeVerifyReport writes the report to localPath, or to _reports/ in the storage backend
+func writeVerifyReport(ctx context.Context, report VerifyReport, localPath string) error {
+	data, err := json.MarshalIndent(report, "", "  ")
+	if err != nil {
+		return err
+	}
+	if localPath != "" {
+		if err := os.WriteFile(localPath, data, 0644); err != nil {
+			return err
+		}
+		Info.Printf("Verify report written: %s", localPath)
+		return nil
+	}
+	key := fmt.Sprintf("_reports/verify_%s.json", report.StartedAt.Format("2006_01_02_15_04_05"))
+	if err := BackupStorage.Put(ctx, key, bytes.NewReader(data), int64(len(data))); err != nil {
+		return err
+	}
+	Info.Printf("Verify report written: %s", BackupStorage.URL(key))
+	return nil
+}